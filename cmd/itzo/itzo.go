@@ -24,6 +24,7 @@ import (
 	"strconv"
 
 	"github.com/elotl/itzo/pkg/api"
+	"github.com/elotl/itzo/pkg/cgroup"
 	"github.com/elotl/itzo/pkg/server"
 	"github.com/elotl/itzo/pkg/unit"
 	"github.com/elotl/itzo/pkg/util"
@@ -48,15 +49,35 @@ func main() {
 	var apprestartpolicy = flag.String("restartpolicy", string(api.RestartPolicyAlways), "Unit restart policy: always, never or onfailure")
 	var workingdir = flag.String("workingdir", "", "Working directory for unit")
 	var netns = flag.String("netns", "", "Pod network namespace name")
+	var pause = flag.Bool("pause", false, "Hold the PID and IPC namespaces of the pod")
+	var defaultRlimits = flag.String("default-rlimits", "", "Default resource limits of units, e.g. nofile=1024:4096,core=0")
+	var rlimits = flag.String("rlimits", "", "Set resource limits and execute the command line arguments")
+	var unitShim = flag.Int(unit.ShimFlag, 0, "Wait for the unit helper on this file descriptor, then execute the command line arguments")
 	// todo, ability to log to a file instead of stdout
 	var usePodman = flag.Bool("use-podman", false, "use podman.io as container runtime")
 	var useAnka = flag.Bool("use-anka", false, "use Veertu's anka as a VM runtime")
+	var imagePullParallelism = flag.Int("image-pull-parallelism", server.ImagePullParallelism, "Maximum number of images pulled at the same time")
 
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 
 	go reaper.Reap()
 
+	if *pause {
+		unit.Pause()
+		os.Exit(0)
+	}
+
+	if *rlimits != "" {
+		err := unit.ExecWithRlimits(*rlimits, flag.Args())
+		glog.Fatalf("Error executing %v: %v", flag.Args(), err)
+	}
+
+	if *unitShim != 0 {
+		err := unit.ExecUnitCommand(*unitShim, flag.Args())
+		glog.Fatalf("Error executing %v: %v", flag.Args(), err)
+	}
+
 	if *appcmdline != "" {
 		policy := api.RestartPolicy(*apprestartpolicy)
 		if *usePodman {
@@ -91,7 +112,21 @@ func main() {
 		runtimeName = runtime.AnkaRuntimeName
 	}
 
+	var err error
+	unit.DefaultRlimits, err = unit.ParseRlimits(*defaultRlimits)
+	if err != nil {
+		glog.Fatalf("Invalid default resource limits: %v", err)
+	}
+
+	server.ImagePullParallelism = *imagePullParallelism
+
 	glog.Infof("Starting up agent, is podman used? %s", strconv.FormatBool(*usePodman))
+	if runtimeName == runtime.ItzoRuntimeName {
+		err := cgroup.Setup()
+		if err != nil {
+			glog.Errorf("Setting up cgroups for units: %v", err)
+		}
+	}
 	// TODO if podman flag is set, ensure that podman service is running
 	server := server.New(*rootdir, runtimeName)
 	endpoint := fmt.Sprintf("0.0.0.0:%d", *port)
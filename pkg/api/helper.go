@@ -16,7 +16,13 @@ limitations under the License.
 
 package api
 
-const PodName string = "itzopod"
+import "time"
+
+const (
+	PodName string = "itzopod"
+
+	DefaultTerminationGracePeriodSeconds int64 = 30
+)
 
 func IsHostNetwork(securityContext *PodSecurityContext) bool {
 	if securityContext == nil {
@@ -29,6 +35,35 @@ func IsHostNetwork(securityContext *PodSecurityContext) bool {
 	return true
 }
 
+// GetPidNamespaceMode returns the PID namespace mode of the units of the pod.
+// Units get their own PID namespace unless the pod asks for the one of the
+// node, or for sharing one via shareProcessNamespace, like v1 pods. Pod is
+// the zero value of the mode, so it's not enough to share the namespace,
+// otherwise any pod setting only e.g. its network mode would.
+func GetPidNamespaceMode(securityContext *PodSecurityContext) NamespaceMode {
+	if securityContext == nil {
+		return NamespaceModeContainer
+	}
+	options := securityContext.NamespaceOptions
+	if options != nil && options.Pid != NamespaceModePod {
+		return options.Pid
+	}
+	share := securityContext.ShareProcessNamespace
+	if share != nil && *share {
+		return NamespaceModePod
+	}
+	return NamespaceModeContainer
+}
+
+// GetIpcNamespaceMode returns the IPC namespace mode of the units of the pod.
+// Units share the IPC namespace of the pod by default.
+func GetIpcNamespaceMode(securityContext *PodSecurityContext) NamespaceMode {
+	if securityContext == nil || securityContext.NamespaceOptions == nil {
+		return NamespaceModePod
+	}
+	return securityContext.NamespaceOptions.Ipc
+}
+
 func MakeStillCreatingStatus(name, image, reason string) *UnitStatus {
 	return &UnitStatus{
 		Name: name,
@@ -54,3 +89,21 @@ func MakeFailedUpdateStatus(name, image, reason string) *UnitStatus {
 		Image: image,
 	}
 }
+
+// GetTerminationGracePeriod returns how long a unit is given to shut down
+// after it has been sent its stop signal. The unit level setting takes
+// precedence over the pod level one. Runtimes that know the StopTimeout of the
+// image, like the itzo one, only fall back on it if neither is set.
+func GetTerminationGracePeriod(spec *PodSpec, unit *Unit) time.Duration {
+	seconds := DefaultTerminationGracePeriodSeconds
+	if spec != nil && spec.TerminationGracePeriodSeconds != nil {
+		seconds = *spec.TerminationGracePeriodSeconds
+	}
+	if unit != nil && unit.TerminationGracePeriodSeconds != nil {
+		seconds = *unit.TerminationGracePeriodSeconds
+	}
+	if seconds < 0 {
+		seconds = 0
+	}
+	return time.Duration(seconds) * time.Second
+}
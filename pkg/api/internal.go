@@ -16,8 +16,11 @@ limitations under the License.
 
 package api
 
+import "time"
+
 type PodParameters struct {
 	Secrets     map[string]map[string][]byte   `json:"secrets"`
+	ConfigMaps  map[string]map[string]string   `json:"configMaps,omitempty"`
 	Credentials map[string]RegistryCredentials `json:"credentials"`
 	Spec        PodSpec                        `json:"spec"`
 	Annotations map[string]string
@@ -27,6 +30,18 @@ type PodParameters struct {
 	PodHostname string
 }
 
+// RestartBackoff configures the exponential backoff between restarts of the
+// units of a pod. Zero values mean the defaults of the runtime.
+type RestartBackoff struct {
+	// Initial delay before restarting a unit.
+	Base time.Duration `json:"base,omitempty"`
+	// Cap on the delay.
+	Max time.Duration `json:"max,omitempty"`
+	// The delay goes back to Base once a unit has been running for this
+	// long.
+	Reset time.Duration `json:"reset,omitempty"`
+}
+
 type RegistryCredentials struct {
 	Server   string `json:"server"`
 	Username string `json:"username"`
@@ -38,6 +53,19 @@ type PodStatusReply struct {
 	InitUnitStatuses []UnitStatus    `json:"initUnitStatus"`
 	ResourceUsage    ResourceMetrics `json:"resourceUsage,omitempty"`
 	PodIP            string          `json:"podIP"`
+	// Phase of the pod computed from the statuses of its units: Pending,
+	// Running, Succeeded or Failed.
+	Phase      PodPhase       `json:"phase,omitempty"`
+	Conditions []PodCondition `json:"conditions,omitempty"`
+	// Why the pod is in its phase, if it's not obvious from the units,
+	// e.g. DeadlineExceeded.
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Number of times the pod has been restarted because its init units
+	// changed.
+	RestartCount int32 `json:"restartCount"`
+	// When the pod was first created by the agent.
+	StartTime Time `json:"startTime,omitempty"`
 }
 
 type PortForwardParams struct {
@@ -64,3 +92,49 @@ type AttachParams struct {
 type RunCmdParams struct {
 	Command []string
 }
+
+type EventType string
+
+const (
+	EventTypeNormal  EventType = "Normal"
+	EventTypeWarning EventType = "Warning"
+)
+
+// Event is something that happened to the pod or one of its units, like an
+// image pull or a failed probe. Repeats of the same event are counted in the
+// same Event.
+type Event struct {
+	// Changes every time the event is recorded, used as the cursor for
+	// reading events.
+	Sequence int64     `json:"sequence"`
+	Type     EventType `json:"type"`
+	Reason   string    `json:"reason"`
+	Message  string    `json:"message"`
+	// The unit the event is about, empty for events about the whole pod.
+	Unit           string `json:"unit,omitempty"`
+	Count          int32  `json:"count"`
+	FirstTimestamp Time   `json:"firstTimestamp"`
+	LastTimestamp  Time   `json:"lastTimestamp"`
+}
+
+type EventsReply struct {
+	Events []Event `json:"events"`
+	// Pass this as since in the next request to get only newer events.
+	Cursor int64 `json:"cursor"`
+}
+
+// FieldError is a problem with one field of a pod update.
+type FieldError struct {
+	// Path of the field, e.g. spec.units[0].image.
+	Field string `json:"field"`
+	// Kind of the problem, e.g. FieldValueInvalid or FieldValueNotFound.
+	Type   string `json:"type"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ValidationErrorReply is returned with 400 Bad Request when a pod update is
+// rejected, before anything in the pod has been changed.
+type ValidationErrorReply struct {
+	Message string       `json:"message"`
+	Errors  []FieldError `json:"errors"`
+}
@@ -19,6 +19,7 @@ package api
 import (
 	"strings"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
@@ -78,6 +79,19 @@ type PodSpec struct {
 	// +patchMergeKey=ip
 	// +patchStrategy=merge
 	HostAliases []HostAlias `json:"hostAliases,omitempty" patchStrategy:"merge" patchMergeKey:"ip"`
+	// Optional duration in seconds the pod needs to terminate
+	// gracefully. When a unit is stopped, its processes are sent a
+	// termination signal, and if they are still running after the grace
+	// period, they are forcibly killed. Units can override this via their
+	// own terminationGracePeriodSeconds. Defaults to 30 seconds.
+	// +optional
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+	// Optional duration in seconds the pod may be active, counted from
+	// when it was first created. Once it has passed, all units are stopped
+	// and the pod fails with reason DeadlineExceeded. Must be a positive
+	// integer.
+	// +optional
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
 }
 
 // HostAlias holds the mapping between IP and hostnames that will be injected as an entry in the
@@ -145,6 +159,10 @@ type PodDNSConfigOption struct {
 type PodSecurityContext struct {
 	// PID, IPC and network namespace sharing options.
 	NamespaceOptions *NamespaceOption `json:"namespaceOptions,omitempty"`
+	// Share a PID namespace between the units of the pod. A Pod PID mode in
+	// NamespaceOptions is the same as no mode at all, units only share a PID
+	// namespace if this is set.
+	ShareProcessNamespace *bool `json:"shareProcessNamespace,omitempty"`
 	// UID to run pod processes as.
 	RunAsUser *int64 `json:"runAsUser,omitempty"`
 	// GID to run pod processes as.
@@ -154,8 +172,34 @@ type PodSecurityContext struct {
 	SupplementalGroups []int64 `json:"supplementalGroups,omitempty"`
 	// Set these sysctls in the pod.
 	Sysctls []Sysctl `json:"sysctls,omitempty"`
+	// The seccomp profile of the units in the pod, unless they override
+	// it.
+	SeccompProfile *SeccompProfile `json:"seccompProfile,omitempty"`
+}
+
+// SeccompProfile defines the seccomp profile applied to the processes of a
+// unit.
+type SeccompProfile struct {
+	// Type of the profile.
+	Type SeccompProfileType `json:"type"`
+	// Path of a JSON profile in the OCI format, relative to the directory
+	// packages are deployed to, e.g. "<package>/profile.json". Only valid
+	// for the Localhost type.
+	LocalhostProfile *string `json:"localhostProfile,omitempty"`
 }
 
+type SeccompProfileType string
+
+const (
+	// No seccomp filter is applied.
+	SeccompProfileTypeUnconfined SeccompProfileType = "Unconfined"
+	// The default profile of the container runtime, the same one Docker
+	// and containerd use.
+	SeccompProfileTypeRuntimeDefault SeccompProfileType = "RuntimeDefault"
+	// A profile delivered via a package.
+	SeccompProfileTypeLocalhost SeccompProfileType = "Localhost"
+)
+
 // NamespaceOption provides options for Linux namespaces.
 type NamespaceOption struct {
 	// Network namespace for this container/sandbox.
@@ -190,6 +234,18 @@ const (
 	NamespaceModeNode NamespaceMode = 2
 )
 
+// Rlimit is a resource limit of the processes of a unit, see setrlimit(2).
+type Rlimit struct {
+	// Name of the resource, the name of its RLIMIT_ constant in lowercase
+	// without the prefix, e.g. "nofile", "nproc", "memlock", "core" or
+	// "stack".
+	Name string `json:"name"`
+	// Soft limit. The maximum uint64 value means unlimited.
+	Soft uint64 `json:"soft"`
+	// Hard limit, the ceiling for the soft limit.
+	Hard uint64 `json:"hard"`
+}
+
 // Sysctl defines a kernel parameter to be set.
 type Sysctl struct {
 	// Name of a property to set.
@@ -477,6 +533,37 @@ type ResourceSpec struct {
 	PrivateIPOnly bool `json:"privateIPOnly"`
 }
 
+// ResourceName is the name identifying various resources in a ResourceList.
+type ResourceName string
+
+const (
+	// CPU, in cores. (500m = .5 cores)
+	ResourceCPU ResourceName = "cpu"
+	// Memory, in bytes. (500Gi = 500GiB = 500 * 1024 * 1024 * 1024)
+	ResourceMemory ResourceName = "memory"
+	// Number of processes and threads.
+	ResourcePIDs ResourceName = "pids"
+	// Local ephemeral storage used by the writable layer of the root
+	// filesystem of a unit, in bytes.
+	ResourceEphemeralStorage ResourceName = "ephemeral-storage"
+)
+
+// ResourceList is a set of (resource name, quantity) pairs.
+type ResourceList map[ResourceName]resource.Quantity
+
+// ResourceRequirements describes the compute resource requirements of a
+// unit.
+type ResourceRequirements struct {
+	// Limits describes the maximum amount of compute resources allowed.
+	// +optional
+	Limits ResourceList `json:"limits,omitempty"`
+	// Requests describes the minimum amount of compute resources
+	// required. If Requests is omitted for a unit, it defaults to Limits
+	// if that is explicitly specified.
+	// +optional
+	Requests ResourceList `json:"requests,omitempty"`
+}
+
 type TerminationMessagePolicy string
 
 const (
@@ -516,12 +603,21 @@ type Unit struct {
 	// List of environment variables that will be exported inside the unit
 	// before start the application.
 	Env []EnvVar `json:"env"`
+	// List of sources to populate environment variables in the unit. All
+	// keys of a source become environment variables. Keys defined in Env
+	// take precedence over the ones from EnvFrom.
+	// +optional
+	EnvFrom []EnvFromSource `json:"envFrom,omitempty"`
 	// A list of volumes that will be attached in the unit.
 	VolumeMounts []VolumeMount `json:"volumeMounts,omitempty"`
 	// A list of ports that will be opened up for this unit.
 	Ports []ContainerPort `json:"ports,omitempty"`
 	// Working directory to change to before running the command for the unit.
 	WorkingDir string `json:"workingDir,omitempty"`
+	// Compute resources required by this unit. Limits are enforced via
+	// the cgroups of the unit.
+	// +optional
+	Resources ResourceRequirements `json:"resources,omitempty"`
 	// Unit security context.
 	SecurityContext *SecurityContext `json:"securityContext,omitempty"`
 	// Periodic probe of container liveness.  Container will be
@@ -537,6 +633,10 @@ type Unit struct {
 	//initialized. If specified, no other probes are executed until
 	//this completes successfully.
 	StartupProbe *Probe `json:"startupProbe,omitempty"`
+	// Actions that the system should take in response to unit
+	// lifecycle events.
+	// +optional
+	Lifecycle *Lifecycle `json:"lifecycle,omitempty"`
 
 	// Optional: Path at which the file to which the container's
 	// termination message will be written is mounted into the
@@ -556,6 +656,41 @@ type Unit struct {
 	// 2048 bytes or 80 lines, whichever is smaller.  Defaults to
 	// File.  Cannot be updated.
 	TerminationMessagePolicy TerminationMessagePolicy `json:"terminationMessagePolicy,omitempty"`
+
+	// Optional duration in seconds the unit needs to terminate
+	// gracefully. Overrides the terminationGracePeriodSeconds of the pod
+	// and the StopTimeout of the image.
+	// +optional
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+
+	// Optional signal sent to the unit to ask it to shut down, e.g.
+	// "SIGQUIT". Overrides the StopSignal of the image. Defaults to
+	// SIGTERM.
+	// +optional
+	StopSignal string `json:"stopSignal,omitempty"`
+
+	// Optional resource limits of the processes of the unit, e.g.
+	// "nofile" or "nproc". Limits not set here default to the ones
+	// configured for itzo.
+	// +optional
+	Rlimits []Rlimit `json:"rlimits,omitempty"`
+
+	// Whether the unit should allocate a buffer for stdin. If this is
+	// not set, reads from stdin in the unit will always result in EOF.
+	// Default is false.
+	// +optional
+	Stdin bool `json:"stdin,omitempty"`
+
+	// Whether stdin should be closed after the first attach session
+	// disconnects. Stdin is opened again when the unit restarts. Default
+	// is false.
+	// +optional
+	StdinOnce bool `json:"stdinOnce,omitempty"`
+
+	// Whether the unit should allocate a TTY for itself. Default is
+	// false.
+	// +optional
+	TTY bool `json:"tty,omitempty"`
 }
 
 // Optional security context that overrides whatever is set for the pod.
@@ -576,8 +711,33 @@ type SecurityContext struct {
 	RunAsUser *int64 `json:"runAsUser,omitempty"`
 	// Username to run unit processes as.
 	RunAsGroup *int64 `json:"runAsGroup,omitempty"`
+	// The seccomp profile of the unit, overriding the one of the pod.
+	SeccompProfile *SeccompProfile `json:"seccompProfile,omitempty"`
+	// Mount the root filesystem of the unit read-only. Volumes, special
+	// filesystems and the termination message file stay writable.
+	ReadOnlyRootFilesystem *bool `json:"readOnlyRootFilesystem,omitempty"`
+	// Run the unit privileged: it gets all capabilities, and /proc and /sys
+	// are not masked.
+	Privileged *bool `json:"privileged,omitempty"`
+	// Whether processes of the unit can gain more privileges than their
+	// parent, e.g. via setuid binaries. If false, no_new_privs is set.
+	AllowPrivilegeEscalation *bool `json:"allowPrivilegeEscalation,omitempty"`
+	// How /proc and /sys are mounted for the unit. Unlike in Kubernetes,
+	// they are not masked if this is unset.
+	ProcMount *ProcMountType `json:"procMount,omitempty"`
 }
 
+type ProcMountType string
+
+const (
+	// Paths in /proc exposing the host, e.g. /proc/kcore, are masked, and
+	// /proc/sys and /sys are read-only, like in other container runtimes.
+	// Privileged units are never masked.
+	ProcMountTypeDefault ProcMountType = "Default"
+	// /proc and /sys are not masked.
+	ProcMountTypeUnmasked ProcMountType = "Unmasked"
+)
+
 // Capability contains the capabilities to add or drop.
 type Capabilities struct {
 	// List of capabilities to add.
@@ -606,25 +766,107 @@ type EnvVar struct {
 	Name string `json:"name"`
 	// Value of the environment variable.
 	Value string `json:"value"`
-	// An environment variable may also come from a secret.
+	// An environment variable may also come from a field of the pod, a
+	// resource of a unit, a configmap or a secret.
 	ValueFrom *EnvVarSource `json:"valueFrom,omitempty"`
 }
 
 // EnvVarSource represents a source for the value of an EnvVar. Only one of its
 // fields may be set.
 type EnvVarSource struct {
+	// Selects a field of the pod: supports metadata.name, metadata.namespace,
+	// metadata.annotations['<KEY>'], spec.nodeName and status.podIP.
+	// +optional
+	FieldRef *ObjectFieldSelector `json:"fieldRef,omitempty"`
+	// Selects a resource of the unit: limits.cpu, limits.memory,
+	// limits.ephemeral-storage, requests.cpu, requests.memory and
+	// requests.ephemeral-storage.
+	// +optional
+	ResourceFieldRef *ResourceFieldSelector `json:"resourceFieldRef,omitempty"`
+	// Selects a key of a configmap.
+	// +optional
+	ConfigMapKeyRef *ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
 	// Selector for the secret.
 	SecretKeyRef *SecretKeySelector `json:"secretKeyRef,omitempty"`
 }
 
+// ObjectFieldSelector selects a field of the pod.
+type ObjectFieldSelector struct {
+	// Version of the schema the FieldPath is written in terms of, defaults
+	// to "v1".
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+	// Path of the field to select.
+	FieldPath string `json:"fieldPath"`
+}
+
+// ResourceFieldSelector represents a resource of a unit, e.g. its CPU or
+// memory limit.
+type ResourceFieldSelector struct {
+	// Unit name, defaults to the unit the environment variable is defined
+	// in.
+	// +optional
+	ContainerName string `json:"containerName,omitempty"`
+	// Required: resource to select.
+	Resource string `json:"resource"`
+	// Specifies the output format of the exposed resources, defaults to "1".
+	// +optional
+	Divisor resource.Quantity `json:"divisor,omitempty"`
+}
+
+// ConfigMapKeySelector selects a key of a ConfigMap.
+type ConfigMapKeySelector struct {
+	// The name of the configmap in the pod's namespace to select from.
+	Name string `json:"name"`
+	// The key to select.
+	Key string `json:"key"`
+	// Specify whether the configmap or its key must be defined.
+	// +optional
+	Optional *bool `json:"optional,omitempty"`
+}
+
 // SecretKeySelector selects a key of a Secret.
 type SecretKeySelector struct {
 	// The name of the secret in the pod's namespace to select from.
 	Name string `json:"name"`
 	// The key of the secret to select from.  Must be a valid secret key.
 	Key string `json:"key"`
-	// k8s allows optional secrets.  We can add that soon
-	// Optional *bool
+	// Specify whether the secret or its key must be defined.
+	// +optional
+	Optional *bool `json:"optional,omitempty"`
+}
+
+// EnvFromSource represents the source of a set of environment variables.
+// Only one of ConfigMapRef and SecretRef may be set.
+type EnvFromSource struct {
+	// An optional identifier to prepend to each key.
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+	// The configmap to select from.
+	// +optional
+	ConfigMapRef *ConfigMapEnvSource `json:"configMapRef,omitempty"`
+	// The secret to select from.
+	// +optional
+	SecretRef *SecretEnvSource `json:"secretRef,omitempty"`
+}
+
+// ConfigMapEnvSource selects a configmap to populate environment variables
+// with.
+type ConfigMapEnvSource struct {
+	// The name of the configmap in the pod's namespace.
+	Name string `json:"name"`
+	// Specify whether the configmap must be defined.
+	// +optional
+	Optional *bool `json:"optional,omitempty"`
+}
+
+// SecretEnvSource selects a secret to populate environment variables with.
+type SecretEnvSource struct {
+	// The name of the secret in the pod's namespace.
+	Name string `json:"name"`
+	// Specify whether the secret must be defined.
+	// +optional
+	Optional *bool `json:"optional,omitempty"`
 }
 
 // Spot policy. Can be "always", "preferred" or "never", meaning to always use
@@ -653,6 +895,10 @@ type PodSpot struct {
 type PodPhase string
 
 const (
+	// PodPending means that the pod has been accepted, but some of its units
+	// have not been started yet, e.g. because their images are still being
+	// pulled, or init units are still running.
+	PodPending PodPhase = "Pending"
 	// PodWaiting means that we're waiting for the pod to begin running.
 	PodWaiting PodPhase = "Waiting"
 	// PodDispatching means that we have a node to put this pod on
@@ -672,6 +918,45 @@ const (
 	PodTerminated PodPhase = "Terminated"
 )
 
+// PodConditionType is the type of a condition of a pod.
+type PodConditionType string
+
+const (
+	// PodInitialized means that all init units have finished successfully.
+	PodInitialized PodConditionType = "Initialized"
+	// ContainersReady means that all units of the pod are ready.
+	ContainersReady PodConditionType = "ContainersReady"
+	// PodReady means that the pod is able to serve requests.
+	PodReady PodConditionType = "Ready"
+)
+
+// ConditionStatus is the status of a condition: "True", "False" or
+// "Unknown".
+type ConditionStatus string
+
+const (
+	ConditionTrue    ConditionStatus = "True"
+	ConditionFalse   ConditionStatus = "False"
+	ConditionUnknown ConditionStatus = "Unknown"
+)
+
+// PodCondition describes the state of a pod at a certain point.
+type PodCondition struct {
+	// Type of the condition.
+	Type PodConditionType `json:"type"`
+	// Status of the condition.
+	Status ConditionStatus `json:"status"`
+	// Last time the condition transitioned from one status to another.
+	// +optional
+	LastTransitionTime Time `json:"lastTransitionTime,omitempty"`
+	// Unique, one-word, CamelCase reason for the last transition.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// Human-readable message about the last transition.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
 // Restart policy for all units in this pod. It can be "always", "onFailure" or
 // "never". Default is "always".
 type RestartPolicy string
@@ -722,6 +1007,7 @@ const (
 
 type UnitStateWaiting struct {
 	Reason       string `json:"reason"`
+	Message      string `json:"message,omitempty"`
 	StartFailure bool   `json:"startFailure"`
 }
 
@@ -735,6 +1021,9 @@ type UnitStateTerminated struct {
 	Reason     string `json:"reason,omitempty"`
 	Message    string `json:"message,omitempty"`
 	StartedAt  Time   `json:"startedAt,omitempty"`
+	// Set if the unit did not exit within its termination grace period
+	// after it was asked to stop, and had to be killed.
+	ForceKilled bool `json:"forceKilled,omitempty"`
 }
 
 // UnitState holds a possible state of a pod unit.  Only one of its
@@ -826,10 +1115,26 @@ type Handler struct {
 	// HTTPGet specifies the http request to perform.
 	HTTPGet *HTTPGetAction `json:"httpGet,omitempty"`
 	// TCPSocket specifies an action involving a TCP port.
-	// TCP hooks not yet supported
 	TCPSocket *TCPSocketAction `json:"tcpSocket,omitempty"`
 }
 
+// Lifecycle describes actions that should be taken in response to unit
+// lifecycle events.
+type Lifecycle struct {
+	// PostStart is called immediately after a unit is started. If the
+	// handler fails, the unit is terminated and restarted according to
+	// its restart policy. The unit is not considered started until the
+	// hook completes.
+	// +optional
+	PostStart *Handler `json:"postStart,omitempty"`
+	// PreStop is called immediately before a unit is terminated. The
+	// unit is sent its stop signal after the handler completes,
+	// regardless of the outcome of the handler. The time spent running
+	// the handler counts against the termination grace period.
+	// +optional
+	PreStop *Handler `json:"preStop,omitempty"`
+}
+
 // Probe describes a health check to be performed against a container
 // to determine whether it is alive or ready to receive traffic.
 type Probe struct {
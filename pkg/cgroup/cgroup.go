@@ -0,0 +1,167 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cgroup creates and inspects the cgroups of units. Both the legacy
+// (v1) and the unified (v2) hierarchy are supported, the mode is detected
+// once per process.
+package cgroup
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/cgroups"
+	"github.com/golang/glog"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+type Mode int
+
+const (
+	// Legacy is the cgroups v1 hierarchy, with one hierarchy per
+	// controller.
+	Legacy Mode = iota
+	// Unified is the cgroups v2 hierarchy.
+	Unified
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Legacy:
+		return "legacy"
+	case Unified:
+		return "unified"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(m))
+	}
+}
+
+var (
+	// Mount point of the cgroup filesystem.
+	mountPoint = "/sys/fs/cgroup"
+	modeOnce   sync.Once
+	mode       Mode
+)
+
+// GetMode returns the cgroup mode of the system.
+func GetMode() Mode {
+	modeOnce.Do(func() {
+		mode = detectMode(mountPoint)
+	})
+	return mode
+}
+
+func detectMode(path string) Mode {
+	var st unix.Statfs_t
+	err := unix.Statfs(path, &st)
+	if err != nil {
+		glog.Warningf("checking cgroup filesystem at %s: %v", path, err)
+		return Legacy
+	}
+	if st.Type == unix.CGROUP2_SUPER_MAGIC {
+		return Unified
+	}
+	return Legacy
+}
+
+// Setup is called by the agent when it starts up. It detects the cgroup
+// mode, and in unified mode creates the subtree for unit cgroups.
+func Setup() error {
+	m := GetMode()
+	glog.Infof("using %s cgroup hierarchy", m)
+	if m != Unified {
+		return nil
+	}
+	return setupUnifiedSubtree()
+}
+
+// Cgroup is the cgroup of a unit.
+type Cgroup interface {
+	// Add moves a process into the cgroup.
+	Add(pid int) error
+	// Delete removes the cgroup.
+	Delete() error
+	// OOMKillCount returns the number of processes in the cgroup that
+	// have been killed by the OOM killer.
+	OOMKillCount() (uint64, error)
+}
+
+// New creates the cgroup of a unit, with resources applied to it.
+func New(name string, resources *specs.LinuxResources) (Cgroup, error) {
+	if GetMode() == Unified {
+		return newUnified(name, resources)
+	}
+	control, err := cgroups.New(
+		cgroups.V1, cgroups.StaticPath("/"+name), resources)
+	if err != nil {
+		return nil, err
+	}
+	return &legacyCgroup{name: name, control: control}, nil
+}
+
+// Load opens the existing cgroup of a unit.
+func Load(name string) (Cgroup, error) {
+	if GetMode() == Unified {
+		return loadUnified(name)
+	}
+	control, err := cgroups.Load(cgroups.V1, cgroups.StaticPath("/"+name))
+	if err != nil {
+		return nil, err
+	}
+	return &legacyCgroup{name: name, control: control}, nil
+}
+
+type legacyCgroup struct {
+	name    string
+	control cgroups.Cgroup
+}
+
+func (c *legacyCgroup) Add(pid int) error {
+	return c.control.Add(cgroups.Process{Pid: pid})
+}
+
+func (c *legacyCgroup) Delete() error {
+	return c.control.Delete()
+}
+
+// OOMKillCount reads the oom_kill counter from memory.oom_control. It is only
+// present in kernels 4.13 and later.
+func (c *legacyCgroup) OOMKillCount() (uint64, error) {
+	for _, s := range c.control.Subsystems() {
+		if s.Name() != cgroups.Memory {
+			continue
+		}
+		p, ok := s.(interface{ Path(string) string })
+		if !ok {
+			break
+		}
+		path := filepath.Join(p.Path("/"+c.name), "memory.oom_control")
+		values, err := readKeyValues(path)
+		if err != nil {
+			return 0, err
+		}
+		count, ok := values["oom_kill"]
+		if !ok {
+			return 0, fmt.Errorf("no oom_kill counter in %s", path)
+		}
+		return count, nil
+	}
+	return 0, fmt.Errorf("no memory cgroup found for %s", c.name)
+}
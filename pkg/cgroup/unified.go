@@ -0,0 +1,318 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	// Subtree of the unified hierarchy that unit cgroups are created in.
+	// The controllers units need are delegated to it.
+	ItzoSubtree = "itzo"
+)
+
+// Controllers enabled for unit cgroups in unified mode.
+var unifiedControllers = []string{"cpu", "memory", "pids"}
+
+func subtreePath() string {
+	return filepath.Join(mountPoint, ItzoSubtree)
+}
+
+func unifiedPath(name string) string {
+	return filepath.Join(subtreePath(), name)
+}
+
+// setupUnifiedSubtree creates the itzo subtree and enables the controllers
+// needed by units both in the root cgroup and in the subtree. Controllers
+// that are not available are skipped.
+func setupUnifiedSubtree() error {
+	err := os.MkdirAll(subtreePath(), 0755)
+	if err != nil {
+		return fmt.Errorf("creating cgroup subtree %s: %v", subtreePath(), err)
+	}
+	available, err := readControllers(filepath.Join(mountPoint, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("reading available cgroup controllers: %v", err)
+	}
+	for _, dir := range []string{mountPoint, subtreePath()} {
+		for _, controller := range unifiedControllers {
+			if !available[controller] {
+				glog.Warningf("cgroup controller %s is not available", controller)
+				continue
+			}
+			path := filepath.Join(dir, "cgroup.subtree_control")
+			err := writeCgroupFile(path, "+"+controller)
+			if err != nil {
+				return fmt.Errorf("enabling cgroup controller %s in %s: %v",
+					controller, dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+func readControllers(path string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	controllers := make(map[string]bool)
+	for _, c := range strings.Fields(string(data)) {
+		controllers[c] = true
+	}
+	return controllers, nil
+}
+
+func writeCgroupFile(path, value string) error {
+	return ioutil.WriteFile(path, []byte(value), 0644)
+}
+
+type unifiedCgroup struct {
+	path string
+}
+
+func newUnified(name string, resources *specs.LinuxResources) (*unifiedCgroup, error) {
+	if _, err := os.Stat(subtreePath()); os.IsNotExist(err) {
+		err = setupUnifiedSubtree()
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := &unifiedCgroup{path: unifiedPath(name)}
+	err := os.MkdirAll(c.path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = c.apply(resources)
+	if err != nil {
+		c.Delete()
+		return nil, err
+	}
+	return c, nil
+}
+
+// ConvertCPUSharesToWeight converts CPU shares, as used in the legacy
+// hierarchy (2-262144), to cpu.weight (1-10000).
+func ConvertCPUSharesToWeight(shares uint64) uint64 {
+	if shares == 0 {
+		return 0
+	}
+	if shares < 2 {
+		shares = 2
+	}
+	return 1 + ((shares-2)*9999)/262142
+}
+
+// ConvertCPUWeightToShares is the inverse of ConvertCPUSharesToWeight.
+func ConvertCPUWeightToShares(weight uint64) uint64 {
+	if weight == 0 {
+		return 0
+	}
+	return 2 + ((weight-1)*262142)/9999
+}
+
+func (c *unifiedCgroup) apply(resources *specs.LinuxResources) error {
+	if resources == nil {
+		return nil
+	}
+	values := make(map[string]string)
+	if cpu := resources.CPU; cpu != nil {
+		if cpu.Shares != nil && *cpu.Shares > 0 {
+			weight := ConvertCPUSharesToWeight(*cpu.Shares)
+			values["cpu.weight"] = strconv.FormatUint(weight, 10)
+		}
+		if cpu.Quota != nil && *cpu.Quota > 0 {
+			period := uint64(100000)
+			if cpu.Period != nil && *cpu.Period > 0 {
+				period = *cpu.Period
+			}
+			values["cpu.max"] = fmt.Sprintf("%d %d", *cpu.Quota, period)
+		}
+	}
+	if mem := resources.Memory; mem != nil && mem.Limit != nil && *mem.Limit > 0 {
+		values["memory.max"] = strconv.FormatInt(*mem.Limit, 10)
+	}
+	if pids := resources.Pids; pids != nil && pids.Limit > 0 {
+		values["pids.max"] = strconv.FormatInt(pids.Limit, 10)
+	}
+	for file, value := range values {
+		err := writeCgroupFile(filepath.Join(c.path, file), value)
+		if err != nil {
+			return fmt.Errorf("setting %s to %q: %v", file, value, err)
+		}
+	}
+	return nil
+}
+
+func loadUnified(name string) (*unifiedCgroup, error) {
+	c := &unifiedCgroup{path: unifiedPath(name)}
+	if _, err := os.Stat(c.path); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *unifiedCgroup) Add(pid int) error {
+	return writeCgroupFile(
+		filepath.Join(c.path, "cgroup.procs"), strconv.Itoa(pid))
+}
+
+func (c *unifiedCgroup) Delete() error {
+	err := os.Remove(c.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// OOMKillCount reads the oom_kill counter from memory.events.
+func (c *unifiedCgroup) OOMKillCount() (uint64, error) {
+	path := filepath.Join(c.path, "memory.events")
+	values, err := readKeyValues(path)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := values["oom_kill"]
+	if !ok {
+		return 0, fmt.Errorf("no oom_kill counter in %s", path)
+	}
+	return count, nil
+}
+
+// UnifiedStats holds the statistics and limits of a unit cgroup in unified
+// mode. Limits are zero if they are not set.
+type UnifiedStats struct {
+	CPUUsageNanos         uint64
+	CPUWeight             uint64
+	CPUQuota              int64
+	CPUPeriod             uint64
+	MemoryUsage           uint64
+	MemoryLimit           uint64
+	MemoryAnon            uint64
+	MemoryInactiveFile    uint64
+	MemoryPageFaults      uint64
+	MemoryMajorPageFaults uint64
+	PidsCurrent           uint64
+	PidsLimit             uint64
+	OOMKills              uint64
+}
+
+// ReadUnifiedStats reads the statistics of the cgroup of a unit in unified
+// mode.
+func ReadUnifiedStats(name string) (*UnifiedStats, error) {
+	dir := unifiedPath(name)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	stats := &UnifiedStats{}
+	cpuStat, err := readKeyValues(filepath.Join(dir, "cpu.stat"))
+	if err == nil {
+		stats.CPUUsageNanos = cpuStat["usage_usec"] * 1000
+	}
+	stats.CPUWeight, _ = readUint(filepath.Join(dir, "cpu.weight"))
+	stats.CPUQuota, stats.CPUPeriod, _ = readCPUMax(filepath.Join(dir, "cpu.max"))
+	memStat, err := readKeyValues(filepath.Join(dir, "memory.stat"))
+	if err == nil {
+		stats.MemoryAnon = memStat["anon"]
+		stats.MemoryInactiveFile = memStat["inactive_file"]
+		stats.MemoryPageFaults = memStat["pgfault"]
+		stats.MemoryMajorPageFaults = memStat["pgmajfault"]
+	}
+	stats.MemoryUsage, _ = readUint(filepath.Join(dir, "memory.current"))
+	stats.MemoryLimit, _ = readUint(filepath.Join(dir, "memory.max"))
+	stats.PidsCurrent, _ = readUint(filepath.Join(dir, "pids.current"))
+	stats.PidsLimit, _ = readUint(filepath.Join(dir, "pids.max"))
+	memEvents, err := readKeyValues(filepath.Join(dir, "memory.events"))
+	if err == nil {
+		stats.OOMKills = memEvents["oom_kill"]
+	}
+	return stats, nil
+}
+
+// readUint reads a single value from a cgroup file. "max" is returned as
+// zero.
+func readUint(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// readCPUMax parses cpu.max, which contains "$QUOTA $PERIOD" where the quota
+// might be "max".
+func readCPUMax(path string) (int64, uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid cpu.max %q", string(data))
+	}
+	period, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if fields[0] == "max" {
+		return 0, period, nil
+	}
+	quota, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return quota, period, nil
+}
+
+// readKeyValues parses flat keyed cgroup files like cpu.stat or memory.stat.
+func readKeyValues(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[fields[0]] = v
+	}
+	return values, scanner.Err()
+}
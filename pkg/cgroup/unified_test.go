@@ -0,0 +1,144 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupFakeMountPoint(t *testing.T) func() {
+	tmpdir, err := ioutil.TempDir("", "itzo-cgroup-test")
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(
+		filepath.Join(tmpdir, "cgroup.controllers"), []byte("cpu io memory pids\n"), 0644)
+	assert.NoError(t, err)
+	origMountPoint := mountPoint
+	mountPoint = tmpdir
+	return func() {
+		mountPoint = origMountPoint
+		os.RemoveAll(tmpdir)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestNewUnified(t *testing.T) {
+	cleanup := setupFakeMountPoint(t)
+	defer cleanup()
+	shares := uint64(512)
+	quota := int64(50000)
+	period := uint64(100000)
+	memLimit := int64(64 * 1024 * 1024)
+	resources := &specs.LinuxResources{
+		CPU: &specs.LinuxCPU{
+			Shares: &shares,
+			Quota:  &quota,
+			Period: &period,
+		},
+		Memory: &specs.LinuxMemory{Limit: &memLimit},
+		Pids:   &specs.LinuxPids{Limit: 10},
+	}
+	c, err := newUnified("myunit", resources)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(mountPoint, "cgroup.subtree_control"))
+	assert.FileExists(t, filepath.Join(subtreePath(), "cgroup.subtree_control"))
+	dir := unifiedPath("myunit")
+	assert.Equal(t, "20", readFile(t, filepath.Join(dir, "cpu.weight")))
+	assert.Equal(t, "50000 100000", readFile(t, filepath.Join(dir, "cpu.max")))
+	assert.Equal(t, "67108864", readFile(t, filepath.Join(dir, "memory.max")))
+	assert.Equal(t, "10", readFile(t, filepath.Join(dir, "pids.max")))
+	err = c.Add(1234)
+	assert.NoError(t, err)
+	assert.Equal(t, "1234", readFile(t, filepath.Join(dir, "cgroup.procs")))
+}
+
+func TestReadUnifiedStats(t *testing.T) {
+	cleanup := setupFakeMountPoint(t)
+	defer cleanup()
+	dir := unifiedPath("myunit")
+	err := os.MkdirAll(dir, 0755)
+	assert.NoError(t, err)
+	files := map[string]string{
+		"cpu.stat":       "usage_usec 1500\nuser_usec 1000\nsystem_usec 500\n",
+		"cpu.weight":     "100\n",
+		"cpu.max":        "max 100000\n",
+		"memory.current": "4096000\n",
+		"memory.max":     "max\n",
+		"memory.stat":    "anon 1024000\ninactive_file 96000\npgfault 42\npgmajfault 3\n",
+		"pids.current":   "7\n",
+		"pids.max":       "100\n",
+		"memory.events":  "low 0\nhigh 0\nmax 5\noom 2\noom_kill 2\n",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		assert.NoError(t, err)
+	}
+	stats, err := ReadUnifiedStats("myunit")
+	assert.NoError(t, err)
+	assert.Equal(t, &UnifiedStats{
+		CPUUsageNanos:         1500000,
+		CPUWeight:             100,
+		CPUQuota:              0,
+		CPUPeriod:             100000,
+		MemoryUsage:           4096000,
+		MemoryLimit:           0,
+		MemoryAnon:            1024000,
+		MemoryInactiveFile:    96000,
+		MemoryPageFaults:      42,
+		MemoryMajorPageFaults: 3,
+		PidsCurrent:           7,
+		PidsLimit:             100,
+		OOMKills:              2,
+	}, stats)
+	_, err = ReadUnifiedStats("nonexistent")
+	assert.Error(t, err)
+}
+
+func TestConvertCPUShares(t *testing.T) {
+	assert.Equal(t, uint64(1), ConvertCPUSharesToWeight(2))
+	assert.Equal(t, uint64(39), ConvertCPUSharesToWeight(1024))
+	assert.Equal(t, uint64(10000), ConvertCPUSharesToWeight(262144))
+	assert.Equal(t, uint64(2), ConvertCPUWeightToShares(1))
+	assert.Equal(t, uint64(262144), ConvertCPUWeightToShares(10000))
+}
+
+func TestUnifiedOOMKillCount(t *testing.T) {
+	cleanup := setupFakeMountPoint(t)
+	defer cleanup()
+	c, err := newUnified("myunit", nil)
+	assert.NoError(t, err)
+	_, err = c.OOMKillCount()
+	assert.Error(t, err)
+	err = ioutil.WriteFile(
+		filepath.Join(c.path, "memory.events"), []byte("oom 1\noom_kill 1\n"), 0644)
+	assert.NoError(t, err)
+	count, err := c.OOMKillCount()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), count)
+}
@@ -179,6 +179,9 @@ func UnitToContainer(unit api.Unit, container *v1.Container) v1.Container {
 	container.Command = unit.Command
 	container.Args = unit.Args
 	container.WorkingDir = unit.WorkingDir
+	container.Stdin = unit.Stdin
+	container.StdinOnce = unit.StdinOnce
+	container.TTY = unit.TTY
 	container.Env = make([]v1.EnvVar, len(unit.Env))
 	for i, e := range unit.Env {
 		container.Env[i] = v1.EnvVar{
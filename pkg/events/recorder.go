@@ -0,0 +1,172 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/golang/glog"
+)
+
+// Reasons of events, the same ones kubelet uses where there is one.
+const (
+	PullingImage        = "Pulling"
+	PulledImage         = "Pulled"
+	FailedToPullImage   = "Failed"
+	CreatedUnit         = "Created"
+	StartedUnit         = "Started"
+	FailedToCreateUnit  = "Failed"
+	FailedToStartUnit   = "Failed"
+	KillingUnit         = "Killing"
+	BackOffStartUnit    = "BackOff"
+	UnitUnhealthy       = "Unhealthy"
+	UnitProbeWarning    = "ProbeWarning"
+	UnitOOMKilled       = "OOMKilled"
+	UnitEvicted         = "Evicted"
+	FailedMountVolume   = "FailedMount"
+	PodRestarted        = "PodRestarted"
+	PodDeadlineExceeded = "DeadlineExceeded"
+)
+
+const DefaultCapacity = 1000
+
+type eventKey struct {
+	eventType api.EventType
+	reason    string
+	unit      string
+	message   string
+}
+
+// Recorder keeps the most recent events of the pod in memory. An event that
+// is the same as an earlier one (same type, reason, unit and message) bumps
+// the count and last timestamp of the earlier one, and moves it to the end of
+// the stream. Once there are more than capacity events, the ones that
+// haven't been seen for the longest time are dropped. A nil Recorder drops
+// all events.
+type Recorder struct {
+	lock     sync.Mutex
+	capacity int
+	sequence int64
+	events   map[eventKey]*api.Event
+}
+
+func NewRecorder(capacity int) *Recorder {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Recorder{
+		capacity: capacity,
+		events:   make(map[eventKey]*api.Event),
+	}
+}
+
+// Event records an event that happened now. Unit is empty for events about
+// the pod.
+func (r *Recorder) Event(unit string, eventType api.EventType, reason, message string) {
+	now := api.Now()
+	r.Record(api.Event{
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Unit:           unit,
+		Count:          1,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+	})
+}
+
+func (r *Recorder) Eventf(unit string, eventType api.EventType, reason, format string, args ...interface{}) {
+	r.Event(unit, eventType, reason, fmt.Sprintf(format, args...))
+}
+
+// Record adds an event recorded elsewhere, e.g. by the helper of a unit,
+// keeping its count and timestamps.
+func (r *Recorder) Record(event api.Event) {
+	if r == nil {
+		return
+	}
+	glog.V(2).Infof("event %s %s %s: %s",
+		event.Type, event.Reason, event.Unit, event.Message)
+	if event.Count < 1 {
+		event.Count = 1
+	}
+	key := eventKey{
+		eventType: event.Type,
+		reason:    event.Reason,
+		unit:      event.Unit,
+		message:   event.Message,
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sequence++
+	if existing, exists := r.events[key]; exists {
+		existing.Sequence = r.sequence
+		existing.Count += event.Count
+		if event.FirstTimestamp.Before(existing.FirstTimestamp.Time) {
+			existing.FirstTimestamp = event.FirstTimestamp
+		}
+		if event.LastTimestamp.After(existing.LastTimestamp.Time) {
+			existing.LastTimestamp = event.LastTimestamp
+		}
+		return
+	}
+	event.Sequence = r.sequence
+	r.events[key] = &event
+	if len(r.events) > r.capacity {
+		r.evictOldest()
+	}
+}
+
+func (r *Recorder) evictOldest() {
+	var oldest eventKey
+	var oldestSequence int64
+	for key, event := range r.events {
+		if oldestSequence == 0 || event.Sequence < oldestSequence {
+			oldest = key
+			oldestSequence = event.Sequence
+		}
+	}
+	delete(r.events, oldest)
+}
+
+// ReadSince returns the events recorded or repeated after the cursor since,
+// oldest first, and the cursor to use for reading the next ones. Zero returns
+// all events, and so does a cursor beyond the current one, which was handed
+// out before the agent restarted.
+func (r *Recorder) ReadSince(since int64) ([]api.Event, int64) {
+	if r == nil {
+		return []api.Event{}, 0
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if since > r.sequence {
+		since = 0
+	}
+	events := []api.Event{}
+	for _, event := range r.events {
+		if event.Sequence > since {
+			events = append(events, *event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Sequence < events[j].Sequence
+	})
+	return events, r.sequence
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func reasons(events []api.Event) []string {
+	var reasons []string
+	for _, event := range events {
+		reasons = append(reasons, event.Reason)
+	}
+	return reasons
+}
+
+func TestRecorderReadSince(t *testing.T) {
+	r := NewRecorder(10)
+	events, cursor := r.ReadSince(0)
+	assert.Empty(t, events)
+	assert.Equal(t, int64(0), cursor)
+
+	r.Event("u1", api.EventTypeNormal, PullingImage, "Pulling image")
+	r.Event("u1", api.EventTypeNormal, PulledImage, "Pulled image")
+	events, cursor = r.ReadSince(0)
+	assert.Equal(t, []string{PullingImage, PulledImage}, reasons(events))
+	assert.Equal(t, "u1", events[0].Unit)
+	assert.Equal(t, int32(1), events[0].Count)
+
+	r.Eventf("u1", api.EventTypeNormal, StartedUnit, "Started unit %s", "u1")
+	events, cursor = r.ReadSince(cursor)
+	assert.Equal(t, []string{StartedUnit}, reasons(events))
+	assert.Equal(t, "Started unit u1", events[0].Message)
+	events, _ = r.ReadSince(cursor)
+	assert.Empty(t, events)
+
+	// A cursor from before a restart returns everything.
+	events, _ = r.ReadSince(cursor + 100)
+	assert.Len(t, events, 3)
+}
+
+func TestRecorderCountsRepeats(t *testing.T) {
+	r := NewRecorder(10)
+	r.Event("u1", api.EventTypeWarning, BackOffStartUnit, "Back-off")
+	r.Event("u2", api.EventTypeWarning, BackOffStartUnit, "Back-off")
+	events, cursor := r.ReadSince(0)
+	assert.Len(t, events, 2)
+	first := events[0]
+
+	time.Sleep(10 * time.Millisecond)
+	r.Event("u1", api.EventTypeWarning, BackOffStartUnit, "Back-off")
+	events, _ = r.ReadSince(cursor)
+	assert.Len(t, events, 1)
+	assert.Equal(t, int32(2), events[0].Count)
+	assert.Equal(t, "u1", events[0].Unit)
+	assert.Equal(t, first.FirstTimestamp, events[0].FirstTimestamp)
+	assert.True(t, events[0].LastTimestamp.After(first.LastTimestamp.Time))
+	assert.True(t, events[0].Sequence > cursor)
+
+	// Events recorded elsewhere keep their count and timestamps.
+	earlier := api.Time{Time: first.FirstTimestamp.Add(-time.Minute)}
+	r.Record(api.Event{
+		Type:           api.EventTypeWarning,
+		Reason:         BackOffStartUnit,
+		Message:        "Back-off",
+		Unit:           "u1",
+		Count:          3,
+		FirstTimestamp: earlier,
+		LastTimestamp:  earlier,
+	})
+	events, _ = r.ReadSince(0)
+	assert.Len(t, events, 2)
+	assert.Equal(t, "u1", events[1].Unit)
+	assert.Equal(t, int32(5), events[1].Count)
+	assert.Equal(t, earlier, events[1].FirstTimestamp)
+}
+
+func TestRecorderCapacity(t *testing.T) {
+	r := NewRecorder(2)
+	r.Event("", api.EventTypeNormal, "A", "a")
+	r.Event("", api.EventTypeNormal, "B", "b")
+	// A is seen again, B becomes the oldest.
+	r.Event("", api.EventTypeNormal, "A", "a")
+	r.Event("", api.EventTypeNormal, "C", "c")
+	events, _ := r.ReadSince(0)
+	assert.Equal(t, []string{"A", "C"}, reasons(events))
+}
+
+func TestNilRecorder(t *testing.T) {
+	var r *Recorder
+	r.Event("u1", api.EventTypeNormal, StartedUnit, "Started")
+	events, cursor := r.ReadSince(0)
+	assert.Empty(t, events)
+	assert.Equal(t, int64(0), cursor)
+}
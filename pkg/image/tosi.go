@@ -72,6 +72,16 @@ func (t *Tosi) Unpack(image, dest, configPath string) error {
 	return t.run(t.server, t.image, dest, configPath, t.username, t.password)
 }
 
+// Fetch pulls the image into the layer cache of tosi and saves its config to
+// configPath, without unpacking it anywhere. A subsequent Unpack of the same
+// image only needs to extract or mount the cached layers.
+func (t *Tosi) Fetch(image, configPath string) error {
+	if image != t.image {
+		return fmt.Errorf("image mismatch %q != %q", t.image, image)
+	}
+	return t.run(t.server, t.image, "", configPath, t.username, t.password)
+}
+
 func (t *Tosi) buildTosiArgs(server, image, dest, configPath, username, password string) []string {
 	imageExtractFlag := TosiDefaultImageExtractFlag
 	// If we are not using an overlayfs have tosi use the extractto flag
@@ -81,11 +91,11 @@ func (t *Tosi) buildTosiArgs(server, image, dest, configPath, username, password
 	args := []string{
 		"-image",
 		image,
-		imageExtractFlag,
-		dest,
-		"-saveconfig",
-		configPath,
 	}
+	if dest != "" {
+		args = append(args, []string{imageExtractFlag, dest}...)
+	}
+	args = append(args, []string{"-saveconfig", configPath}...)
 	if username != "" {
 		args = append(args, []string{"-username", username}...)
 	}
@@ -17,9 +17,15 @@ limitations under the License.
 package metrics
 
 import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
 	"github.com/containerd/cgroups"
 	cgroupsv1 "github.com/containerd/cgroups/stats/v1"
 	"github.com/elotl/itzo/pkg/api"
+	"github.com/elotl/itzo/pkg/cgroup"
 	itzonet "github.com/elotl/itzo/pkg/net"
 	"github.com/golang/glog"
 	"github.com/shirou/gopsutil/cpu"
@@ -28,8 +34,9 @@ import (
 	psnet "github.com/shirou/gopsutil/net"
 )
 
-// The Itzo metrics provider uses cgroups v1, and psutil to gather information
-// about the host.
+// The Itzo metrics provider uses cgroups (either v1 or v2, depending on the
+// hierarchy used on the system), and psutil to gather information about the
+// host.
 type ItzoMetricsProvider struct {
     GenericSystemMetricsProvider
 }
@@ -37,6 +44,9 @@ type ItzoMetricsProvider struct {
 // GetUnitMetrics returns a ResourceMetrics map with various container level
 // metrics.
 func (m *ItzoMetricsProvider) ReadUnitMetrics(name string) api.ResourceMetrics {
+	if cgroup.GetMode() == cgroup.Unified {
+		return readUnifiedUnitMetrics(name)
+	}
 	metrics := api.ResourceMetrics{}
 	control, err := cgroups.Load(cgroups.V1, cgroups.StaticPath("/"+name))
 	if err != nil {
@@ -61,6 +71,7 @@ func (m *ItzoMetricsProvider) ReadUnitMetrics(name string) api.ResourceMetrics {
 		metrics[name+".memoryWorkingSet"] = float64(workingSet)
 		limit := m.Usage.Limit
 		if !isMemoryUnlimited(limit) {
+			metrics[name+".memoryLimit"] = float64(limit)
 			metrics[name+".memoryAvailable"] = float64(limit - workingSet)
 		} else {
 			if sysMem, err := mem.VirtualMemory(); err == nil {
@@ -68,9 +79,97 @@ func (m *ItzoMetricsProvider) ReadUnitMetrics(name string) api.ResourceMetrics {
 			}
 		}
 	}
+	if cm.Pids != nil {
+		metrics[name+".pids"] = float64(cm.Pids.Current)
+		if cm.Pids.Limit > 0 {
+			metrics[name+".pidsLimit"] = float64(cm.Pids.Limit)
+		}
+	}
+	readCPULimits(name, control, metrics)
+	if cg, err := cgroup.Load(name); err == nil {
+		if oomKills, err := cg.OOMKillCount(); err == nil {
+			metrics[name+".oomKills"] = float64(oomKills)
+		}
+	}
 	return metrics
 }
 
+// readUnifiedUnitMetrics is the cgroups v2 version of ReadUnitMetrics. It
+// produces the same metrics.
+func readUnifiedUnitMetrics(name string) api.ResourceMetrics {
+	metrics := api.ResourceMetrics{}
+	cs, err := cgroup.ReadUnifiedStats(name)
+	if err != nil {
+		glog.Errorf("Getting cgroup metrics for %q: %v", name, err)
+		return metrics
+	}
+	metrics[name+".cpuUsage"] = float64(cs.CPUUsageNanos)
+	if cs.CPUWeight > 0 {
+		shares := cgroup.ConvertCPUWeightToShares(cs.CPUWeight)
+		metrics[name+".cpuShares"] = float64(shares)
+	}
+	if cs.CPUQuota > 0 && cs.CPUPeriod > 0 {
+		metrics[name+".cpuLimit"] = float64(cs.CPUQuota) / float64(cs.CPUPeriod)
+	}
+	metrics[name+".memoryRSS"] = float64(cs.MemoryAnon)
+	metrics[name+".memoryPageFaults"] = float64(cs.MemoryPageFaults)
+	metrics[name+".memoryMajorPageFaults"] = float64(cs.MemoryMajorPageFaults)
+	metrics[name+".memoryUsage"] = float64(cs.MemoryUsage)
+	workingSet := cs.MemoryUsage
+	if cs.MemoryInactiveFile < cs.MemoryUsage {
+		workingSet = cs.MemoryUsage - cs.MemoryInactiveFile
+	}
+	metrics[name+".memoryWorkingSet"] = float64(workingSet)
+	if cs.MemoryLimit > 0 && !isMemoryUnlimited(cs.MemoryLimit) {
+		metrics[name+".memoryLimit"] = float64(cs.MemoryLimit)
+		metrics[name+".memoryAvailable"] = float64(cs.MemoryLimit - workingSet)
+	} else if sysMem, err := mem.VirtualMemory(); err == nil {
+		metrics[name+".memoryAvailable"] = float64(sysMem.Available)
+	}
+	metrics[name+".pids"] = float64(cs.PidsCurrent)
+	if cs.PidsLimit > 0 {
+		metrics[name+".pidsLimit"] = float64(cs.PidsLimit)
+	}
+	metrics[name+".oomKills"] = float64(cs.OOMKills)
+	return metrics
+}
+
+// readCPULimits adds the CPU shares and the CFS quota of the unit (in cores)
+// to metrics. The cgroups library does not include them in its stats.
+func readCPULimits(name string, control cgroups.Cgroup, metrics api.ResourceMetrics) {
+	for _, s := range control.Subsystems() {
+		if s.Name() != cgroups.Cpu {
+			continue
+		}
+		p, ok := s.(interface{ Path(string) string })
+		if !ok {
+			return
+		}
+		dir := p.Path("/" + name)
+		if shares, err := readCgroupInt(filepath.Join(dir, "cpu.shares")); err == nil {
+			metrics[name+".cpuShares"] = float64(shares)
+		}
+		quota, err := readCgroupInt(filepath.Join(dir, "cpu.cfs_quota_us"))
+		if err != nil || quota <= 0 {
+			return
+		}
+		period, err := readCgroupInt(filepath.Join(dir, "cpu.cfs_period_us"))
+		if err != nil || period <= 0 {
+			return
+		}
+		metrics[name+".cpuLimit"] = float64(quota) / float64(period)
+		return
+	}
+}
+
+func readCgroupInt(path string) (int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
 func getWorkingSet(memory *cgroupsv1.MemoryStat) uint64 {
 	workingSet := memory.Usage.Usage
 	if memory.TotalInactiveFile < memory.Usage.Usage {
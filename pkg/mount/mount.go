@@ -95,6 +95,31 @@ var Mounts = []Mount{
 	},
 }
 
+var (
+	// Paths hidden from unprivileged units, the same ones Docker masks.
+	MaskedPaths = []string{
+		"/proc/acpi",
+		"/proc/asound",
+		"/proc/kcore",
+		"/proc/keys",
+		"/proc/latency_stats",
+		"/proc/sched_debug",
+		"/proc/scsi",
+		"/proc/timer_list",
+		"/proc/timer_stats",
+		"/sys/firmware",
+	}
+	// Paths that are read-only for unprivileged units.
+	ReadonlyPaths = []string{
+		"/proc/bus",
+		"/proc/fs",
+		"/proc/irq",
+		"/proc/sys",
+		"/proc/sysrq-trigger",
+		"/sys",
+	}
+)
+
 func NewOSMounter(basedir string) Mounter {
 	return &OSMounter{
 		basedir: basedir,
@@ -399,6 +424,53 @@ func ShareMount(target string, flags uintptr) error {
 	return mounter("none", target, "", flags, "")
 }
 
+// RemountReadOnly makes the mount at target read-only. Mounts below target
+// are not affected.
+func RemountReadOnly(target string) error {
+	glog.V(5).Infof("Remounting %s read-only", target)
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	return mounter("", target, "", flags, "")
+}
+
+// MaskPaths hides MaskedPaths and makes ReadonlyPaths read-only, in the
+// mount namespace of the calling process. Paths that don't exist are
+// skipped.
+func MaskPaths() error {
+	for _, path := range MaskedPaths {
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			err = mounter("tmpfs", path, "tmpfs", uintptr(syscall.MS_RDONLY), "")
+		} else {
+			err = mounter("/dev/null", path, "", uintptr(syscall.MS_BIND), "")
+		}
+		if err != nil {
+			return fmt.Errorf("masking %s: %v", path, err)
+		}
+	}
+	for _, path := range ReadonlyPaths {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = mounter(path, path, "", uintptr(syscall.MS_BIND|syscall.MS_REC), "")
+		if err != nil {
+			return fmt.Errorf("bind mounting %s: %v", path, err)
+		}
+		err = RemountReadOnly(path)
+		if err != nil {
+			return fmt.Errorf("remounting %s read-only: %v", path, err)
+		}
+	}
+	return nil
+}
+
 func (om *OSMounter) AttachMount(unit, src, dst string) error {
 	glog.V(5).Infof("Mounting %s->%s", src, dst)
 	// Directory for mount source.
@@ -87,6 +87,14 @@ func ShareMount(target string, flags uintptr) error {
 	return nil
 }
 
+func RemountReadOnly(target string) error {
+	return nil
+}
+
+func MaskPaths() error {
+	return nil
+}
+
 func (om *OSMounter) AttachMount(unit, src, dst string) error {
 	return nil
 }
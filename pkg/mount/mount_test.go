@@ -87,6 +87,58 @@ func createTmpDir(t *testing.T) string {
 	return dir
 }
 
+func TestRemountReadOnly(t *testing.T) {
+	var target string
+	var flags uintptr
+	mounter = func(source, dst, fstype string, f uintptr, data string) error {
+		target = dst
+		flags = f
+		return nil
+	}
+	err := RemountReadOnly("/")
+	assert.NoError(t, err)
+	assert.Equal(t, "/", target)
+	assert.NotZero(t, flags&syscall.MS_REMOUNT)
+	assert.NotZero(t, flags&syscall.MS_BIND)
+	assert.NotZero(t, flags&syscall.MS_RDONLY)
+}
+
+func TestMaskPaths(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "itzo-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	file := path.Join(tmpdir, "file")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("foo"), 0644))
+	dir := path.Join(tmpdir, "dir")
+	assert.NoError(t, os.Mkdir(dir, 0755))
+	missing := path.Join(tmpdir, "missing")
+	savedMasked, savedReadonly := MaskedPaths, ReadonlyPaths
+	defer func() {
+		MaskedPaths, ReadonlyPaths = savedMasked, savedReadonly
+	}()
+	MaskedPaths = []string{file, dir, missing}
+	ReadonlyPaths = []string{dir, missing}
+	type mount struct {
+		src    string
+		dst    string
+		fstype string
+		flags  uintptr
+	}
+	var mounts []mount
+	mounter = func(source, target, fstype string, flags uintptr, data string) error {
+		mounts = append(mounts, mount{source, target, fstype, flags})
+		return nil
+	}
+	err = MaskPaths()
+	assert.NoError(t, err)
+	assert.Equal(t, []mount{
+		{"/dev/null", file, "", syscall.MS_BIND},
+		{"tmpfs", dir, "tmpfs", syscall.MS_RDONLY},
+		{dir, dir, "", syscall.MS_BIND | syscall.MS_REC},
+		{"", dir, "", syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY},
+	}, mounts)
+}
+
 func TestAttachMount(t *testing.T) {
 	mountSrc := ""
 	mountDst := ""
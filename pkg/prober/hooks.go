@@ -0,0 +1,57 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prober
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/probe"
+)
+
+// RunHandler runs a lifecycle hook handler of a unit once. Handlers are
+// executed the same way as probes: exec handlers are run with the environment
+// of the unit, HTTP and TCP handlers default to the pod IP. A timeout of zero
+// means no timeout.
+func RunHandler(unitName, podIP string, handler *api.Handler, timeout time.Duration) error {
+	if handler == nil {
+		return nil
+	}
+	apiEnv := EnvironToAPIEnvVar(os.Environ())
+	pb := newProber(unitName, podIP, apiEnv)
+	p := &api.Probe{
+		Handler:        *handler,
+		TimeoutSeconds: int32(timeout / time.Second),
+	}
+	result, output, err := pb.runProbe(Liveness, p)
+	if err != nil {
+		return err
+	}
+	if result != probe.Success && result != probe.Warning {
+		output = strings.TrimSpace(output)
+		if output == "" {
+			output = string(result)
+		}
+		return errors.New(output)
+	}
+	glog.V(3).Infof("hook for %q succeeded", unitName)
+	return nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prober
+
+import (
+	"testing"
+
+	"github.com/elotl/itzo/pkg/api"
+)
+
+func TestRunHandler(t *testing.T) {
+	tests := []struct {
+		handler     *api.Handler
+		expectError string
+	}{
+		{ // No hook
+			handler: nil,
+		},
+		{ // Hook succeeds
+			handler: &api.Handler{
+				Exec: &api.ExecAction{Command: []string{"/bin/true"}},
+			},
+		},
+		{ // Hook fails, output is returned
+			handler: &api.Handler{
+				Exec: &api.ExecAction{
+					Command: []string{"/bin/sh", "-c", "echo oops; exit 1"},
+				},
+			},
+			expectError: "oops",
+		},
+		{ // No action
+			handler:     &api.Handler{},
+			expectError: "Missing probe handler for myunit",
+		},
+	}
+	for i, test := range tests {
+		err := RunHandler("myunit", "127.0.0.1", test.handler, 0)
+		if test.expectError == "" && err != nil {
+			t.Errorf("[%d] Didn't expect hook error but got: %v", i, err)
+		}
+		if test.expectError != "" {
+			if err == nil {
+				t.Errorf("[%d] Expected hook error but no error was returned.", i)
+			} else if err.Error() != test.expectError {
+				t.Errorf("[%d] Expected error %q but got %q", i, test.expectError, err.Error())
+			}
+		}
+	}
+}
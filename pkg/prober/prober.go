@@ -29,6 +29,7 @@ import (
 	"time"
 
 	"github.com/elotl/itzo/pkg/api"
+	"github.com/elotl/itzo/pkg/events"
 	"github.com/elotl/itzo/pkg/util"
 	"github.com/golang/glog"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -41,6 +42,11 @@ import (
 
 const maxProbeRetries = 3
 
+// EventRecorder gets notified about failed probes.
+type EventRecorder interface {
+	RecordEvent(eventType api.EventType, reason, message string)
+}
+
 // Prober helps to check the liveness/readiness of a container.
 type prober struct {
 	unitName string
@@ -55,6 +61,8 @@ type prober struct {
 	tcp           tcprobe.Prober
 	// Runner allows us to easier test exec probes
 	runner CommandRunner
+	// Optional, records failed probes as events.
+	recorder EventRecorder
 }
 
 // NewProber creates a Prober, it takes a command runner and
@@ -88,19 +96,31 @@ func (pb *prober) probe(probeType ProbeType, probeSpec *api.Probe) (Result, erro
 	if err != nil || (result != probe.Success && result != probe.Warning) {
 		if err != nil {
 			glog.V(1).Infof("%s probe for %q errored: %v", probeType, pb.unitName, err)
+			pb.recordEvent(api.EventTypeWarning, events.UnitUnhealthy,
+				fmt.Sprintf("%s probe errored: %v", probeType, err))
 		} else { // result != probe.Success
 			glog.V(1).Infof("%s probe for %q failed (%v): %s", probeType, pb.unitName, result, output)
+			pb.recordEvent(api.EventTypeWarning, events.UnitUnhealthy,
+				fmt.Sprintf("%s probe failed: %s", probeType, output))
 		}
 		return Failure, err
 	}
 	if result == probe.Warning {
 		glog.V(3).Infof("%s probe for %q succeeded with a warning: %s", probeType, pb.unitName, output)
+		pb.recordEvent(api.EventTypeWarning, events.UnitProbeWarning,
+			fmt.Sprintf("%s probe warning: %s", probeType, output))
 	} else {
 		glog.V(3).Infof("%s probe for %q succeeded", probeType, pb.unitName)
 	}
 	return Success, nil
 }
 
+func (pb *prober) recordEvent(eventType api.EventType, reason, message string) {
+	if pb.recorder != nil {
+		pb.recorder.RecordEvent(eventType, reason, message)
+	}
+}
+
 // runProbeWithRetries tries to probe the container in a finite loop, it returns the last result
 // if it never succeeds.
 func (pb *prober) runProbeWithRetries(probeType ProbeType, p *api.Probe, retries int) (probe.Result, string, error) {
@@ -210,7 +230,7 @@ type execCmd struct {
 }
 
 func (pb *prober) newExecCmd(cmd []string, timeout time.Duration) kubeexec.Cmd {
-	return execCmd{run: func() ([]byte, error) {
+	return &execCmd{run: func() ([]byte, error) {
 		return pb.runner.RunWithTimeout(cmd, timeout)
 	}}
 }
@@ -244,11 +264,11 @@ func (eic execCmd) SetStdin(in io.Reader) {
 	//unimplemented
 }
 
-func (eic execCmd) SetStdout(out io.Writer) {
+func (eic *execCmd) SetStdout(out io.Writer) {
 	eic.writer = out
 }
 
-func (eic execCmd) SetStderr(out io.Writer) {
+func (eic *execCmd) SetStderr(out io.Writer) {
 	eic.writer = out
 }
 
@@ -260,7 +280,7 @@ func (eic execCmd) Stop() {
 	//unimplemented
 }
 
-func (eic execCmd) Start() error {
+func (eic *execCmd) Start() error {
 	data, err := eic.CombinedOutput()
 	if eic.writer != nil {
 		eic.writer.Write(data)
@@ -117,6 +117,12 @@ func NewWorker(
 	return w
 }
 
+// SetEventRecorder makes the worker record failed probes as events. It
+// needs to be called before Start.
+func (w *worker) SetEventRecorder(recorder EventRecorder) {
+	w.prober.recorder = recorder
+}
+
 // run periodically probes the container.
 func (w *worker) Start() {
 	if w.spec == nil {
@@ -180,3 +180,28 @@ func TestRunProbeWorker(t *testing.T) {
 	}
 	w.Stop()
 }
+
+type eventRecorder struct {
+	reasons  []string
+	messages []string
+}
+
+func (r *eventRecorder) RecordEvent(eventType api.EventType, reason, message string) {
+	r.reasons = append(r.reasons, reason)
+	r.messages = append(r.messages, message)
+}
+
+func TestProbeEvents(t *testing.T) {
+	p := mkProbe(api.Probe{FailureThreshold: 2})
+	w := makeTestWorker(Liveness, &p, probe.Success, nil)
+	recorder := &eventRecorder{}
+	w.SetEventRecorder(recorder)
+	w.doProbe()
+	assert.Empty(t, recorder.reasons)
+	// Every failed probe is recorded, even below the failure threshold.
+	w.prober.exec = fakeExecProber{probe.Failure, nil}
+	w.doProbe()
+	w.doProbe()
+	assert.Equal(t, []string{"Unhealthy", "Unhealthy"}, recorder.reasons)
+	assert.Contains(t, recorder.messages[0], "Liveness probe failed")
+}
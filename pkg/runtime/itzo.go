@@ -44,5 +44,10 @@ type UnitRunner interface {
 	GetLogBuffer(unitName string) (*logbuf.LogBuffer, error)
 	ReadLogBuffer(unitName string, n int) ([]logbuf.LogEntry, error)
 	GetPid(string) (int, bool)
+	RemovePodNamespaces() error
+	AdoptUnit(podName, unitName string) (bool, error)
+	AdoptPodNamespaces() error
+	GetFsUsage(unitName string) (uint64, error)
+	ReadUnitEvents(unitName string) ([]api.Event, error)
 }
 
@@ -27,6 +27,10 @@ func (i ImagePuller) PullImage(rootdir, name, image string, registryCredentials
 	return nil
 }
 
+func (i ImagePuller) PrePullImage(rootdir, name, image string, registryCredentials map[string]api.RegistryCredentials) error {
+	return nil
+}
+
 type ItzoRuntime struct {}
 
 func (i ItzoRuntime) RunPodSandbox(spec *api.PodSpec) error {
@@ -41,7 +45,7 @@ func (i ItzoRuntime) RemovePodSandbox(spec *api.PodSpec) error {
 	panic("implement me")
 }
 
-func (i ItzoRuntime) CreateContainer(unit api.Unit, spec *api.PodSpec, podName string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool) (*api.UnitStatus, error) {
+func (i ItzoRuntime) CreateContainer(unit api.Unit, spec *api.PodSpec, podName string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool, restartBackoff api.RestartBackoff) (*api.UnitStatus, error) {
 	panic("implement me")
 }
 
@@ -21,19 +21,29 @@ import (
 	"github.com/elotl/itzo/pkg/api"
 	"github.com/elotl/itzo/pkg/logbuf"
 	"github.com/elotl/itzo/pkg/metrics"
+	"github.com/elotl/itzo/pkg/seccomp"
 	itzounit "github.com/elotl/itzo/pkg/unit"
 	"github.com/elotl/itzo/pkg/util"
 	"github.com/golang/glog"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 )
 
 type ImagePuller struct {
 }
 
-func (ip *ImagePuller) PullImage(rootdir, name, image string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool) error {
-	server, repo := util.ParseImageSpec(image)
-	username, password := util.GetRepoCreds(server, registryCredentials)
+// Images are fetched ahead of creating a unit into this directory under the
+// rootdir. Unit names can't start with a dot, so it never clashes with a unit.
+const stagingDirName = ".staging"
+
+func parseImage(image string, registryCredentials map[string]api.RegistryCredentials) (server, repo, username, password string) {
+	server, repo = util.ParseImageSpec(image)
+	username, password = util.GetRepoCreds(server, registryCredentials)
 
 	if server == "docker.io" {
 		// K8s and Helm might set this for images, but the actual official
@@ -43,6 +53,11 @@ func (ip *ImagePuller) PullImage(rootdir, name, image string, registryCredential
 	if server != "" && !strings.HasPrefix(server, "http") {
 		server = "https://" + server
 	}
+	return server, repo, username, password
+}
+
+func (ip *ImagePuller) PullImage(rootdir, name, image string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool) error {
+	server, repo, username, password := parseImage(image, registryCredentials)
 	glog.Infof("Creating new unit '%s' in %s\n", name, rootdir)
 	u, err := itzounit.OpenUnit(rootdir, name)
 	if err != nil {
@@ -56,6 +71,24 @@ func (ip *ImagePuller) PullImage(rootdir, name, image string, registryCredential
 	return nil
 }
 
+// PrePullImage fetches the image of a unit into a staging directory, leaving
+// the unit itself alone.
+func (ip *ImagePuller) PrePullImage(rootdir, name, image string, registryCredentials map[string]api.RegistryCredentials) error {
+	server, repo, username, password := parseImage(image, registryCredentials)
+	dir := filepath.Join(rootdir, stagingDirName, name)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return errors.Wrapf(err, "creating staging directory for unit %s", name)
+	}
+	defer os.RemoveAll(dir)
+	err = itzounit.FetchImage(
+		repo, server, username, password, filepath.Join(dir, "config"))
+	if err != nil {
+		return errors.Wrapf(err, "pulling image %s", image)
+	}
+	return nil
+}
+
 type ItzoRuntime struct {
 	metrics.ItzoMetricsProvider
 
@@ -89,8 +122,30 @@ func (i *ItzoRuntime) RunPodSandbox(spec *api.PodSpec) error {
 	return nil
 }
 
+// StopPodSandbox stops the running units of the pod in parallel, each one
+// getting its termination grace period. Units are left in place with their
+// last status.
 func (i *ItzoRuntime) StopPodSandbox(spec *api.PodSpec) error {
-	return nil
+	units := append(append([]api.Unit{}, spec.InitUnits...), spec.Units...)
+	errs := make(chan error, len(units))
+	var wg sync.WaitGroup
+	for _, unit := range units {
+		if !i.UnitMgr.UnitRunning(unit.Name) {
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			glog.Infoln("Stopping unit", name)
+			err := i.UnitMgr.StopUnit(name)
+			if err != nil {
+				errs <- fmt.Errorf("stopping unit %s: %v", name, err)
+			}
+		}(unit.Name)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
 }
 
 func (i *ItzoRuntime) RemovePodSandbox(spec *api.PodSpec) error {
@@ -101,6 +156,11 @@ func (i *ItzoRuntime) RemovePodSandbox(spec *api.PodSpec) error {
 			return err
 		}
 	}
+	err := i.UnitMgr.RemovePodNamespaces()
+	if err != nil {
+		glog.Errorf("Error removing pod namespaces: %v", err)
+		return err
+	}
 	for _, volume := range spec.Volumes {
 		err := i.MountCtl.DeleteMount(&volume)
 		if err != nil {
@@ -111,14 +171,14 @@ func (i *ItzoRuntime) RemovePodSandbox(spec *api.PodSpec) error {
 	return nil
 }
 
-func (i *ItzoRuntime) CreateContainer(unit api.Unit, spec *api.PodSpec, podName string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool) (*api.UnitStatus, error) {
+func (i *ItzoRuntime) CreateContainer(unit api.Unit, spec *api.PodSpec, podName string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool, restartBackoff api.RestartBackoff) (*api.UnitStatus, error) {
 	// pull image
 	err := i.ImgPuller.PullImage(i.rootdir, unit.Name, unit.Image, registryCredentials, useOverlayfs)
 	if err != nil {
 		msg := fmt.Sprintf("Bad image spec for unit %s: %v", unit.Name, err)
 		return api.MakeFailedUpdateStatus(unit.Name, unit.Image, msg), err
 	}
-	err = i.saveUnitConfig(&unit, spec.SecurityContext)
+	err = i.saveUnitConfig(&unit, spec, restartBackoff)
 	if err != nil {
 		msg := fmt.Sprintf("Error saving unit %s configuration: %v",
 			unit.Name, err)
@@ -137,6 +197,10 @@ func (i *ItzoRuntime) CreateContainer(unit api.Unit, spec *api.PodSpec, podName
 	return nil, nil
 }
 
+func (i *ItzoRuntime) PrePullImage(unit api.Unit, registryCredentials map[string]api.RegistryCredentials) error {
+	return i.ImgPuller.PrePullImage(i.rootdir, unit.Name, unit.Image, registryCredentials)
+}
+
 func (i *ItzoRuntime) StartContainer(unit api.Unit, podSpec *api.PodSpec, podName string) (*api.UnitStatus, error) {
 	err := i.UnitMgr.StartUnit(
 		podName,
@@ -186,18 +250,10 @@ func (i *ItzoRuntime) RemoveContainer(unit *api.Unit) error {
 	return err
 }
 
+// ContainerStatus returns the status of a unit. The status file maintained by
+// the unit helper is the source of truth, both for running and for exited
+// units.
 func (i *ItzoRuntime) ContainerStatus(unitName, unitImage string) (*api.UnitStatus, error) {
-	if i.UnitMgr.UnitRunning(unitName) {
-		return &api.UnitStatus{
-			Name: unitName,
-			State: api.UnitState{
-				Running: &api.UnitStateRunning{},
-			},
-			RestartCount: 0,
-			Image:        unitImage,
-			Ready:        true,
-		}, nil
-	}
 	if !itzounit.IsUnitExist(i.rootdir, unitName) {
 		reason := "PodInitializing"
 		return api.MakeStillCreatingStatus(
@@ -230,19 +286,70 @@ func (i *ItzoRuntime) GetPid(unitName string) (int, bool) {
 	return i.UnitMgr.GetPid(unitName)
 }
 
+// ReadUnitMetrics adds the disk space used by the writable layer of the unit
+// to the cgroup metrics of the unit.
+func (i *ItzoRuntime) ReadUnitMetrics(name string) api.ResourceMetrics {
+	metrics := i.ItzoMetricsProvider.ReadUnitMetrics(name)
+	used, err := i.UnitMgr.GetFsUsage(name)
+	if err == itzounit.ErrNoWritableLayer {
+		return metrics
+	}
+	if err != nil {
+		glog.Warningf("getting storage usage of %s: %v", name, err)
+		return metrics
+	}
+	metrics[name+".fsUsed"] = float64(used)
+	return metrics
+}
+
+func (i *ItzoRuntime) ReadUnitEvents(unitName string) ([]api.Event, error) {
+	return i.UnitMgr.ReadUnitEvents(unitName)
+}
+
 func (i *ItzoRuntime) SetPodNetwork(netNS, podIP string)  {
 	i.podIP = podIP
 	i.netNS = netNS
 }
 
-func (i *ItzoRuntime) saveUnitConfig(unit *api.Unit, podSecurityContext *api.PodSecurityContext) error {
+// RestorePod adopts the pod namespaces and the units of a pod started by a
+// previous instance of the agent. Running units are left alone.
+func (i *ItzoRuntime) RestorePod(spec *api.PodSpec, podName string) (map[string]bool, error) {
+	err := i.UnitMgr.AdoptPodNamespaces()
+	if err != nil {
+		return nil, fmt.Errorf("adopting pod namespaces: %v", err)
+	}
+	started := make(map[string]bool)
+	for _, unit := range append(spec.InitUnits, spec.Units...) {
+		ok, err := i.UnitMgr.AdoptUnit(podName, unit.Name)
+		if err != nil {
+			// Better not to start the unit a second time.
+			glog.Errorf("adopting unit %s: %v", unit.Name, err)
+			ok = true
+		}
+		started[unit.Name] = ok
+	}
+	return started, nil
+}
+
+func (i *ItzoRuntime) saveUnitConfig(unit *api.Unit, spec *api.PodSpec, restartBackoff api.RestartBackoff) error {
+	podSecurityContext := spec.SecurityContext
 	unitConfig := itzounit.UnitConfig{
-		StartupProbe:             util.TranslateProbePorts(unit, unit.StartupProbe),
-		ReadinessProbe:           util.TranslateProbePorts(unit, unit.ReadinessProbe),
-		LivenessProbe:            util.TranslateProbePorts(unit, unit.LivenessProbe),
-		TerminationMessagePolicy: unit.TerminationMessagePolicy,
-		TerminationMessagePath:   unit.TerminationMessagePath,
-		PodIP:                    i.podIP,
+		StartupProbe:                     util.TranslateProbePorts(unit, unit.StartupProbe),
+		ReadinessProbe:                   util.TranslateProbePorts(unit, unit.ReadinessProbe),
+		LivenessProbe:                    util.TranslateProbePorts(unit, unit.LivenessProbe),
+		Lifecycle:                        util.TranslateLifecyclePorts(unit, unit.Lifecycle),
+		TerminationMessagePolicy:         unit.TerminationMessagePolicy,
+		TerminationMessagePath:           unit.TerminationMessagePath,
+		PodIP:                            i.podIP,
+		TerminationGracePeriodSeconds:    unit.TerminationGracePeriodSeconds,
+		PodTerminationGracePeriodSeconds: spec.TerminationGracePeriodSeconds,
+		StopSignal:                       unit.StopSignal,
+		Resources:                        unit.Resources,
+		RestartBackoff:                   restartBackoff,
+		Rlimits:                          itzounit.MergeRlimits(itzounit.DefaultRlimits, unit.Rlimits),
+		Stdin:                            unit.Stdin,
+		StdinOnce:                        unit.StdinOnce,
+		TTY:                              unit.TTY,
 	}
 	if podSecurityContext != nil {
 		unitConfig.PodSecurityContext = *podSecurityContext
@@ -250,6 +357,22 @@ func (i *ItzoRuntime) saveUnitConfig(unit *api.Unit, podSecurityContext *api.Pod
 	if unit.SecurityContext != nil {
 		unitConfig.SecurityContext = *unit.SecurityContext
 	}
+	err := itzounit.ValidateRlimits(unit.Rlimits)
+	if err != nil {
+		return fmt.Errorf("unit %q: %v", unit.Name, err)
+	}
+	unitConfig.SeccompProfile = unitConfig.SecurityContext.SeccompProfile
+	if unitConfig.SeccompProfile == nil {
+		unitConfig.SeccompProfile = unitConfig.PodSecurityContext.SeccompProfile
+	}
+	profile := unitConfig.SeccompProfile
+	if profile != nil && profile.Type == api.SeccompProfileTypeLocalhost {
+		localhostProfile, err := i.loadLocalhostSeccompProfile(profile)
+		if err != nil {
+			return fmt.Errorf("unit %q seccomp profile: %v", unit.Name, err)
+		}
+		unitConfig.SeccompLocalhostProfile = localhostProfile
+	}
 	u, err := itzounit.OpenUnit(i.rootdir, unit.Name)
 	if err != nil {
 		return fmt.Errorf("opening unit %q for saving unit configuration: %v",
@@ -263,6 +386,25 @@ func (i *ItzoRuntime) saveUnitConfig(unit *api.Unit, podSecurityContext *api.Pod
 	return nil
 }
 
+// loadLocalhostSeccompProfile loads a seccomp profile from the directory
+// packages are deployed to.
+func (i *ItzoRuntime) loadLocalhostSeccompProfile(profile *api.SeccompProfile) (*specs.LinuxSeccomp, error) {
+	if profile.LocalhostProfile == nil || *profile.LocalhostProfile == "" {
+		return nil, fmt.Errorf("localhostProfile is required for type %s",
+			profile.Type)
+	}
+	path := filepath.Clean(*profile.LocalhostProfile)
+	if filepath.IsAbs(path) ||
+		path == ".." || strings.HasPrefix(path, "../") {
+		return nil, fmt.Errorf("invalid localhostProfile %q: it must be a relative path inside the packages directory", path)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(i.rootdir, "..", "packages", path))
+	if err != nil {
+		return nil, err
+	}
+	return seccomp.LoadProfile(data)
+}
+
 func makeAppEnv(unit *api.Unit) []string {
 	var e []string
 	for _, ev := range unit.Env {
@@ -60,7 +60,7 @@ func (m *MacRuntime) RemovePodSandbox(spec *api.PodSpec) error {
 	return nil
 }
 
-func (m *MacRuntime) CreateContainer(unit api.Unit, spec *api.PodSpec, podName string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool) (*api.UnitStatus, error) {
+func (m *MacRuntime) CreateContainer(unit api.Unit, spec *api.PodSpec, podName string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool, restartBackoff api.RestartBackoff) (*api.UnitStatus, error) {
 	// check if vm already exist
 	// if it doesn't, check if vm template exists in registry
 	vmId, _ := parseImageUrl(unit.Image)
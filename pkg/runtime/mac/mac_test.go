@@ -212,7 +212,7 @@ func TestMacRuntime_CreateContainerVMTemplateNotFound(t *testing.T) {
 	unitStatus, err := macRuntime.CreateContainer(api.Unit{
 		Name:  "dummy",
 		Image: "registry:8089/not-existing-vm-template-id",
-	}, &api.PodSpec{}, "", map[string]api.RegistryCredentials{}, false)
+	}, &api.PodSpec{}, "", map[string]api.RegistryCredentials{}, false, api.RestartBackoff{})
 	assert.Error(t, err)
 	assert.NotNil(t, unitStatus.State.Waiting)
 	assert.Equal(t, "VMTemplateNotFound", unitStatus.State.Waiting.Reason)
@@ -235,7 +235,7 @@ func TestMacRuntime_CreateContainerPullingFailed(t *testing.T) {
 	unitStatus, err := macRuntime.CreateContainer(api.Unit{
 		Name:  "dummy",
 		Image: "registry:8089/vm-template-id",
-	}, &api.PodSpec{}, "", map[string]api.RegistryCredentials{}, false)
+	}, &api.PodSpec{}, "", map[string]api.RegistryCredentials{}, false, api.RestartBackoff{})
 	assert.Error(t, err)
 	assert.NotNil(t, unitStatus.State.Waiting)
 	assert.Equal(t, "VMTemplatePullFailed", unitStatus.State.Waiting.Reason)
@@ -258,7 +258,7 @@ func TestMacRuntime_CreateContainerHappyPath(t *testing.T) {
 	unitStatus, err := macRuntime.CreateContainer(api.Unit{
 		Name:  "dummy",
 		Image: "registry:8089/vm-template-id",
-	}, &api.PodSpec{}, "", map[string]api.RegistryCredentials{}, false)
+	}, &api.PodSpec{}, "", map[string]api.RegistryCredentials{}, false, api.RestartBackoff{})
 	assert.NoError(t, err)
 	assert.NotNil(t, unitStatus.State.Waiting)
 	assert.Equal(t, "VMCreated", unitStatus.State.Waiting.Reason)
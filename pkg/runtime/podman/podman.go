@@ -21,6 +21,7 @@ package podman
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/containers/podman/v2/pkg/bindings"
 	"github.com/containers/podman/v2/pkg/bindings/containers"
 	"github.com/containers/podman/v2/pkg/bindings/images"
@@ -32,7 +33,9 @@ import (
 	"github.com/elotl/itzo/pkg/logbuf"
 	"github.com/elotl/itzo/pkg/metrics"
 	"github.com/elotl/itzo/pkg/runtime"
+	itzounit "github.com/elotl/itzo/pkg/unit"
 	"github.com/elotl/itzo/pkg/util"
+	"github.com/elotl/itzo/pkg/util/kill"
 	"github.com/golang/glog"
 	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
 	v1 "k8s.io/api/core/v1"
@@ -40,6 +43,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -144,6 +148,18 @@ func (p *PodmanImageService) PullImage(rootdir, name, image string, registryCred
 	return err
 }
 
+// ImageEnv returns the default environment from the config of an image.
+func (p *PodmanImageService) ImageEnv(image string) ([]string, error) {
+	report, err := images.GetImage(p.connText, image, nil)
+	if err != nil {
+		return nil, err
+	}
+	if report.ImageData == nil || report.Config == nil {
+		return nil, nil
+	}
+	return report.Config.Env, nil
+}
+
 func (p *PodmanImageService) RemoveImage(rootdir, image string) error {
 	_, err := images.Remove(p.connText, image, false)
 	return err
@@ -158,7 +174,7 @@ func NewPodmanContainerService(ctx context.Context, rootdir string) *PodmanConta
 	return &PodmanContainerService{rootdir: rootdir, imgPuller: PodmanImageService{connText: ctx}}
 }
 
-func (pcs *PodmanContainerService) CreateContainer(unit api.Unit, spec *api.PodSpec, podName string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool) (*api.UnitStatus, error) {
+func (pcs *PodmanContainerService) CreateContainer(unit api.Unit, spec *api.PodSpec, podName string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool, restartBackoff api.RestartBackoff) (*api.UnitStatus, error) {
 	container := convert.UnitToContainer(unit, nil)
 
 	var err = pcs.imgPuller.PullImage(pcs.rootdir, unit.Name, unit.Image, registryCredentials, false)
@@ -169,17 +185,77 @@ func (pcs *PodmanContainerService) CreateContainer(unit api.Unit, spec *api.PodS
 	containerSpec := specgen.NewSpecGenerator(container.Image, false)
 	containerSpec.Name = convert.UnitNameToContainerName(unit.Name)
 	containerSpec.Pod = api.PodName
-	containerSpec.Command = unit.Command
 	containerSpec.RestartPolicy = restartPolicyMap[spec.RestartPolicy]
+	// Unlike the itzo runtime, there is no image StopTimeout to fall back on
+	// if neither the unit nor the pod sets a grace period: podman only exposes
+	// the OCI config of images, which has no stop timeout.
+	stopTimeout := uint(api.GetTerminationGracePeriod(spec, &unit) / time.Second)
+	containerSpec.StopTimeout = &stopTimeout
+	containerSpec.ResourceLimits = util.UnitResourcesToLinux(unit.Resources)
+	if unit.StopSignal != "" {
+		stopSignal, err := kill.ParseSignal(unit.StopSignal)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid stop signal for unit %s: %v", unit.Name, err)
+			return api.MakeFailedUpdateStatus(unit.Name, unit.Image, msg), err
+		}
+		containerSpec.StopSignal = &stopSignal
+	}
+	seccompProfilePath, err := getSeccompProfilePath(spec, &unit)
+	if err != nil {
+		msg := fmt.Sprintf("Invalid seccomp profile for unit %s: %v", unit.Name, err)
+		return api.MakeFailedUpdateStatus(unit.Name, unit.Image, msg), err
+	}
+	containerSpec.SeccompProfilePath = seccompProfilePath
+	err = itzounit.ValidateRlimits(unit.Rlimits)
+	if err != nil {
+		msg := fmt.Sprintf("Invalid resource limits for unit %s: %v", unit.Name, err)
+		return api.MakeFailedUpdateStatus(unit.Name, unit.Image, msg), err
+	}
+	for _, rl := range itzounit.MergeRlimits(itzounit.DefaultRlimits, unit.Rlimits) {
+		containerSpec.Rlimits = append(containerSpec.Rlimits, runtimespec.POSIXRlimit{
+			Type: "RLIMIT_" + strings.ToUpper(rl.Name),
+			Hard: rl.Hard,
+			Soft: rl.Soft,
+		})
+	}
+	if sc := unit.SecurityContext; sc != nil {
+		if sc.ReadOnlyRootFilesystem != nil {
+			containerSpec.ReadOnlyFilesystem = *sc.ReadOnlyRootFilesystem
+		}
+		if sc.Privileged != nil {
+			containerSpec.Privileged = *sc.Privileged
+		}
+		if sc.AllowPrivilegeEscalation != nil && !containerSpec.Privileged {
+			containerSpec.NoNewPrivileges = !*sc.AllowPrivilegeEscalation
+		}
+	}
+	containerSpec.Stdin = unit.Stdin
+	containerSpec.Terminal = unit.TTY
 	containerSpec.Env = make(map[string]string)
 	containerSpec.Mounts = make([]runtimespec.Mount, 0)
 
 	// TODO - examine if it's needed
+	var specEnv []string
 	for _, env := range container.Env {
 		if env.ValueFrom == nil {
 			containerSpec.Env[env.Name] = env.Value
+			specEnv = append(specEnv, env.Name+"="+env.Value)
 		}
 	}
+	// Podman merges the environment of the image on its own, but $(VAR)
+	// references in command and args need to see it too.
+	imageEnv, err := pcs.imgPuller.ImageEnv(container.Image)
+	if err != nil {
+		glog.Warningf("getting environment of image %s: %v", container.Image, err)
+	}
+	command, args := util.ExpandContainerCommandAndArgs(
+		unit.Command, unit.Args, util.MergeEnv(imageEnv, specEnv))
+	// The command of a unit replaces the entrypoint of the image, and its
+	// args the cmd of the image.
+	if len(command) > 0 {
+		containerSpec.Entrypoint = command
+	}
+	containerSpec.Command = args
 	for _, mount := range container.VolumeMounts {
 		var volume v1.Volume
 		for _, vol := range spec.Volumes {
@@ -213,6 +289,37 @@ func (pcs *PodmanContainerService) CreateContainer(unit api.Unit, spec *api.PodS
 	return api.MakeStillCreatingStatus(unit.Name, unit.Image, "Container created"), nil
 }
 
+// getSeccompProfilePath translates the seccomp profile of the unit to a
+// podman seccomp profile path. An empty path means the podman default.
+func getSeccompProfilePath(spec *api.PodSpec, unit *api.Unit) (string, error) {
+	var profile *api.SeccompProfile
+	if unit.SecurityContext != nil {
+		profile = unit.SecurityContext.SeccompProfile
+	}
+	if profile == nil && spec.SecurityContext != nil {
+		profile = spec.SecurityContext.SeccompProfile
+	}
+	if profile == nil {
+		return "", nil
+	}
+	switch profile.Type {
+	case api.SeccompProfileTypeUnconfined:
+		return "unconfined", nil
+	case api.SeccompProfileTypeRuntimeDefault:
+		return "", nil
+	case api.SeccompProfileTypeLocalhost:
+		if profile.LocalhostProfile == nil {
+			return "", fmt.Errorf("localhostProfile is required for type %s", profile.Type)
+		}
+		path := filepath.Clean(*profile.LocalhostProfile)
+		if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, "../") {
+			return "", fmt.Errorf("invalid localhostProfile %q", *profile.LocalhostProfile)
+		}
+		return filepath.Join("/tmp/itzo/packages", path), nil
+	}
+	return "", fmt.Errorf("invalid seccomp profile type %q", profile.Type)
+}
+
 func (pcs *PodmanContainerService) StartContainer(unit api.Unit, spec *api.PodSpec, podName string) (*api.UnitStatus, error) {
 	podmanContainerName := convert.UnitNameToContainerName(unit.Name)
 	err := containers.Start(pcs.imgPuller.connText, podmanContainerName, nil)
@@ -263,6 +370,12 @@ type PodmanRuntime struct {
 	PodmanContainerService
 }
 
+// PrePullImage pulls the image of a unit into the image store of podman, where
+// CreateContainer will find it.
+func (p *PodmanRuntime) PrePullImage(unit api.Unit, registryCredentials map[string]api.RegistryCredentials) error {
+	return p.imgPuller.PullImage(p.rootdir, unit.Name, unit.Image, registryCredentials, false)
+}
+
 func (p *PodmanRuntime) GetLogBuffer(options runtime.LogOptions) (*logbuf.LogBuffer, error) {
 	tail := 4096
 	if options.LineNum != 0 {
@@ -49,7 +49,7 @@ func (n NoOpPodmanRuntime) RemovePodSandbox(spec *api.PodSpec) error {
 	return nil
 }
 
-func (n NoOpPodmanRuntime) CreateContainer(unit api.Unit, spec *api.PodSpec, podName string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool) (*api.UnitStatus, error) {
+func (n NoOpPodmanRuntime) CreateContainer(unit api.Unit, spec *api.PodSpec, podName string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool, restartBackoff api.RestartBackoff) (*api.UnitStatus, error) {
 	return nil, nil
 }
 
@@ -35,7 +35,7 @@ type PodSandbox interface {
 }
 
 type ContainerService interface {
-	CreateContainer(unit api.Unit, spec *api.PodSpec, podName string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool) (*api.UnitStatus, error)
+	CreateContainer(unit api.Unit, spec *api.PodSpec, podName string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool, restartBackoff api.RestartBackoff) (*api.UnitStatus, error)
 	StartContainer(unit api.Unit, spec *api.PodSpec, podName string) (*api.UnitStatus, error)
 	RemoveContainer(unit *api.Unit) error
 	ContainerStatus(unitName, unitImage string) (*api.UnitStatus, error)
@@ -59,6 +59,28 @@ type RuntimeService interface {
 	metrics.MetricsProvider
 }
 
+// PodRestorer is implemented by runtimes that can take over the units of a
+// pod left running by a previous instance of the agent. RestorePod returns
+// the units that have been started before.
+type PodRestorer interface {
+	RestorePod(spec *api.PodSpec, podName string) (map[string]bool, error)
+}
+
+// ImagePrePuller is implemented by runtimes that can pull the image of a unit
+// without creating the unit. It's used to keep the old unit running until the
+// image of its replacement has been pulled.
+type ImagePrePuller interface {
+	PrePullImage(unit api.Unit, registryCredentials map[string]api.RegistryCredentials) error
+}
+
 type ImageService interface {
 	PullImage(rootdir, name, image string, registryCredentials map[string]api.RegistryCredentials, useOverlayfs bool) error
+	PrePullImage(rootdir, name, image string, registryCredentials map[string]api.RegistryCredentials) error
+}
+
+// UnitEventReader is implemented by runtimes that record events about units
+// outside of the agent, e.g. in the helper process of the unit. The events are
+// returned once.
+type UnitEventReader interface {
+	ReadUnitEvents(unitName string) ([]api.Event, error)
 }
@@ -0,0 +1,227 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package seccomp
+
+import (
+	"fmt"
+	"runtime"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Return values of seccomp filters, from linux/seccomp.h.
+	retKillThread  = 0x00000000
+	retKillProcess = 0x80000000
+	retTrap        = 0x00030000
+	retErrno       = 0x00050000
+	retTrace       = 0x7ff00000
+	retLog         = 0x7ffc0000
+	retAllow       = 0x7fff0000
+	retDataMask    = 0x0000ffff
+
+	// Offsets in struct seccomp_data.
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+
+	maxArgs = 6
+
+	// System calls via the x32 ABI have this bit set on x86-64.
+	x32SyscallBit = 0x40000000
+
+	// Placeholder for jumps to the end of a rule, see ruleBuilder.
+	skipToEnd = 0xff
+)
+
+// BuildFilter compiles profile into a BPF program for the native architecture.
+// System calls that don't exist on this architecture are ignored, and the
+// process is killed if it uses any other system call ABI.
+func BuildFilter(profile *specs.LinuxSeccomp) ([]bpf.RawInstruction, error) {
+	if syscallNumbers == nil {
+		return nil, fmt.Errorf("seccomp filters are not supported on %s", runtime.GOARCH)
+	}
+	defaultRet, err := toRet(profile.DefaultAction, nil)
+	if err != nil {
+		return nil, err
+	}
+	prog := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: offsetArch, Size: 4},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: nativeAuditArch, SkipTrue: 1},
+		bpf.RetConstant{Val: retKillProcess},
+		bpf.LoadAbsolute{Off: offsetNr, Size: 4},
+	}
+	if runtime.GOARCH == "amd64" {
+		prog = append(prog,
+			bpf.JumpIf{Cond: bpf.JumpLessThan, Val: x32SyscallBit, SkipTrue: 1},
+			bpf.RetConstant{Val: retKillProcess})
+	}
+	for _, call := range profile.Syscalls {
+		ret, err := toRet(call.Action, call.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range call.Names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				continue
+			}
+			rule, err := buildRule(nr, call.Args, ret)
+			if err != nil {
+				return nil, fmt.Errorf("seccomp rule for %s: %v", name, err)
+			}
+			prog = append(prog, rule...)
+		}
+	}
+	prog = append(prog, bpf.RetConstant{Val: defaultRet})
+	return bpf.Assemble(prog)
+}
+
+func toRet(action specs.LinuxSeccompAction, errnoRet *uint) (uint32, error) {
+	data := uint32(unix.EPERM)
+	if errnoRet != nil {
+		data = uint32(*errnoRet) & retDataMask
+	}
+	switch action {
+	case specs.ActKill:
+		return retKillThread, nil
+	case specs.ActKillProcess:
+		return retKillProcess, nil
+	case specs.ActTrap:
+		return retTrap, nil
+	case specs.ActErrno:
+		return retErrno | data, nil
+	case specs.ActTrace:
+		return retTrace | data, nil
+	case specs.ActLog:
+		return retLog, nil
+	case specs.ActAllow:
+		return retAllow, nil
+	}
+	return 0, fmt.Errorf("invalid seccomp action %q", action)
+}
+
+// ruleBuilder assembles the instructions of a single rule. The accumulator
+// holds the system call number when the rule starts, and again when it ends
+// without returning. Failed checks jump to the end of the rule, via the
+// skipToEnd placeholder.
+type ruleBuilder struct {
+	insts []bpf.Instruction
+}
+
+func (b *ruleBuilder) add(insts ...bpf.Instruction) {
+	b.insts = append(b.insts, insts...)
+}
+
+func (b *ruleBuilder) finish() []bpf.Instruction {
+	b.add(bpf.LoadAbsolute{Off: offsetNr, Size: 4})
+	end := len(b.insts) - 1
+	for i, inst := range b.insts {
+		jump, ok := inst.(bpf.JumpIf)
+		if !ok {
+			continue
+		}
+		if jump.SkipTrue == skipToEnd {
+			jump.SkipTrue = uint8(end - i - 1)
+		}
+		if jump.SkipFalse == skipToEnd {
+			jump.SkipFalse = uint8(end - i - 1)
+		}
+		b.insts[i] = jump
+	}
+	return b.insts
+}
+
+func buildRule(nr int, args []specs.LinuxSeccompArg, ret uint32) ([]bpf.Instruction, error) {
+	if len(args) == 0 {
+		return []bpf.Instruction{
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(nr), SkipFalse: 1},
+			bpf.RetConstant{Val: ret},
+		}, nil
+	}
+	b := &ruleBuilder{}
+	b.add(bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(nr), SkipFalse: skipToEnd})
+	// All arguments have to match.
+	for _, arg := range args {
+		if arg.Index >= maxArgs {
+			return nil, fmt.Errorf("invalid argument index %d", arg.Index)
+		}
+		err := addArgCheck(b, arg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.add(bpf.RetConstant{Val: ret})
+	return b.finish(), nil
+}
+
+// addArgCheck compares a 64 bit argument, in two 32 bit halves. Only little
+// endian architectures are supported.
+func addArgCheck(b *ruleBuilder, arg specs.LinuxSeccompArg) error {
+	loadHi := bpf.LoadAbsolute{Off: offsetArgs + 8*uint32(arg.Index) + 4, Size: 4}
+	loadLo := bpf.LoadAbsolute{Off: offsetArgs + 8*uint32(arg.Index), Size: 4}
+	hi, lo := uint32(arg.Value>>32), uint32(arg.Value)
+	switch arg.Op {
+	case specs.OpEqualTo:
+		b.add(
+			loadHi,
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: hi, SkipFalse: skipToEnd},
+			loadLo,
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: lo, SkipFalse: skipToEnd})
+	case specs.OpNotEqual:
+		b.add(
+			loadHi,
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: hi, SkipFalse: 2},
+			loadLo,
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: lo, SkipTrue: skipToEnd})
+	case specs.OpMaskedEqual:
+		// Value is the mask, ValueTwo the value to compare with.
+		vhi, vlo := uint32(arg.ValueTwo>>32), uint32(arg.ValueTwo)
+		b.add(
+			loadHi,
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: hi},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: vhi, SkipFalse: skipToEnd},
+			loadLo,
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: lo},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: vlo, SkipFalse: skipToEnd})
+	case specs.OpGreaterThan, specs.OpGreaterEqual,
+		specs.OpLessThan, specs.OpLessEqual:
+		// The high half decides, unless it's equal.
+		hiCond, loCond := bpf.JumpGreaterThan, bpf.JumpGreaterThan
+		switch arg.Op {
+		case specs.OpGreaterEqual:
+			loCond = bpf.JumpGreaterOrEqual
+		case specs.OpLessThan:
+			hiCond, loCond = bpf.JumpLessThan, bpf.JumpLessThan
+		case specs.OpLessEqual:
+			hiCond, loCond = bpf.JumpLessThan, bpf.JumpLessOrEqual
+		}
+		b.add(
+			loadHi,
+			bpf.JumpIf{Cond: hiCond, Val: hi, SkipTrue: 3},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: hi, SkipFalse: skipToEnd},
+			loadLo,
+			bpf.JumpIf{Cond: loCond, Val: lo, SkipFalse: skipToEnd})
+	default:
+		return fmt.Errorf("invalid operator %q", arg.Op)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package seccomp
+
+import (
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// seccompData builds the input of a filter for the BPF VM. The VM loads
+// words in network byte order, while the kernel uses the native one, so each
+// 32 bit half is stored big endian here.
+func seccompData(arch uint32, nr int, args ...uint64) []byte {
+	data := make([]byte, offsetArgs+8*maxArgs)
+	binary.BigEndian.PutUint32(data[offsetNr:], uint32(nr))
+	binary.BigEndian.PutUint32(data[offsetArch:], arch)
+	for i, arg := range args {
+		off := offsetArgs + 8*i
+		binary.BigEndian.PutUint32(data[off:], uint32(arg))
+		binary.BigEndian.PutUint32(data[off+4:], uint32(arg>>32))
+	}
+	return data
+}
+
+func runFilter(t *testing.T, profile *specs.LinuxSeccomp, data []byte) uint32 {
+	raw, err := BuildFilter(profile)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	insts, ok := bpf.Disassemble(raw)
+	assert.True(t, ok)
+	vm, err := bpf.NewVM(insts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	ret, err := vm.Run(data)
+	assert.NoError(t, err)
+	return uint32(ret)
+}
+
+func TestDefaultProfile(t *testing.T) {
+	eperm := uint32(retErrno | unix.EPERM)
+	testCases := []struct {
+		name     string
+		caps     []string
+		arch     uint32
+		nr       int
+		args     []uint64
+		expected uint32
+	}{
+		{
+			name:     "allowed",
+			nr:       syscallNumbers["read"],
+			expected: retAllow,
+		},
+		{
+			name:     "denied",
+			nr:       syscallNumbers["mount"],
+			expected: eperm,
+		},
+		{
+			name:     "allowed with capability",
+			caps:     []string{"CAP_SYS_ADMIN"},
+			nr:       syscallNumbers["mount"],
+			expected: retAllow,
+		},
+		{
+			name:     "clone",
+			nr:       syscallNumbers["clone"],
+			args:     []uint64{unix.CLONE_VM | unix.CLONE_THREAD},
+			expected: retAllow,
+		},
+		{
+			name:     "clone new namespace",
+			nr:       syscallNumbers["clone"],
+			args:     []uint64{unix.CLONE_NEWNS},
+			expected: eperm,
+		},
+		{
+			name:     "personality",
+			nr:       syscallNumbers["personality"],
+			args:     []uint64{0xffffffff},
+			expected: retAllow,
+		},
+		{
+			name:     "personality denied",
+			nr:       syscallNumbers["personality"],
+			args:     []uint64{0x0040000},
+			expected: eperm,
+		},
+		{
+			name:     "foreign architecture",
+			arch:     0x40000003,
+			nr:       syscallNumbers["read"],
+			expected: retKillProcess,
+		},
+	}
+	for _, tc := range testCases {
+		arch := tc.arch
+		if arch == 0 {
+			arch = nativeAuditArch
+		}
+		profile := DefaultProfile(tc.caps)
+		ret := runFilter(t, profile, seccompData(arch, tc.nr, tc.args...))
+		assert.Equal(t, tc.expected, ret, tc.name)
+	}
+}
+
+func TestArgOperators(t *testing.T) {
+	nr := syscallNumbers["write"]
+	value := uint64(0x100000010)
+	testCases := []struct {
+		op      specs.LinuxSeccompOperator
+		allowed []uint64
+		denied  []uint64
+	}{
+		{
+			op:      specs.OpEqualTo,
+			allowed: []uint64{value},
+			denied:  []uint64{0x10, 0x100000000, 0x200000010},
+		},
+		{
+			op:      specs.OpNotEqual,
+			allowed: []uint64{0x10, 0x100000000, 0x200000010},
+			denied:  []uint64{value},
+		},
+		{
+			op:      specs.OpGreaterThan,
+			allowed: []uint64{value + 1, 0x200000000},
+			denied:  []uint64{value, 0xffffffff, 0x10},
+		},
+		{
+			op:      specs.OpGreaterEqual,
+			allowed: []uint64{value, 0x200000000},
+			denied:  []uint64{value - 1, 0xffffffff},
+		},
+		{
+			op:      specs.OpLessThan,
+			allowed: []uint64{value - 1, 0xffffffff, 0},
+			denied:  []uint64{value, 0x200000000},
+		},
+		{
+			op:      specs.OpLessEqual,
+			allowed: []uint64{value, 0xffffffff},
+			denied:  []uint64{value + 1, 0x200000000},
+		},
+	}
+	for _, tc := range testCases {
+		profile := &specs.LinuxSeccomp{
+			DefaultAction: specs.ActErrno,
+			Syscalls: []specs.LinuxSyscall{
+				{
+					Names:  []string{"write"},
+					Action: specs.ActAllow,
+					Args: []specs.LinuxSeccompArg{
+						{Index: 2, Value: value, Op: tc.op},
+					},
+				},
+			},
+		}
+		for _, arg := range tc.allowed {
+			data := seccompData(nativeAuditArch, nr, 1, 0, arg)
+			ret := runFilter(t, profile, data)
+			assert.Equal(t, uint32(retAllow), ret, "%s %#x", tc.op, arg)
+		}
+		for _, arg := range tc.denied {
+			data := seccompData(nativeAuditArch, nr, 1, 0, arg)
+			ret := runFilter(t, profile, data)
+			assert.Equal(t, uint32(retErrno|unix.EPERM), ret, "%s %#x", tc.op, arg)
+		}
+	}
+}
+
+func TestMaskedEqual(t *testing.T) {
+	nr := syscallNumbers["ioctl"]
+	errno := uint(unix.ENOTTY)
+	profile := &specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Syscalls: []specs.LinuxSyscall{
+			{
+				Names:    []string{"ioctl"},
+				Action:   specs.ActErrno,
+				ErrnoRet: &errno,
+				Args: []specs.LinuxSeccompArg{
+					{Index: 1, Value: 0xff00, ValueTwo: 0x5400, Op: specs.OpMaskedEqual},
+				},
+			},
+		},
+	}
+	ret := runFilter(t, profile, seccompData(nativeAuditArch, nr, 0, 0x5412))
+	assert.Equal(t, uint32(retErrno|unix.ENOTTY), ret)
+	ret = runFilter(t, profile, seccompData(nativeAuditArch, nr, 0, 0x8912))
+	assert.Equal(t, uint32(retAllow), ret)
+}
+
+func TestLoadProfile(t *testing.T) {
+	_, err := LoadProfile([]byte(`{
+		"defaultAction": "SCMP_ACT_ERRNO",
+		"syscalls": [
+			{"names": ["read", "write", "no_such_syscall"], "action": "SCMP_ACT_ALLOW"}
+		]
+	}`))
+	assert.NoError(t, err)
+	invalid := []string{
+		`{"defaultAction": "SCMP_ACT_FOO"}`,
+		`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["read"], "action": "SCMP_ACT_FOO"}]}`,
+		`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["read"], "action": "SCMP_ACT_ERRNO", "args": [{"index": 6, "op": "SCMP_CMP_EQ"}]}]}`,
+		`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["read"], "action": "SCMP_ACT_ERRNO", "args": [{"index": 0, "op": "SCMP_CMP_FOO"}]}]}`,
+		`not json`,
+	}
+	for _, data := range invalid {
+		_, err := LoadProfile([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
+
+// The filter is installed in a child process, since it can't be removed.
+func TestInstallFilter(t *testing.T) {
+	if os.Getenv("ITZO_TEST_SECCOMP_CHILD") == "1" {
+		raw, err := BuildFilter(DefaultProfile(nil))
+		if err != nil {
+			os.Exit(2)
+		}
+		if err := InstallFilter(raw); err != nil {
+			os.Exit(3)
+		}
+		if err := unix.Unshare(unix.CLONE_NEWUTS); err != unix.EPERM {
+			os.Exit(4)
+		}
+		os.Exit(0)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInstallFilter$")
+	cmd.Env = append(os.Environ(), "ITZO_TEST_SECCOMP_CHILD=1")
+	err := cmd.Run()
+	assert.NoError(t, err)
+}
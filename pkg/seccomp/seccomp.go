@@ -0,0 +1,93 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package seccomp compiles seccomp profiles in the OCI format, the one
+// containerd uses, into BPF programs, and installs them. It does not need
+// libseccomp, so only the native architecture of the kernel is supported.
+package seccomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"unsafe"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// From linux/seccomp.h, missing from x/sys/unix.
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+)
+
+// LoadProfile parses and validates a JSON seccomp profile.
+func LoadProfile(data []byte) (*specs.LinuxSeccomp, error) {
+	var profile specs.LinuxSeccomp
+	err := json.Unmarshal(data, &profile)
+	if err != nil {
+		return nil, fmt.Errorf("decoding seccomp profile: %v", err)
+	}
+	_, err = BuildFilter(&profile)
+	if err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// InstallFilter installs filter for all threads of the calling process. The
+// filter is inherited by child processes, and can't be removed.
+func InstallFilter(filter []bpf.RawInstruction) error {
+	if len(filter) == 0 {
+		return fmt.Errorf("empty seccomp filter")
+	}
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: (*unix.SockFilter)(unsafe.Pointer(&filter[0])),
+	}
+	err := seccompSetFilter(&prog)
+	if err == unix.EACCES {
+		// Without CAP_SYS_ADMIN, the kernel only accepts a filter if
+		// no_new_privs is set.
+		err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+		if err != nil {
+			return fmt.Errorf("setting no_new_privs: %v", err)
+		}
+		err = seccompSetFilter(&prog)
+	}
+	if err != nil {
+		return fmt.Errorf("installing seccomp filter: %v", err)
+	}
+	return nil
+}
+
+func seccompSetFilter(prog *unix.SockFprog) error {
+	r1, _, errno := unix.Syscall(
+		unix.SYS_SECCOMP,
+		seccompSetModeFilter,
+		seccompFilterFlagTsync,
+		uintptr(unsafe.Pointer(prog)))
+	if errno != 0 {
+		return errno
+	}
+	if r1 != 0 {
+		return fmt.Errorf("failed to synchronize thread %d", r1)
+	}
+	return nil
+}
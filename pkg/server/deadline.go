@@ -0,0 +1,97 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"time"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/elotl/itzo/pkg/events"
+	"github.com/golang/glog"
+)
+
+// Reason and message in the status of a pod that has been active for longer
+// than its activeDeadlineSeconds, the same ones kubelet uses.
+const (
+	DeadlineExceededReason  = "DeadlineExceeded"
+	DeadlineExceededMessage = "Pod was active on the node longer than the specified deadline"
+)
+
+// activeDeadline returns when the pod has to be stopped, false if it has no
+// deadline.
+func (pc *PodController) activeDeadline() (time.Time, bool) {
+	seconds := pc.podStatus.ActiveDeadlineSeconds
+	if seconds == nil || pc.startTime.IsZero() {
+		return time.Time{}, false
+	}
+	return pc.startTime.Add(time.Duration(*seconds) * time.Second), true
+}
+
+func (pc *PodController) pastActiveDeadline() bool {
+	deadline, ok := pc.activeDeadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// updateDeadlineTimer arms the timer the update loop uses for stopping the
+// pod once it has reached its deadline, which might have changed with an
+// update.
+func (pc *PodController) updateDeadlineTimer() {
+	if pc.deadlineTimer != nil {
+		pc.deadlineTimer.Stop()
+		pc.deadlineTimer = nil
+	}
+	deadline, ok := pc.activeDeadline()
+	if !ok || pc.isDeadlineExceeded() {
+		return
+	}
+	pc.deadlineTimer = time.NewTimer(time.Until(deadline))
+}
+
+func (pc *PodController) deadlineChan() <-chan time.Time {
+	if pc.deadlineTimer == nil {
+		return nil
+	}
+	return pc.deadlineTimer.C
+}
+
+func (pc *PodController) isDeadlineExceeded() bool {
+	pc.statusLock.Lock()
+	defer pc.statusLock.Unlock()
+	return pc.deadlineExceeded
+}
+
+// enforceActiveDeadline stops all units of the pod gracefully, and marks the
+// pod failed. Units are not started again after this.
+func (pc *PodController) enforceActiveDeadline() {
+	pc.deadlineTimer = nil
+	glog.Infof("pod %s has been active longer than %ds, stopping its units",
+		pc.podName, *pc.podStatus.ActiveDeadlineSeconds)
+	pc.statusLock.Lock()
+	pc.deadlineExceeded = true
+	pc.statusLock.Unlock()
+	pc.recorder.Event("", api.EventTypeWarning, events.PodDeadlineExceeded,
+		DeadlineExceededMessage)
+	if pc.cancelFunc != nil {
+		// Init units are not waited for anymore.
+		pc.cancelFunc()
+	}
+	pc.waitGroup.Wait()
+	err := pc.runtime.StopPodSandbox(pc.podStatus)
+	if err != nil {
+		glog.Errorf("stopping units of pod %s: %v", pc.podName, err)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elotl/itzo/pkg/api"
+	runtime2 "github.com/elotl/itzo/pkg/runtime"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActiveDeadline(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "itzo-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	recorder := &startRecorder{started: make(map[string][]string)}
+	pc := newTestPodController(tmpdir, recorder, nil)
+	var lock sync.Mutex
+	var stopped []string
+	unitMgr := pc.runtime.(*runtime2.ItzoRuntime).UnitMgr.(*UnitMock)
+	unitMgr.Running = func(name string) bool { return true }
+	unitMgr.Stop = func(name string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		stopped = append(stopped, name)
+		return nil
+	}
+
+	// No deadline.
+	pc.doUpdate(makeTestPodParameters(nil))
+	pc.waitGroup.Wait()
+	assert.Nil(t, pc.deadlineChan())
+
+	// The pod has been running for longer than its new deadline.
+	pc.startTime = api.Time{Time: time.Now().Add(-time.Minute)}
+	params := makeTestPodParameters(nil)
+	seconds := int64(30)
+	params.Spec.ActiveDeadlineSeconds = &seconds
+	pc.doUpdate(params)
+	pc.waitGroup.Wait()
+	assert.True(t, pc.pastActiveDeadline())
+	select {
+	case <-pc.deadlineChan():
+	case <-time.After(3 * time.Second):
+		assert.FailNow(t, "deadline timer did not fire")
+	}
+	pc.enforceActiveDeadline()
+	sort.Strings(stopped)
+	assert.Equal(t, []string{"unit1", "unit2"}, stopped)
+
+	reply := api.PodStatusReply{
+		UnitStatuses: []api.UnitStatus{
+			terminatedStatus("unit1", 143), terminatedStatus("unit2", 143),
+		},
+	}
+	pc.FillPodStatus(&reply)
+	assert.Equal(t, api.PodFailed, reply.Phase)
+	assert.Equal(t, DeadlineExceededReason, reply.Reason)
+	assert.Equal(t, DeadlineExceededMessage, reply.Message)
+
+	// Units are not started again.
+	recorder.started = make(map[string][]string)
+	params = makeTestPodParameters(nil)
+	params.Spec.Units = append(params.Spec.Units, api.Unit{Name: "unit3", Image: "img3"})
+	pc.doUpdate(params)
+	pc.waitGroup.Wait()
+	assert.Empty(t, recorder.get())
+	assert.Nil(t, pc.deadlineChan())
+}
+
+func TestActiveDeadlineTimer(t *testing.T) {
+	recorder := &startRecorder{started: make(map[string][]string)}
+	pc := newTestPodController(DEFAULT_ROOTDIR, recorder, nil)
+	seconds := int64(3600)
+	pc.podStatus = &api.PodSpec{ActiveDeadlineSeconds: &seconds}
+	// Not started yet.
+	pc.updateDeadlineTimer()
+	assert.Nil(t, pc.deadlineChan())
+	pc.startTime = api.Now()
+	pc.updateDeadlineTimer()
+	assert.NotNil(t, pc.deadlineChan())
+	assert.False(t, pc.pastActiveDeadline())
+	// The deadline is removed with an update.
+	pc.podStatus = &api.PodSpec{}
+	pc.updateDeadlineTimer()
+	assert.Nil(t, pc.deadlineChan())
+}
@@ -0,0 +1,350 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"math"
+	goruntime "runtime"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/elotl/itzo/pkg/util"
+	"github.com/golang/glog"
+	"github.com/shirou/gopsutil/mem"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/kubernetes/third_party/forked/golang/expansion"
+)
+
+// envResolver turns the environment of units into plain values, using the
+// secrets, configmaps and metadata of a pod update.
+type envResolver struct {
+	params *api.PodParameters
+	// IP address of the pod, falls back to the one in params if empty.
+	podIP string
+	// Ephemeral storage capacity of the node is the size of this filesystem.
+	rootdir string
+	// Resources of the node, used as limits of units that don't set them.
+	// Looked up on first use.
+	capacity api.ResourceList
+}
+
+func newEnvResolver(params *api.PodParameters, podIP, rootdir string) *envResolver {
+	return &envResolver{
+		params:  params,
+		podIP:   podIP,
+		rootdir: rootdir,
+	}
+}
+
+// resolveUnits replaces the environment of units in place. Variables from
+// envFrom come first, followed by the ones in env, and a later variable
+// overrides an earlier one with the same name. References to earlier
+// variables in values are expanded. The environment of a unit is
+// resolved as far as possible even if some of it fails; errors are returned
+// keyed by unit name.
+func (r *envResolver) resolveUnits(spec *api.PodSpec) map[string]error {
+	errs := make(map[string]error)
+	for _, units := range [][]api.Unit{spec.InitUnits, spec.Units} {
+		for i := range units {
+			err := r.resolveUnit(spec, &units[i])
+			if err != nil {
+				glog.Errorf("resolving environment of unit %s: %v",
+					units[i].Name, err)
+				errs[units[i].Name] = err
+			}
+		}
+	}
+	return errs
+}
+
+func (r *envResolver) resolveUnit(spec *api.PodSpec, unit *api.Unit) error {
+	var errs []string
+	env := make([]api.EnvVar, 0, len(unit.Env))
+	index := make(map[string]int)
+	values := make(map[string]string)
+	add := func(name, value string) {
+		values[name] = value
+		if i, exists := index[name]; exists {
+			env[i].Value = value
+			return
+		}
+		index[name] = len(env)
+		env = append(env, api.EnvVar{Name: name, Value: value})
+	}
+	for _, ef := range unit.EnvFrom {
+		data, err := r.envFromSource(ef)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		keys := make([]string, 0, len(data))
+		for key := range data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			name := ef.Prefix + key
+			if msgs := validation.IsEnvVarName(name); len(msgs) > 0 {
+				glog.Warningf("skipping invalid environment variable name %q in unit %s: %s",
+					name, unit.Name, strings.Join(msgs, ", "))
+				continue
+			}
+			add(name, data[key])
+		}
+	}
+	for _, ev := range unit.Env {
+		if ev.ValueFrom == nil {
+			// Like kubelet, $(VAR) references to variables defined earlier
+			// are expanded.
+			mapping := expansion.MappingFuncFor(values)
+			add(ev.Name, expansion.Expand(ev.Value, mapping))
+			continue
+		}
+		value, ok, err := r.envVarSource(spec, unit, ev.ValueFrom)
+		if err != nil {
+			errs = append(errs,
+				fmt.Sprintf("environment variable %s: %v", ev.Name, err))
+			continue
+		}
+		if ok {
+			add(ev.Name, value)
+		}
+	}
+	unit.Env = env
+	unit.EnvFrom = nil
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
+
+func (r *envResolver) envFromSource(ef api.EnvFromSource) (map[string]string, error) {
+	switch {
+	case ef.ConfigMapRef != nil:
+		cm, exists := r.params.ConfigMaps[ef.ConfigMapRef.Name]
+		if !exists {
+			if isOptional(ef.ConfigMapRef.Optional) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("configmap %q not found",
+				ef.ConfigMapRef.Name)
+		}
+		return cm, nil
+	case ef.SecretRef != nil:
+		secret, exists := r.params.Secrets[ef.SecretRef.Name]
+		if !exists {
+			if isOptional(ef.SecretRef.Optional) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("secret %q not found", ef.SecretRef.Name)
+		}
+		data := make(map[string]string, len(secret))
+		for k, v := range secret {
+			data[k] = string(v)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("envFrom source without configMapRef or secretRef")
+}
+
+// envVarSource returns the value of a variable. False is returned if an
+// optional source is missing, in which case the variable is not set.
+func (r *envResolver) envVarSource(spec *api.PodSpec, unit *api.Unit, src *api.EnvVarSource) (string, bool, error) {
+	switch {
+	case src.FieldRef != nil:
+		value, err := r.podField(src.FieldRef.FieldPath)
+		return value, err == nil, err
+	case src.ResourceFieldRef != nil:
+		value, err := r.unitResource(spec, unit, src.ResourceFieldRef)
+		return value, err == nil, err
+	case src.ConfigMapKeyRef != nil:
+		ref := src.ConfigMapKeyRef
+		cm, exists := r.params.ConfigMaps[ref.Name]
+		if !exists {
+			if isOptional(ref.Optional) {
+				return "", false, nil
+			}
+			return "", false, fmt.Errorf("configmap %q not found", ref.Name)
+		}
+		value, exists := cm[ref.Key]
+		if !exists {
+			if isOptional(ref.Optional) {
+				return "", false, nil
+			}
+			return "", false, fmt.Errorf("key %q not found in configmap %q",
+				ref.Key, ref.Name)
+		}
+		return value, true, nil
+	case src.SecretKeyRef != nil:
+		ref := src.SecretKeyRef
+		secret, exists := r.params.Secrets[ref.Name]
+		if !exists {
+			if isOptional(ref.Optional) {
+				return "", false, nil
+			}
+			return "", false, fmt.Errorf("secret %q not found", ref.Name)
+		}
+		value, exists := secret[ref.Key]
+		if !exists {
+			if isOptional(ref.Optional) {
+				return "", false, nil
+			}
+			return "", false, fmt.Errorf("key %q not found in secret %q",
+				ref.Key, ref.Name)
+		}
+		return string(value), true, nil
+	}
+	return "", false, fmt.Errorf("valueFrom without a source")
+}
+
+func (r *envResolver) podField(path string) (string, error) {
+	namespace, name := util.SplitNamespaceAndName(r.params.PodName)
+	switch path {
+	case "metadata.name":
+		return name, nil
+	case "metadata.namespace":
+		return namespace, nil
+	case "spec.nodeName":
+		return r.params.NodeName, nil
+	case "status.podIP":
+		if r.podIP != "" {
+			return r.podIP, nil
+		}
+		return r.params.PodIP, nil
+	}
+	const prefix, suffix = "metadata.annotations['", "']"
+	if strings.HasPrefix(path, prefix) && strings.HasSuffix(path, suffix) &&
+		len(path) > len(prefix)+len(suffix) {
+		key := path[len(prefix) : len(path)-len(suffix)]
+		return r.params.Annotations[key], nil
+	}
+	return "", fmt.Errorf("unsupported fieldPath %q", path)
+}
+
+func (r *envResolver) unitResource(spec *api.PodSpec, unit *api.Unit, sel *api.ResourceFieldSelector) (string, error) {
+	target := unit
+	if sel.ContainerName != "" && sel.ContainerName != unit.Name {
+		target = nil
+		for _, units := range [][]api.Unit{spec.InitUnits, spec.Units} {
+			for i := range units {
+				if units[i].Name == sel.ContainerName {
+					target = &units[i]
+				}
+			}
+		}
+		if target == nil {
+			return "", fmt.Errorf("unit %q not found", sel.ContainerName)
+		}
+	}
+	parts := strings.SplitN(sel.Resource, ".", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("unsupported resource %q", sel.Resource)
+	}
+	kind, name := parts[0], api.ResourceName(parts[1])
+	switch name {
+	case api.ResourceCPU, api.ResourceMemory, api.ResourceEphemeralStorage:
+	default:
+		return "", fmt.Errorf("unsupported resource %q", sel.Resource)
+	}
+	var quantity resource.Quantity
+	switch kind {
+	case "limits":
+		q, err := r.limit(target, name)
+		if err != nil {
+			return "", err
+		}
+		quantity = q
+	case "requests":
+		// Requests default to limits if they are explicitly specified.
+		if q, exists := target.Resources.Requests[name]; exists {
+			quantity = q
+		} else if q, exists := target.Resources.Limits[name]; exists {
+			quantity = q
+		}
+	default:
+		return "", fmt.Errorf("unsupported resource %q", sel.Resource)
+	}
+	return convertResource(name, quantity, sel.Divisor)
+}
+
+// limit returns the limit of a resource of the unit, or the capacity of the
+// node if the unit has no limit.
+func (r *envResolver) limit(unit *api.Unit, name api.ResourceName) (resource.Quantity, error) {
+	if q, exists := unit.Resources.Limits[name]; exists {
+		return q, nil
+	}
+	if r.capacity == nil {
+		capacity, err := nodeCapacity(r.rootdir)
+		if err != nil {
+			return resource.Quantity{}, err
+		}
+		r.capacity = capacity
+	}
+	return r.capacity[name], nil
+}
+
+func nodeCapacity(rootdir string) (api.ResourceList, error) {
+	vm, err := mem.VirtualMemory()
+	if err != nil {
+		return nil, fmt.Errorf("getting memory capacity: %v", err)
+	}
+	path := rootdir
+	if path == "" {
+		path = "/"
+	}
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return nil, fmt.Errorf("getting ephemeral storage capacity: %v", err)
+	}
+	return api.ResourceList{
+		api.ResourceCPU: *resource.NewQuantity(
+			int64(goruntime.NumCPU()), resource.DecimalSI),
+		api.ResourceMemory: *resource.NewQuantity(
+			int64(vm.Total), resource.BinarySI),
+		api.ResourceEphemeralStorage: *resource.NewQuantity(
+			int64(uint64(st.Blocks)*uint64(st.Bsize)), resource.BinarySI),
+	}, nil
+}
+
+// convertResource divides a quantity by divisor, rounding up, the same way
+// the downward API of Kubernetes does.
+func convertResource(name api.ResourceName, quantity, divisor resource.Quantity) (string, error) {
+	if divisor.IsZero() {
+		divisor = resource.MustParse("1")
+	}
+	if divisor.Sign() < 0 {
+		return "", fmt.Errorf("invalid divisor %s", divisor.String())
+	}
+	var value int64
+	if name == api.ResourceCPU {
+		value = int64(math.Ceil(
+			float64(quantity.MilliValue()) / float64(divisor.MilliValue())))
+	} else {
+		value = int64(math.Ceil(
+			float64(quantity.Value()) / float64(divisor.Value())))
+	}
+	return fmt.Sprintf("%d", value), nil
+}
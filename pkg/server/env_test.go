@@ -0,0 +1,336 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	spec := &api.PodSpec{
+		Units: []api.Unit{
+			{
+				Name: "unit1",
+				Env: []api.EnvVar{
+					{
+						Name:  "foo",
+						Value: "fooval",
+					},
+					{
+						Name: "bar",
+						ValueFrom: &api.EnvVarSource{
+							SecretKeyRef: &api.SecretKeySelector{
+								Name: "name1",
+								Key:  "value1",
+							},
+						},
+					},
+					{
+						Name: "baz",
+						ValueFrom: &api.EnvVarSource{
+							SecretKeyRef: &api.SecretKeySelector{
+								Name: "name2",
+								Key:  "value2",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	params := &api.PodParameters{
+		Secrets: map[string]map[string][]byte{
+			"name1": map[string][]byte{
+				"value1": []byte("secret1"),
+			},
+		},
+	}
+	errs := newEnvResolver(params, "", "").resolveUnits(spec)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs["unit1"].Error(), "name2")
+	assert.Len(t, spec.Units[0].Env, 2)
+	assert.Equal(t, api.EnvVar{Name: "foo", Value: "fooval"}, spec.Units[0].Env[0])
+	assert.Equal(t, api.EnvVar{Name: "bar", Value: "secret1"}, spec.Units[0].Env[1])
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestResolveEnv(t *testing.T) {
+	params := &api.PodParameters{
+		PodName:     "myns_mypod",
+		NodeName:    "mynode",
+		PodIP:       "10.0.0.2",
+		Annotations: map[string]string{"team": "blue"},
+		Secrets: map[string]map[string][]byte{
+			"mysecret": {"password": []byte("hunter2")},
+		},
+		ConfigMaps: map[string]map[string]string{
+			"mycm": {"LEVEL": "debug", "MODE": "fast", "1INVALID": "x"},
+		},
+	}
+	fieldRef := func(path string) *api.EnvVarSource {
+		return &api.EnvVarSource{
+			FieldRef: &api.ObjectFieldSelector{FieldPath: path},
+		}
+	}
+	resourceRef := func(unit, res, divisor string) *api.EnvVarSource {
+		sel := &api.ResourceFieldSelector{ContainerName: unit, Resource: res}
+		if divisor != "" {
+			sel.Divisor = resource.MustParse(divisor)
+		}
+		return &api.EnvVarSource{ResourceFieldRef: sel}
+	}
+	unit := api.Unit{
+		Name: "unit1",
+		Resources: api.ResourceRequirements{
+			Limits: api.ResourceList{
+				api.ResourceCPU:    resource.MustParse("1500m"),
+				api.ResourceMemory: resource.MustParse("64Mi"),
+			},
+			Requests: api.ResourceList{
+				api.ResourceCPU: resource.MustParse("250m"),
+			},
+		},
+		EnvFrom: []api.EnvFromSource{
+			{ConfigMapRef: &api.ConfigMapEnvSource{Name: "mycm"}},
+			{Prefix: "S_", SecretRef: &api.SecretEnvSource{Name: "mysecret"}},
+			{SecretRef: &api.SecretEnvSource{
+				Name: "missing", Optional: boolPtr(true)}},
+		},
+		Env: []api.EnvVar{
+			{Name: "MODE", Value: "slow"},
+			{Name: "POD_NAME", ValueFrom: fieldRef("metadata.name")},
+			{Name: "POD_NAMESPACE", ValueFrom: fieldRef("metadata.namespace")},
+			{Name: "NODE_NAME", ValueFrom: fieldRef("spec.nodeName")},
+			{Name: "POD_IP", ValueFrom: fieldRef("status.podIP")},
+			{Name: "TEAM", ValueFrom: fieldRef("metadata.annotations['team']")},
+			{Name: "CPU_LIMIT", ValueFrom: resourceRef("", "limits.cpu", "")},
+			{Name: "CPU_REQUEST", ValueFrom: resourceRef("", "requests.cpu", "1m")},
+			{Name: "MEM_LIMIT", ValueFrom: resourceRef("", "limits.memory", "1Mi")},
+			{Name: "MEM_REQUEST", ValueFrom: resourceRef("", "requests.memory", "")},
+			{Name: "OTHER_CPU", ValueFrom: resourceRef("unit2", "requests.cpu", "1m")},
+			{
+				Name: "LEVEL2",
+				ValueFrom: &api.EnvVarSource{
+					ConfigMapKeyRef: &api.ConfigMapKeySelector{
+						Name: "mycm", Key: "LEVEL"},
+				},
+			},
+			{
+				Name: "OPTIONAL",
+				ValueFrom: &api.EnvVarSource{
+					ConfigMapKeyRef: &api.ConfigMapKeySelector{
+						Name: "mycm", Key: "missing", Optional: boolPtr(true)},
+				},
+			},
+		},
+	}
+	unit2 := api.Unit{
+		Name: "unit2",
+		Resources: api.ResourceRequirements{
+			Limits: api.ResourceList{
+				api.ResourceCPU: resource.MustParse("2"),
+			},
+		},
+	}
+	spec := &api.PodSpec{Units: []api.Unit{unit, unit2}}
+	errs := newEnvResolver(params, "", "").resolveUnits(spec)
+	assert.Empty(t, errs)
+	assert.Nil(t, spec.Units[0].EnvFrom)
+	assert.Equal(t, []api.EnvVar{
+		{Name: "LEVEL", Value: "debug"},
+		{Name: "MODE", Value: "slow"},
+		{Name: "S_password", Value: "hunter2"},
+		{Name: "POD_NAME", Value: "mypod"},
+		{Name: "POD_NAMESPACE", Value: "myns"},
+		{Name: "NODE_NAME", Value: "mynode"},
+		{Name: "POD_IP", Value: "10.0.0.2"},
+		{Name: "TEAM", Value: "blue"},
+		{Name: "CPU_LIMIT", Value: "2"},
+		{Name: "CPU_REQUEST", Value: "250"},
+		{Name: "MEM_LIMIT", Value: "64"},
+		{Name: "MEM_REQUEST", Value: "67108864"},
+		{Name: "OTHER_CPU", Value: "2000"},
+		{Name: "LEVEL2", Value: "debug"},
+	}, spec.Units[0].Env)
+
+	// The pod IP set up by the agent takes precedence.
+	spec = &api.PodSpec{Units: []api.Unit{{
+		Name: "unit1",
+		Env:  []api.EnvVar{{Name: "POD_IP", ValueFrom: fieldRef("status.podIP")}},
+	}}}
+	errs = newEnvResolver(params, "10.0.0.3", "").resolveUnits(spec)
+	assert.Empty(t, errs)
+	assert.Equal(t, "10.0.0.3", spec.Units[0].Env[0].Value)
+}
+
+func TestResolveEnvExpansion(t *testing.T) {
+	params := &api.PodParameters{
+		PodName: "myns_mypod",
+		ConfigMaps: map[string]map[string]string{
+			"mycm": {"HOST": "db"},
+		},
+	}
+	spec := &api.PodSpec{Units: []api.Unit{{
+		Name: "unit1",
+		EnvFrom: []api.EnvFromSource{
+			{ConfigMapRef: &api.ConfigMapEnvSource{Name: "mycm"}},
+		},
+		Env: []api.EnvVar{
+			{Name: "URL", Value: "http://$(HOST):$(PORT)/$(POD)"},
+			{
+				Name: "POD",
+				ValueFrom: &api.EnvVarSource{
+					FieldRef: &api.ObjectFieldSelector{
+						FieldPath: "metadata.name"},
+				},
+			},
+			{Name: "PORT", Value: "5432"},
+			{Name: "DSN", Value: "$(URL)?pod=$(POD)&cost=$$(PORT)"},
+		},
+	}}}
+	errs := newEnvResolver(params, "", "").resolveUnits(spec)
+	assert.Empty(t, errs)
+	assert.Equal(t, []api.EnvVar{
+		{Name: "HOST", Value: "db"},
+		{Name: "URL", Value: "http://db:$(PORT)/$(POD)"},
+		{Name: "POD", Value: "mypod"},
+		{Name: "PORT", Value: "5432"},
+		{Name: "DSN", Value: "http://db:$(PORT)/$(POD)?pod=mypod&cost=$(PORT)"},
+	}, spec.Units[0].Env)
+}
+
+func TestResolveEnvNodeCapacity(t *testing.T) {
+	spec := &api.PodSpec{Units: []api.Unit{{
+		Name: "unit1",
+		Env: []api.EnvVar{
+			{
+				Name: "MEM_LIMIT",
+				ValueFrom: &api.EnvVarSource{
+					ResourceFieldRef: &api.ResourceFieldSelector{
+						Resource: "limits.memory",
+					},
+				},
+			},
+		},
+	}}}
+	errs := newEnvResolver(&api.PodParameters{}, "", "").resolveUnits(spec)
+	assert.Empty(t, errs)
+	assert.NotEqual(t, "0", spec.Units[0].Env[0].Value)
+}
+
+func TestResolveEnvErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		unit api.Unit
+	}{
+		{
+			name: "missing configmap",
+			unit: api.Unit{EnvFrom: []api.EnvFromSource{
+				{ConfigMapRef: &api.ConfigMapEnvSource{Name: "missing"}},
+			}},
+		},
+		{
+			name: "missing configmap key",
+			unit: api.Unit{Env: []api.EnvVar{{
+				Name: "FOO",
+				ValueFrom: &api.EnvVarSource{
+					ConfigMapKeyRef: &api.ConfigMapKeySelector{
+						Name: "mycm", Key: "missing"},
+				},
+			}}},
+		},
+		{
+			name: "unsupported field",
+			unit: api.Unit{Env: []api.EnvVar{{
+				Name: "FOO",
+				ValueFrom: &api.EnvVarSource{
+					FieldRef: &api.ObjectFieldSelector{FieldPath: "spec.foo"},
+				},
+			}}},
+		},
+		{
+			name: "unsupported resource",
+			unit: api.Unit{Env: []api.EnvVar{{
+				Name: "FOO",
+				ValueFrom: &api.EnvVarSource{
+					ResourceFieldRef: &api.ResourceFieldSelector{
+						Resource: "limits.gpu"},
+				},
+			}}},
+		},
+		{
+			name: "missing unit",
+			unit: api.Unit{Env: []api.EnvVar{{
+				Name: "FOO",
+				ValueFrom: &api.EnvVarSource{
+					ResourceFieldRef: &api.ResourceFieldSelector{
+						ContainerName: "missing", Resource: "limits.cpu"},
+				},
+			}}},
+		},
+	}
+	params := &api.PodParameters{
+		ConfigMaps: map[string]map[string]string{"mycm": {"FOO": "foo"}},
+	}
+	for _, tc := range testCases {
+		tc.unit.Name = "unit1"
+		spec := &api.PodSpec{Units: []api.Unit{tc.unit}}
+		errs := newEnvResolver(params, "", "").resolveUnits(spec)
+		assert.Error(t, errs["unit1"], tc.name)
+	}
+}
+
+func TestEnvConfigErrorStatus(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "itzo-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	recorder := &startRecorder{started: make(map[string][]string)}
+	pc := newTestPodController(tmpdir, recorder, nil)
+	env := []api.EnvVar{{
+		Name: "LEVEL",
+		ValueFrom: &api.EnvVarSource{
+			ConfigMapKeyRef: &api.ConfigMapKeySelector{
+				Name: "mycm", Key: "LEVEL"},
+		},
+	}}
+	pc.doUpdate(makeTestPodParameters(env))
+	pc.waitGroup.Wait()
+	assert.Contains(t, recorder.get(), "unit1")
+	assert.NotContains(t, recorder.get(), "unit2")
+	status := pc.syncErrors["unit2"]
+	assert.NotNil(t, status.State.Waiting)
+	assert.True(t, status.State.Waiting.StartFailure)
+	assert.Equal(t, EnvConfigErrorReason, status.State.Waiting.Reason)
+	assert.Contains(t, status.State.Waiting.Message, "mycm")
+
+	// The configmap shows up in the next update.
+	params := makeTestPodParameters(env)
+	params.ConfigMaps = map[string]map[string]string{"mycm": {"LEVEL": "info"}}
+	pc.doUpdate(params)
+	pc.waitGroup.Wait()
+	assert.Equal(t, []string{"LEVEL=info"}, recorder.get()["unit2"])
+	assert.NotContains(t, pc.syncErrors, "unit2")
+}
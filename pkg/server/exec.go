@@ -59,6 +59,7 @@ func (s *Server) runExec(ws *wsstream.WSReadWriter, params api.ExecParams) {
 
 	var env []string
 
+	var rlimits []api.Rlimit
 	// allow us to skip entering namespace for testing
 	if !params.SkipNSEnter {
 		unit, err := unit.OpenUnit(s.installRootdir, unitName)
@@ -111,11 +112,19 @@ func (s *Server) runExec(ws *wsstream.WSReadWriter, params api.ExecParams) {
 			"/usr/bin/nsenter",
 			"-t",
 			strconv.Itoa(pid),
-			"-p",
 			"-u",
 			"-m",
 			"-n",
 		}
+		// The helper of the unit is in the PID and IPC namespaces of the
+		// unit, unless they are the ones of the node.
+		pidMode, ipcMode := unit.GetNamespaceModes()
+		if pidMode != api.NamespaceModeNode {
+			nsenterCmd = append(nsenterCmd, "-p")
+		}
+		if ipcMode != api.NamespaceModeNode {
+			nsenterCmd = append(nsenterCmd, "-i")
+		}
 		if uid != 0 || gid != 0 {
 			userSpec := []string{
 				"-S",
@@ -126,6 +135,18 @@ func (s *Server) runExec(ws *wsstream.WSReadWriter, params api.ExecParams) {
 			nsenterCmd = append(nsenterCmd, userSpec...)
 		}
 		command = append(nsenterCmd, command...)
+		rlimits = unit.GetRlimits()
+	}
+
+	if len(rlimits) > 0 {
+		// Resource limits are not inherited via nsenter, itzo sets them
+		// before executing the command.
+		command = append([]string{
+			"/proc/self/exe",
+			"--rlimits",
+			unit.FormatRlimits(rlimits),
+			"--",
+		}, command...)
 	}
 
 	glog.Infof("Exec command: %s", command[0])
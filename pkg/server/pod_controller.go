@@ -18,12 +18,14 @@ package server
 
 import (
 	"fmt"
+	"github.com/elotl/itzo/pkg/events"
 	"github.com/elotl/itzo/pkg/logbuf"
 	"github.com/elotl/itzo/pkg/mount"
 	"github.com/elotl/itzo/pkg/runtime"
 	"github.com/elotl/itzo/pkg/runtime/podman"
 	"github.com/elotl/itzo/pkg/runtime/mac"
 	"github.com/elotl/itzo/pkg/util/conmap"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
@@ -40,11 +42,21 @@ const (
 	UpdateTypePodCreate       = "pod_created"
 	UpdateTypeUnitsChange     = "units_changed"
 	UseOverlayfsAnnotationKey = "pod.elotl.co/image-overlay-rootfs"
+	// Exponential backoff between unit restarts, as Go durations, e.g. "10s".
+	RestartBackoffBaseAnnotationKey  = "pod.elotl.co/restart-backoff-base"
+	RestartBackoffMaxAnnotationKey   = "pod.elotl.co/restart-backoff-max"
+	RestartBackoffResetAnnotationKey = "pod.elotl.co/restart-backoff-reset"
+	// Reason in the status of units whose environment can't be resolved.
+	EnvConfigErrorReason = "CreateContainerConfigError"
+	// Reason in the status of units waiting for their image.
+	UnitCreatingReason = "ContainerCreating"
 )
 
 var (
 	specChanSize                = 100
 	waitForInitUnitPollInterval = 1 * time.Second
+	// Maximum number of images pulled at the same time during a pod sync.
+	ImagePullParallelism = 3
 )
 
 // I know how to do one thing: Make Controllers. A ton of controllers...
@@ -58,9 +70,15 @@ type PodController struct {
 	allCreds    map[string]api.RegistryCredentials
 	// We keep syncErrors in the map between syncs until a sync works
 	// and we clear or overwrite the error
-	syncErrors               map[string]api.UnitStatus
-	cancelFunc               context.CancelFunc
-	waitGroup                sync.WaitGroup
+	syncErrors map[string]api.UnitStatus
+	// Units are created and started in the background, so access to
+	// syncErrors goes through syncErrorsLock.
+	syncErrorsLock sync.Mutex
+	cancelFunc     context.CancelFunc
+	waitGroup      sync.WaitGroup
+	// Tracks units of the last update that are created once their image has
+	// been pulled.
+	createGroup              sync.WaitGroup
 	netNS                    string
 	podIP                    string
 	podRestartCount          int32
@@ -69,6 +87,30 @@ type PodController struct {
 	// these are annotations with prefix of "pod.elotl.co/"
 	// which are passed from kip
 	annotations map[string]string
+	// The last applied pod update is saved here. State is not saved if it's
+	// empty.
+	stateDir string
+	// Units of the restored pod that had been started by the previous
+	// instance of the agent, if some of the units are still to be started
+	// once the next update brings their secrets.
+	restoredUnits map[string]bool
+	// Units of the last update whose environment could not be resolved.
+	envErrors map[string]error
+	// When the pod was first created.
+	startTime api.Time
+	// Protects the fields below, used for computing the status of the pod.
+	statusLock sync.Mutex
+	// Last reported conditions of the pod, for keeping track of their
+	// transition times.
+	conditions map[api.PodConditionType]api.PodCondition
+	// Set if an init unit has failed and it won't be restarted.
+	initFailure string
+	// Set once the pod has been stopped because of its activeDeadlineSeconds.
+	deadlineExceeded bool
+	// Fires when the active deadline of the pod is reached.
+	deadlineTimer *time.Timer
+	// Recent events of the pod and its units.
+	recorder *events.Recorder
 }
 
 func NewPodController(rootdir string, runtimeName string) (*PodController, error) {
@@ -103,6 +145,8 @@ func NewPodController(rootdir string, runtimeName string) (*PodController, error
 		podRestartCount:          0,
 		runtimeName:              runtimeName,
 		currentlyRestartingUnits: conmap.NewKeyTypeValueType(),
+		stateDir:                 filepath.Join(rootdir, stateDirName),
+		recorder:                 events.NewRecorder(events.DefaultCapacity),
 	}, nil
 }
 
@@ -112,6 +156,12 @@ func (pc *PodController) SetPodNetwork(netNS, podIP string) {
 	pc.runtime.SetPodNetwork(netNS, podIP)
 }
 
+// SetPodIP sets the IP address of a pod that uses the network of the host,
+// so units can look it up via the downward API.
+func (pc *PodController) SetPodIP(podIP string) {
+	pc.podIP = podIP
+}
+
 func (pc *PodController) runUpdateLoop() {
 	for {
 		// pull updates off until we have no more updates since we
@@ -120,24 +170,142 @@ func (pc *PodController) runUpdateLoop() {
 			<-pc.updateChan
 			continue
 		}
-		podParams := <-pc.updateChan
-		glog.Infof("New pod update")
-		pc.doUpdate(podParams)
+		select {
+		case podParams := <-pc.updateChan:
+			glog.Infof("New pod update")
+			pc.doUpdate(podParams)
+		case <-pc.deadlineChan():
+			pc.enforceActiveDeadline()
+		}
 	}
 }
 
 func (pc *PodController) doUpdate(podParams *api.PodParameters) {
+	if pc.isDeadlineExceeded() {
+		glog.Infof("pod %s has exceeded its active deadline, ignoring update",
+			pc.podName)
+		return
+	}
+	// Resolving the environment of units modifies the spec, so a copy for
+	// saving is made beforehand.
+	saved, err := stripPodParameters(podParams)
+	if err != nil {
+		glog.Errorf("copying pod update for saving: %v", err)
+	}
+	// Units of the last update still waiting for their images are created
+	// with the credentials and annotations of that update.
+	pc.createGroup.Wait()
 	pc.podName = podParams.PodName
 	pc.podHostname = podParams.PodHostname
+	if pc.startTime.IsZero() {
+		pc.startTime = api.Now()
+	}
 	spec := &podParams.Spec
-	MergeSecretsIntoSpec(podParams.Secrets, spec.Units)
-	MergeSecretsIntoSpec(podParams.Secrets, spec.InitUnits)
+	pc.envErrors = newEnvResolver(podParams, pc.podIP, pc.rootdir).resolveUnits(spec)
+	// Units are created with settings from the annotations, e.g. their
+	// restart backoff.
+	pc.annotations = podParams.Annotations
 	pc.SyncPodUnits(spec, pc.podStatus, podParams.Credentials)
 	pc.podStatus = spec
-	pc.annotations = podParams.Annotations
+	if saved != nil {
+		pc.saveState(saved)
+	}
+	pc.updateDeadlineTimer()
+}
+
+func (pc *PodController) saveState(params *api.PodParameters) {
+	if pc.stateDir == "" {
+		return
+	}
+	state := podState{
+		Params:       *params,
+		RestartCount: pc.podRestartCount,
+		StartTime:    pc.startTime,
+	}
+	err := saveState(pc.stateDir, podStateFile, &state)
+	if err != nil {
+		glog.Errorf("saving pod state: %v", err)
+	}
+}
+
+// restoreState picks up the pod saved by a previous instance of the agent.
+// Units that are still running are adopted by the runtime, and the ones that
+// have not been started yet are started, without touching the rest.
+func (pc *PodController) restoreState() error {
+	if pc.stateDir == "" {
+		return nil
+	}
+	var state podState
+	found, err := loadState(pc.stateDir, podStateFile, &state)
+	if err != nil || !found {
+		return err
+	}
+	params := &state.Params
+	glog.Infof("restoring pod %s", params.PodName)
+	pc.podName = params.PodName
+	pc.podHostname = params.PodHostname
+	pc.annotations = params.Annotations
+	pc.podRestartCount = state.RestartCount
+	pc.startTime = state.StartTime
+	spec := &params.Spec
+	spec.Phase = api.PodRunning
+	pc.podStatus = spec
+	restorer, ok := pc.runtime.(runtime.PodRestorer)
+	if !ok {
+		glog.Infof("runtime %s keeps units running on its own", pc.runtimeName)
+		return nil
+	}
+	started, err := restorer.RestorePod(spec, pc.podName)
+	if err != nil {
+		return err
+	}
+	if pc.pastActiveDeadline() {
+		// The update loop stops the pod right away.
+		return nil
+	}
+	var pending []api.Unit
+	for _, unit := range append(spec.InitUnits, spec.Units...) {
+		if !started[unit.Name] {
+			pending = append(pending, unit)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if unitsUseSecrets(pending) {
+		// Secrets are not saved, wait for them.
+		glog.Infof("units of pod %s will be started on the next update",
+			pc.podName)
+		pc.restoredUnits = started
+		return nil
+	}
+	pc.envErrors = newEnvResolver(params, pc.podIP, pc.rootdir).resolveUnits(spec)
+	pc.startUnits(spec, spec.InitUnits, sendUnits(spec.Units), started)
+	return nil
+}
+
+func unitsUseSecrets(units []api.Unit) bool {
+	for _, unit := range units {
+		for _, ev := range unit.Env {
+			if ev.ValueFrom != nil && ev.ValueFrom.SecretKeyRef != nil {
+				return true
+			}
+		}
+		for _, ef := range unit.EnvFrom {
+			if ef.SecretRef != nil {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (pc *PodController) Start() {
+	err := pc.restoreState()
+	if err != nil {
+		glog.Errorf("restoring pod state: %v", err)
+	}
+	pc.updateDeadlineTimer()
 	go pc.runUpdateLoop()
 }
 
@@ -163,35 +331,6 @@ func (pc *PodController) UpdatePod(params *api.PodParameters) error {
 	return nil
 }
 
-// Modifies the PodSpec and inserts secrets into the spec
-func MergeSecretsIntoSpec(secrets map[string]map[string][]byte, units []api.Unit) {
-	for i := 0; i < len(units); i++ {
-		newEnv := make([]api.EnvVar, 0, len(units[i].Env))
-		for _, ev := range units[i].Env {
-			if ev.ValueFrom == nil {
-				newEnv = append(newEnv, ev)
-			} else if ev.ValueFrom.SecretKeyRef != nil {
-				name := ev.ValueFrom.SecretKeyRef.Name
-				key := ev.ValueFrom.SecretKeyRef.Key
-				m, exists := secrets[name]
-				if !exists {
-					glog.Errorf("Could not find secret for env var %s at %s[%s]",
-						ev.Name, name, key)
-					continue
-				}
-				val, exists := m[key]
-				if !exists {
-					glog.Errorf("Could not find secret for env var %s at %s[%s]",
-						ev.Name, name, key)
-					continue
-				}
-				newEnv = append(newEnv, api.EnvVar{Name: ev.Name, Value: string(val)})
-			}
-		}
-		units[i].Env = newEnv
-	}
-}
-
 func unitsEqual(specUnit, statusUnit api.Unit) bool {
 	if specUnit.Image == statusUnit.Image && specUnit.Name == statusUnit.Name {
 		return true
@@ -268,10 +407,25 @@ func (pc *PodController) SyncPodUnits(spec *api.PodSpec, status *api.PodSpec, al
 	glog.Infof("detected change: %s", event)
 	var initsToStart []api.Unit
 	var unitsToStart []api.Unit
+	// Units of a new pod, sent once they have been created.
+	var created <-chan api.Unit
+	// Units restored after a restart of the agent that are still to be
+	// started.
+	started := pc.restoredUnits
+	pc.restoredUnits = nil
 	switch event {
 	case UpdateTypeNoChanges:
-		// there aren't any units to restart
-		return event
+		if started == nil {
+			// Units that failed to start because of their environment
+			// might have what they need now.
+			initsToStart, unitsToStart, started = pc.envFailedUnits(spec)
+			if len(initsToStart) == 0 && len(unitsToStart) == 0 {
+				// there aren't any units to restart
+				return event
+			}
+			break
+		}
+		initsToStart, unitsToStart = spec.InitUnits, spec.Units
 	case UpdateTypeUnitsChange:
 		addUnits, err := pc.RestartUnits(spec, status)
 		if err != nil {
@@ -279,23 +433,104 @@ func (pc *PodController) SyncPodUnits(spec *api.PodSpec, status *api.PodSpec, al
 			return event
 		}
 		initsToStart, unitsToStart = []api.Unit{}, addUnits
+		if started != nil {
+			for _, unit := range addUnits {
+				started[unit.Name] = false
+			}
+			initsToStart, unitsToStart = spec.InitUnits, spec.Units
+		}
 	case UpdateTypePodCreate:
 		// start pod
-
-		err := pc.CreatePod(spec)
+		var err error
+		created, err = pc.CreatePod(spec)
 		if err != nil {
 			glog.Errorf("error creating pod: %v", err)
 			return event
 		}
-		initsToStart, unitsToStart = spec.InitUnits, spec.Units
+		initsToStart = spec.InitUnits
 	case UpdateTypePodRestart:
-		err := pc.RestartPod(spec, status)
+		var err error
+		created, err = pc.RestartPod(spec, status)
 		if err != nil {
 			glog.Errorf("error restarting pod: %v", err)
 			return event
 		}
 		initsToStart = spec.InitUnits
-		unitsToStart = spec.Units
+		started = nil
+	}
+	if created == nil {
+		created = sendUnits(unitsToStart)
+	}
+	pc.startUnits(spec, initsToStart, created, started)
+	spec.Phase = api.PodRunning
+	return event
+}
+
+// envFailedUnits returns the units of spec that have not been started
+// because their environment could not be resolved. If an init unit failed,
+// the units after it have never been started either.
+func (pc *PodController) envFailedUnits(spec *api.PodSpec) ([]api.Unit, []api.Unit, map[string]bool) {
+	started := make(map[string]bool)
+	for _, unit := range spec.InitUnits {
+		if pc.hasEnvConfigError(unit.Name) {
+			return spec.InitUnits, spec.Units, started
+		}
+		started[unit.Name] = true
+	}
+	var units []api.Unit
+	for _, unit := range spec.Units {
+		if pc.hasEnvConfigError(unit.Name) {
+			units = append(units, unit)
+		}
+	}
+	return nil, units, nil
+}
+
+func (pc *PodController) getSyncError(name string) (api.UnitStatus, bool) {
+	pc.syncErrorsLock.Lock()
+	defer pc.syncErrorsLock.Unlock()
+	status, exists := pc.syncErrors[name]
+	return status, exists
+}
+
+func (pc *PodController) setSyncError(name string, status api.UnitStatus) {
+	pc.syncErrorsLock.Lock()
+	defer pc.syncErrorsLock.Unlock()
+	pc.syncErrors[name] = status
+}
+
+func (pc *PodController) clearSyncError(name string) {
+	pc.syncErrorsLock.Lock()
+	defer pc.syncErrorsLock.Unlock()
+	delete(pc.syncErrors, name)
+}
+
+func (pc *PodController) hasEnvConfigError(name string) bool {
+	status, exists := pc.getSyncError(name)
+	return exists && status.State.Waiting != nil &&
+		status.State.Waiting.Reason == EnvConfigErrorReason
+}
+
+// setEnvConfigError records the error of a unit that can't be started
+// because its environment could not be resolved.
+func (pc *PodController) setEnvConfigError(unit api.Unit, err error) {
+	unitStatus := api.MakeFailedUpdateStatus(
+		unit.Name, unit.Image, EnvConfigErrorReason)
+	unitStatus.State.Waiting.Message = err.Error()
+	pc.setSyncError(unit.Name, *unitStatus)
+	pc.recorder.Eventf(unit.Name, api.EventTypeWarning,
+		events.FailedToCreateUnit, "Error: %v", err)
+}
+
+// startUnits starts init units one by one, then the rest of the units in the
+// background, in the order they are received from unitsToStart. Units in
+// started are not started again, but init units are still waited for. Units
+// whose environment could not be resolved are not started, and neither is
+// anything after such an init unit.
+func (pc *PodController) startUnits(spec *api.PodSpec, initsToStart []api.Unit, unitsToStart <-chan api.Unit, started map[string]bool) {
+	envErrors := pc.envErrors
+	if len(initsToStart) > 0 {
+		pc.setInitFailure("")
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	if pc.cancelFunc != nil {
@@ -314,31 +549,64 @@ func (pc *PodController) SyncPodUnits(spec *api.PodSpec, status *api.PodSpec, al
 		}
 		for _, unit := range initsToStart {
 			// Start init units first, one by one, and wait for each to finish.
-			unitStatus, err := pc.runtime.StartContainer(unit, spec, pc.podName)
-			if err != nil {
-				glog.Errorf("error starting unit %s : %v", unit.Name, err)
-				pc.syncErrors[unit.Name] = *unitStatus
-				pc.waitGroup.Done()
-				return
+			if !started[unit.Name] {
+				if err := envErrors[unit.Name]; err != nil {
+					pc.setEnvConfigError(unit, err)
+					pc.waitGroup.Done()
+					return
+				}
+				if !pc.startUnit(unit, spec) {
+					pc.waitGroup.Done()
+					return
+				}
 			}
 			if !pc.waitForInitUnit(ctx, unit.Name, unit.Image, ipolicy) {
+				if ctx.Err() == nil {
+					// The init unit failed, and it won't be restarted.
+					pc.setInitFailure(fmt.Sprintf(
+						"init unit %s failed", unit.Name))
+				}
+				pc.waitGroup.Done()
 				return
 			}
 		}
-		for _, unit := range unitsToStart {
-			unitStatus, err := pc.runtime.StartContainer(unit, spec, pc.podName)
-			if err != nil {
-				glog.Errorf("error starting unit %s : %v", unit.Name, err)
-				pc.syncErrors[unit.Name] = *unitStatus
-				pc.waitGroup.Done()
-				return
+		for unit := range unitsToStart {
+			if started[unit.Name] {
+				continue
+			}
+			if err := envErrors[unit.Name]; err != nil {
+				pc.setEnvConfigError(unit, err)
+				continue
 			}
-			delete(pc.syncErrors, unit.Name)
+			// A unit failing to start doesn't keep the rest from starting.
+			pc.startUnit(unit, spec)
 		}
 		pc.waitGroup.Done()
 	}()
-	spec.Phase = api.PodRunning
-	return event
+}
+
+// startUnit starts a unit, and records the error if it fails.
+func (pc *PodController) startUnit(unit api.Unit, spec *api.PodSpec) bool {
+	unitStatus, err := pc.runtime.StartContainer(unit, spec, pc.podName)
+	if err != nil {
+		glog.Errorf("error starting unit %s : %v", unit.Name, err)
+		pc.setSyncError(unit.Name, *unitStatus)
+		pc.recorder.Eventf(unit.Name, api.EventTypeWarning,
+			events.FailedToStartUnit, "Error: %v", err)
+		return false
+	}
+	pc.clearSyncError(unit.Name)
+	return true
+}
+
+// sendUnits returns a closed channel with units in it.
+func sendUnits(units []api.Unit) <-chan api.Unit {
+	ch := make(chan api.Unit, len(units))
+	for _, unit := range units {
+		ch <- unit
+	}
+	close(ch)
+	return ch
 }
 
 func (pc *PodController) waitForInitUnit(ctx context.Context, name, image string, policy api.RestartPolicy) bool {
@@ -387,7 +655,7 @@ func (pc *PodController) GetStatus() ([]api.UnitStatus, []api.UnitStatus, error)
 				unitStatus = api.MakeStillCreatingStatus(unit.Name, unit.Image, "ContainerCreating")
 			}
 		}
-		failedStatus, exists := pc.syncErrors[unit.Name]
+		failedStatus, exists := pc.getSyncError(unit.Name)
 		if exists {
 			unitStatus = &failedStatus
 		}
@@ -399,7 +667,7 @@ func (pc *PodController) GetStatus() ([]api.UnitStatus, []api.UnitStatus, error)
 			// TODO add proper handling
 			glog.Error(err)
 		}
-		failedStatus, exists := pc.syncErrors[unit.Name]
+		failedStatus, exists := pc.getSyncError(unit.Name)
 		if exists {
 			unitStatus = &failedStatus
 		}
@@ -418,64 +686,234 @@ func (pc *PodController) GetStatus() ([]api.UnitStatus, []api.UnitStatus, error)
 	return statuses, initStatuses, nil
 }
 
-// returns: units to start, init units to start
-func (pc *PodController) RestartPod(spec, status *api.PodSpec) error {
+// RestartPod tears down the units of status and creates the ones of spec. The
+// units are created in the background, see createContainers.
+func (pc *PodController) RestartPod(spec, status *api.PodSpec) (<-chan api.Unit, error) {
 	glog.Info("init units not equal, trying to restart pod")
+	pc.recorder.Event("", api.EventTypeNormal, events.PodRestarted,
+		"Init units changed, restarting pod")
 	for _, unit := range status.Units {
-		err := pc.runtime.RemoveContainer(&unit)
+		err := pc.removeContainer(unit)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 	err := pc.runtime.StopPodSandbox(status)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = pc.runtime.RemovePodSandbox(status)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = pc.runtime.RunPodSandbox(spec)
+	err = pc.runPodSandbox(spec)
 	if err != nil {
-		return err
-	}
-	for _, unit := range spec.Units {
-		unitStatus, err := pc.runtime.CreateContainer(unit, spec, pc.podName, pc.allCreds, pc.useImageOverlayRootfs())
-		if err != nil {
-			pc.syncErrors[unit.Name] = *unitStatus
-			return err
-		}
+		return nil, err
 	}
+	created := pc.createContainers(spec)
 	pc.podRestartCount += 1
 	spec.Phase = api.PodDispatching
-	return nil
+	return created, nil
 }
 
-func (pc *PodController) CreatePod(spec *api.PodSpec) error {
+// CreatePod sets up a new pod. Its units are created in the background, see
+// createContainers.
+func (pc *PodController) CreatePod(spec *api.PodSpec) (<-chan api.Unit, error) {
 	glog.Info("status units are nil, trying to create pod from scratch")
+	err := pc.runPodSandbox(spec)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("successfully created pod %s", pc.podName)
+	return pc.createContainers(spec), nil
+}
+
+// runPodSandbox sets up the volumes of the pod.
+func (pc *PodController) runPodSandbox(spec *api.PodSpec) error {
 	err := pc.runtime.RunPodSandbox(spec)
 	if err != nil {
-		return err
+		pc.recorder.Eventf("", api.EventTypeWarning, events.FailedMountVolume,
+			"Unable to mount volumes: %v", err)
 	}
+	return err
+}
+
+// createContainers pulls the images of the units of spec in parallel, and
+// creates each unit in the background as soon as its image is there. Created
+// units are sent on the returned channel, which is closed once all of them
+// are done. Until then, units are reported as waiting for their image. Units
+// whose image can't be pulled or that can't be created are only recorded in
+// syncErrors, the rest of the units don't wait for them.
+func (pc *PodController) createContainers(spec *api.PodSpec) <-chan api.Unit {
 	for _, unit := range spec.Units {
-		glog.Infof("trying to create container: %s", unit.Name)
-		unitStatus, err := pc.runtime.CreateContainer(unit, spec, pc.podName, pc.allCreds, pc.useImageOverlayRootfs())
-		if err != nil {
-			pc.syncErrors[unit.Name] = *unitStatus
-			glog.Errorf("cannot create container %v", err)
-			return err
+		unitStatus := api.MakeStillCreatingStatus(
+			unit.Name, unit.Image, UnitCreatingReason)
+		unitStatus.State.Waiting.Message = fmt.Sprintf(
+			"Pulling image %q", unit.Image)
+		pc.setSyncError(unit.Name, *unitStatus)
+	}
+	pulls := pc.pullImages(spec.Units)
+	created := make(chan api.Unit, len(spec.Units))
+	pc.createGroup.Add(1)
+	go func() {
+		defer pc.createGroup.Done()
+		defer close(created)
+		for pull := range pulls {
+			if pull.err != nil {
+				continue
+			}
+			unit := pull.unit
+			glog.Infof("trying to create container: %s", unit.Name)
+			err := pc.createContainer(unit, spec)
+			if err != nil {
+				glog.Errorf("cannot create container %v", err)
+				continue
+			}
+			pc.clearSyncError(unit.Name)
+			created <- unit
 		}
+	}()
+	return created
+}
+
+func (pc *PodController) createContainer(unit api.Unit, spec *api.PodSpec) error {
+	unitStatus, err := pc.runtime.CreateContainer(unit, spec, pc.podName, pc.allCreds, pc.useImageOverlayRootfs(), pc.restartBackoff())
+	if err != nil {
+		pc.setSyncError(unit.Name, *unitStatus)
+		pc.recorder.Eventf(unit.Name, api.EventTypeWarning,
+			events.FailedToCreateUnit, "Error: %v", err)
+		return err
 	}
-	glog.Infof("successfully created pod %s", pc.podName)
+	pc.recorder.Eventf(unit.Name, api.EventTypeNormal,
+		events.CreatedUnit, "Created unit %s", unit.Name)
 	return nil
 }
 
+// removeContainer stops and removes a unit. Events the unit has recorded are
+// picked up first, they are gone with the unit.
+func (pc *PodController) removeContainer(unit api.Unit) error {
+	pc.collectUnitEvents([]api.Unit{unit})
+	pc.recorder.Eventf(unit.Name, api.EventTypeNormal,
+		events.KillingUnit, "Stopping unit %s", unit.Name)
+	return pc.runtime.RemoveContainer(&unit)
+}
+
+// unitPull is the outcome of pulling the image of a unit.
+type unitPull struct {
+	unit api.Unit
+	err  error
+}
+
+// pullImages pulls the images of units ahead of creating them, at most
+// ImagePullParallelism at a time. Units sharing an image only pull it once.
+// Units are sent on the returned channel as soon as their image has been
+// pulled or has failed to, and the channel is closed once all pulls are done.
+// Failed pulls are also recorded in syncErrors. Runtimes that can't pull
+// images on their own are left to pull when creating units, their units are
+// sent right away.
+func (pc *PodController) pullImages(units []api.Unit) <-chan unitPull {
+	results := make(chan unitPull, len(units))
+	puller, ok := pc.runtime.(runtime.ImagePrePuller)
+	if !ok {
+		for _, unit := range units {
+			results <- unitPull{unit: unit}
+		}
+		close(results)
+		return results
+	}
+	var images []string
+	unitsByImage := make(map[string][]api.Unit)
+	for _, unit := range units {
+		if _, exists := unitsByImage[unit.Image]; !exists {
+			images = append(images, unit.Image)
+		}
+		unitsByImage[unit.Image] = append(unitsByImage[unit.Image], unit)
+	}
+	parallelism := ImagePullParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	slots := make(chan struct{}, parallelism)
+	creds := pc.allCreds
+	var wg sync.WaitGroup
+	for _, image := range images {
+		imageUnits := unitsByImage[image]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			err := pc.pullImage(puller, imageUnits, creds)
+			<-slots
+			for _, unit := range imageUnits {
+				results <- unitPull{unit: unit, err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// pullImage pulls the image shared by units.
+func (pc *PodController) pullImage(puller runtime.ImagePrePuller, units []api.Unit, creds map[string]api.RegistryCredentials) error {
+	unit := units[0]
+	glog.Infof("pulling image %s", unit.Image)
+	pc.recorder.Eventf(unit.Name, api.EventTypeNormal,
+		events.PullingImage, "Pulling image %q", unit.Image)
+	start := time.Now()
+	err := puller.PrePullImage(unit, creds)
+	if err == nil {
+		pc.recorder.Eventf(unit.Name, api.EventTypeNormal,
+			events.PulledImage, "Successfully pulled image %q in %v",
+			unit.Image, time.Since(start).Round(time.Millisecond))
+		return nil
+	}
+	for _, unit := range units {
+		glog.Errorf("pulling image %s for unit %s failed: %v",
+			unit.Image, unit.Name, err)
+		msg := fmt.Sprintf("Pulling image failed: %v", err)
+		pc.setSyncError(unit.Name, *api.MakeFailedUpdateStatus(
+			unit.Name, unit.Image, msg))
+		pc.recorder.Eventf(unit.Name, api.EventTypeWarning,
+			events.FailedToPullImage, "Failed to pull image %q: %v",
+			unit.Image, err)
+	}
+	return err
+}
+
+// prePullImages pulls the images of units that replace a unit of the pod,
+// before the old unit is torn down. If the image can't be pulled, the old unit
+// is kept in spec in place of the new one, so it keeps running, and the
+// failure is reported in syncErrors. The update is tried again next time.
+func (pc *PodController) prePullImages(spec, status *api.PodSpec) {
+	var replacements []api.Unit
+	for i := range spec.Units {
+		if i < len(status.Units) && !unitsEqual(spec.Units[i], status.Units[i]) {
+			replacements = append(replacements, spec.Units[i])
+		}
+	}
+	failed := make(map[string]bool)
+	for pull := range pc.pullImages(replacements) {
+		failed[pull.unit.Name] = pull.err != nil
+	}
+	for i := range spec.Units {
+		if i >= len(status.Units) || !failed[spec.Units[i].Name] {
+			continue
+		}
+		glog.Infof("keeping unit %s running", status.Units[i].Name)
+		spec.Units[i] = status.Units[i]
+	}
+}
+
 func (pc *PodController) RestartUnits(spec, status *api.PodSpec) ([]api.Unit, error) {
+	pc.prePullImages(spec, status)
 	addUnits, deleteUnits := diffUnits(spec.Units, status.Units)
 	spec.Phase = api.PodWaiting
 
 	for _, unit := range deleteUnits {
-		err := pc.runtime.RemoveContainer(&unit)
+		err := pc.removeContainer(unit)
 		if err != nil {
 			return []api.Unit{}, err
 		}
@@ -483,9 +921,8 @@ func (pc *PodController) RestartUnits(spec, status *api.PodSpec) ([]api.Unit, er
 	}
 
 	for _, unit := range addUnits {
-		unitStatus, err := pc.runtime.CreateContainer(unit, spec, pc.podName, pc.allCreds, pc.useImageOverlayRootfs())
+		err := pc.createContainer(unit, spec)
 		if err != nil {
-			pc.syncErrors[unit.Name] = *unitStatus
 			return []api.Unit{}, err
 		}
 		pc.currentlyRestartingUnits.Delete(unit.Name)
@@ -513,6 +950,30 @@ func (pc *PodController) useImageOverlayRootfs() bool {
 	return true
 }
 
+// restartBackoff returns the restart backoff settings for the units of the
+// pod. Missing or invalid annotations leave the default of the runtime in
+// place.
+func (pc *PodController) restartBackoff() api.RestartBackoff {
+	return api.RestartBackoff{
+		Base:  pc.durationAnnotation(RestartBackoffBaseAnnotationKey),
+		Max:   pc.durationAnnotation(RestartBackoffMaxAnnotationKey),
+		Reset: pc.durationAnnotation(RestartBackoffResetAnnotationKey),
+	}
+}
+
+func (pc *PodController) durationAnnotation(key string) time.Duration {
+	val, ok := pc.annotations[key]
+	if !ok {
+		return 0
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		glog.Errorf("invalid duration %q for annotation %s", val, key)
+		return 0
+	}
+	return d
+}
+
 // Metrics
 //
 // These methods are just passthrough to the underlying runtime implementation
@@ -536,3 +997,30 @@ func (pc *PodController) UnitRunning(unit string) bool {
 func (pc *PodController) GetPid(unitName string) (int, bool) {
 	return pc.runtime.GetPid(unitName)
 }
+
+// collectUnitEvents adds the events the runtime has recorded for units to the
+// events of the pod.
+func (pc *PodController) collectUnitEvents(units []api.Unit) {
+	reader, ok := pc.runtime.(runtime.UnitEventReader)
+	if !ok {
+		return
+	}
+	for _, unit := range units {
+		unitEvents, err := reader.ReadUnitEvents(unit.Name)
+		if err != nil {
+			glog.Warningf("reading events of unit %s: %v", unit.Name, err)
+		}
+		for _, event := range unitEvents {
+			pc.recorder.Record(event)
+		}
+	}
+}
+
+// ReadEvents returns the events of the pod after the cursor since, and the
+// cursor for reading the next ones.
+func (pc *PodController) ReadEvents(since int64) ([]api.Event, int64) {
+	status := pc.podStatus
+	pc.collectUnitEvents(status.InitUnits)
+	pc.collectUnitEvents(status.Units)
+	return pc.recorder.ReadSince(since)
+}
@@ -17,12 +17,15 @@ limitations under the License.
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/elotl/itzo/pkg/logbuf"
 	runtime2 "github.com/elotl/itzo/pkg/runtime"
 	"github.com/elotl/itzo/pkg/util/conmap"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -32,48 +35,6 @@ import (
 	"golang.org/x/net/context"
 )
 
-func TestMergeSecretsIntoSpec(t *testing.T) {
-	spec := &api.PodSpec{
-		Units: []api.Unit{
-			{
-				Env: []api.EnvVar{
-					{
-						Name:  "foo",
-						Value: "fooval",
-					},
-					{
-						Name: "bar",
-						ValueFrom: &api.EnvVarSource{
-							SecretKeyRef: &api.SecretKeySelector{
-								Name: "name1",
-								Key:  "value1",
-							},
-						},
-					},
-					{
-						Name: "baz",
-						ValueFrom: &api.EnvVarSource{
-							SecretKeyRef: &api.SecretKeySelector{
-								Name: "name2",
-								Key:  "value2",
-							},
-						},
-					},
-				},
-			},
-		},
-	}
-	secrets := map[string]map[string][]byte{
-		"name1": map[string][]byte{
-			"value1": []byte("secret1"),
-		},
-	}
-	MergeSecretsIntoSpec(secrets, spec.Units)
-	assert.Len(t, spec.Units[0].Env, 2)
-	assert.Equal(t, api.EnvVar{"foo", "fooval", nil}, spec.Units[0].Env[0])
-	assert.Equal(t, api.EnvVar{"bar", "secret1", nil}, spec.Units[0].Env[1])
-}
-
 func TestUnitsSlicesEqual(t *testing.T) {
 	testCases := []struct {
 		name           string
@@ -312,6 +273,71 @@ type MountMock struct {
 	Detach func(unitname, dst string) error
 }
 
+func TestRestartBackoff(t *testing.T) {
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    api.RestartBackoff
+	}{
+		{
+			"no annotations",
+			nil,
+			api.RestartBackoff{},
+		},
+		{
+			"all annotations",
+			map[string]string{
+				RestartBackoffBaseAnnotationKey:  "10s",
+				RestartBackoffMaxAnnotationKey:   "2m",
+				RestartBackoffResetAnnotationKey: "1h",
+			},
+			api.RestartBackoff{
+				Base:  10 * time.Second,
+				Max:   2 * time.Minute,
+				Reset: time.Hour,
+			},
+		},
+		{
+			"invalid annotations",
+			map[string]string{
+				RestartBackoffBaseAnnotationKey: "ten seconds",
+				RestartBackoffMaxAnnotationKey:  "-1m",
+			},
+			api.RestartBackoff{},
+		},
+	}
+	for _, tc := range testCases {
+		pc := PodController{annotations: tc.annotations}
+		assert.Equal(t, tc.expected, pc.restartBackoff(), tc.name)
+	}
+}
+
+func TestRestartBackoffNewPod(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "itzo-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	recorder := &startRecorder{started: make(map[string][]string)}
+	pc := newTestPodController(tmpdir, recorder, nil)
+	params := makeTestPodParameters(nil)
+	params.Annotations = map[string]string{
+		RestartBackoffBaseAnnotationKey: "10s",
+		RestartBackoffMaxAnnotationKey:  "2m",
+	}
+	pc.doUpdate(params)
+	pc.waitGroup.Wait()
+	for _, name := range []string{"unit1", "unit2"} {
+		buf, err := ioutil.ReadFile(filepath.Join(tmpdir, name, "unitConfig"))
+		assert.NoError(t, err)
+		var uc unit.UnitConfig
+		assert.NoError(t, json.Unmarshal(buf, &uc))
+		expected := api.RestartBackoff{
+			Base: 10 * time.Second,
+			Max:  2 * time.Minute,
+		}
+		assert.Equal(t, expected, uc.RestartBackoff, name)
+	}
+}
+
 func NewMountMock() *MountMock {
 	return &MountMock{
 		Create: func(vol *api.Volume) error {
@@ -346,7 +372,8 @@ func (m *MountMock) DetachMount(unitname, dst string) error {
 }
 
 type ImagePullMock struct {
-	Pull func(rootdir, name, image string, registryCredentials map[string]api.RegistryCredentials, overlayRootfs bool) error
+	Pull    func(rootdir, name, image string, registryCredentials map[string]api.RegistryCredentials, overlayRootfs bool) error
+	PrePull func(rootdir, name, image string, registryCredentials map[string]api.RegistryCredentials) error
 }
 
 func (p *ImagePullMock) ListImages() {
@@ -365,11 +392,18 @@ func (p *ImagePullMock) PullImage(rootdir, name, image string, registryCredentia
 	return p.Pull(rootdir, name, image, registryCredentials, overlayRootfs)
 }
 
+func (p *ImagePullMock) PrePullImage(rootdir, name, image string, registryCredentials map[string]api.RegistryCredentials) error {
+	return p.PrePull(rootdir, name, image, registryCredentials)
+}
+
 func NewImagePullMock() *ImagePullMock {
 	return &ImagePullMock{
 		Pull: func(rootdir, name, image string, registryCredentials map[string]api.RegistryCredentials, overlayRootfs bool) error {
 			return nil
 		},
+		PrePull: func(rootdir, name, image string, registryCredentials map[string]api.RegistryCredentials) error {
+			return nil
+		},
 	}
 }
 
@@ -377,9 +411,15 @@ type UnitMock struct {
 	Start  func(string, string, string, string, string, []string, []string, []string, api.RestartPolicy) error
 	Stop   func(string) error
 	Remove func(string) error
+	Adopt  func(string, string) (bool, error)
+	// Optional, units are not running by default.
+	Running func(string) bool
 }
 
 func (u *UnitMock) UnitRunning(s string) bool {
+	if u.Running != nil {
+		return u.Running(s)
+	}
 	return false
 }
 
@@ -407,6 +447,26 @@ func (u *UnitMock) RemoveUnit(name string) error {
 	return u.Remove(name)
 }
 
+func (u *UnitMock) RemovePodNamespaces() error {
+	return nil
+}
+
+func (u *UnitMock) AdoptUnit(podName, unitName string) (bool, error) {
+	return u.Adopt(podName, unitName)
+}
+
+func (u *UnitMock) AdoptPodNamespaces() error {
+	return nil
+}
+
+func (u *UnitMock) GetFsUsage(unitName string) (uint64, error) {
+	return 0, nil
+}
+
+func (u *UnitMock) ReadUnitEvents(unitName string) ([]api.Event, error) {
+	return nil, nil
+}
+
 func NewUnitMock() *UnitMock {
 	return &UnitMock{
 		Start: func(pod, hostname, name, workingdir, netns string, command, args, env []string, rp api.RestartPolicy) error {
@@ -418,6 +478,9 @@ func NewUnitMock() *UnitMock {
 		Remove: func(name string) error {
 			return nil
 		},
+		Adopt: func(pod, name string) (bool, error) {
+			return false, nil
+		},
 	}
 }
 
@@ -595,6 +658,239 @@ func TestFullSyncErrors(t *testing.T) {
 	}
 }
 
+func TestPrePullImages(t *testing.T) {
+	testCases := []struct {
+		name       string
+		pullErr    error
+		removed    []string
+		started    []string
+		imageAfter string
+	}{
+		{
+			name:       "pulled",
+			removed:    []string{"unit1"},
+			started:    []string{"unit1"},
+			imageAfter: "img:2",
+		},
+		{
+			name:       "pull failed",
+			pullErr:    fmt.Errorf("manifest unknown"),
+			removed:    nil,
+			started:    []string{},
+			imageAfter: "img:1",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			status := &api.PodSpec{
+				Units: []api.Unit{
+					{Name: "unit1", Image: "img:1"},
+					{Name: "unit2", Image: "other"},
+				},
+			}
+			spec := &api.PodSpec{
+				Units: []api.Unit{
+					{Name: "unit1", Image: "img:2"},
+					{Name: "unit2", Image: "other"},
+				},
+			}
+			recorder := &startRecorder{started: make(map[string][]string)}
+			pc := newTestPodController(DEFAULT_ROOTDIR, recorder, nil)
+			pc.stateDir = ""
+			r := pc.runtime.(*runtime2.ItzoRuntime)
+			var removed []string
+			r.UnitMgr.(*UnitMock).Remove = func(name string) error {
+				removed = append(removed, name)
+				return nil
+			}
+			var pulled []string
+			r.ImgPuller.(*ImagePullMock).PrePull = func(rootdir, name, image string, creds map[string]api.RegistryCredentials) error {
+				pulled = append(pulled, image)
+				return tc.pullErr
+			}
+			event := pc.SyncPodUnits(spec, status, nil)
+			pc.waitGroup.Wait()
+			assert.Equal(t, UpdateTypeUnitsChange, event)
+			assert.Equal(t, []string{"img:2"}, pulled)
+			assert.Equal(t, tc.removed, removed)
+			var started []string
+			for name := range recorder.get() {
+				started = append(started, name)
+			}
+			assert.ElementsMatch(t, tc.started, started)
+			assert.Equal(t, tc.imageAfter, spec.Units[0].Image)
+			failed, exists := pc.syncErrors["unit1"]
+			assert.Equal(t, tc.pullErr != nil, exists)
+			if exists {
+				assert.True(t, failed.State.Waiting.StartFailure)
+				assert.Contains(t, failed.State.Waiting.Reason, "manifest unknown")
+			}
+		})
+	}
+}
+
+func TestPullImagesParallel(t *testing.T) {
+	savedParallelism := ImagePullParallelism
+	defer func() { ImagePullParallelism = savedParallelism }()
+	ImagePullParallelism = 2
+	recorder := &startRecorder{started: make(map[string][]string)}
+	pc := newTestPodController(DEFAULT_ROOTDIR, recorder, nil)
+	r := pc.runtime.(*runtime2.ItzoRuntime)
+	var mu sync.Mutex
+	pulls := make(map[string]int)
+	running, maxRunning := 0, 0
+	release := make(chan struct{})
+	r.ImgPuller.(*ImagePullMock).PrePull = func(rootdir, name, image string, creds map[string]api.RegistryCredentials) error {
+		mu.Lock()
+		pulls[image]++
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if image == "bad" {
+			return fmt.Errorf("manifest unknown")
+		}
+		return nil
+	}
+	units := []api.Unit{
+		{Name: "unit1", Image: "img1"},
+		{Name: "unit2", Image: "img2"},
+		{Name: "unit3", Image: "img1"},
+		{Name: "unit4", Image: "bad"},
+		{Name: "unit5", Image: "bad"},
+	}
+	done := make(chan map[string]error)
+	go func() {
+		errs := make(map[string]error)
+		for pull := range pc.pullImages(units) {
+			if pull.err != nil {
+				errs[pull.unit.Name] = pull.err
+			}
+		}
+		done <- errs
+	}()
+	// Both slots are taken before any of the pulls finishes.
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		mu.Lock()
+		n := running
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		release <- struct{}{}
+	}
+	errs := <-done
+	assert.Equal(t, map[string]int{"img1": 1, "img2": 1, "bad": 1}, pulls)
+	assert.Equal(t, 2, maxRunning)
+	assert.Len(t, errs, 2)
+	assert.Error(t, errs["unit4"])
+	assert.Error(t, errs["unit5"])
+	assert.Len(t, pc.syncErrors, 2)
+	assert.Contains(t, pc.syncErrors["unit5"].State.Waiting.Reason, "manifest unknown")
+}
+
+func TestCreatePodSlowAndFailedPulls(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "itzo-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	recorder := &startRecorder{started: make(map[string][]string)}
+	isStarted := func(name string) bool {
+		recorder.Lock()
+		defer recorder.Unlock()
+		_, ok := recorder.started[name]
+		return ok
+	}
+	pc := newTestPodController(tmpdir, recorder, nil)
+	pc.stateDir = ""
+	r := pc.runtime.(*runtime2.ItzoRuntime)
+	release := make(chan struct{})
+	r.ImgPuller.(*ImagePullMock).PrePull = func(rootdir, name, image string, creds map[string]api.RegistryCredentials) error {
+		switch image {
+		case "slow":
+			<-release
+		case "bad":
+			return fmt.Errorf("manifest unknown")
+		}
+		return nil
+	}
+	var mu sync.Mutex
+	var created []string
+	r.ImgPuller.(*ImagePullMock).Pull = func(rootdir, name, image string, creds map[string]api.RegistryCredentials, overlayRootfs bool) error {
+		mu.Lock()
+		defer mu.Unlock()
+		created = append(created, name)
+		return nil
+	}
+	params := makeTestPodParameters(nil)
+	params.Spec.Units = []api.Unit{
+		{Name: "slow", Image: "slow"},
+		{Name: "bad", Image: "bad"},
+		{Name: "good", Image: "good"},
+	}
+	// The update doesn't wait for the pulls.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pc.doUpdate(params)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "timed out waiting for update")
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; {
+		if isStarted("good") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, isStarted("good"))
+	assert.False(t, isStarted("slow"))
+	assert.False(t, isStarted("bad"))
+	mu.Lock()
+	assert.Equal(t, []string{"good"}, created)
+	mu.Unlock()
+	statuses, _, err := pc.GetStatus()
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 3)
+	byName := make(map[string]api.UnitStatus)
+	for _, status := range statuses {
+		byName[status.Name] = status
+	}
+	slow := byName["slow"].State.Waiting
+	if assert.NotNil(t, slow) {
+		assert.Equal(t, UnitCreatingReason, slow.Reason)
+		assert.Contains(t, slow.Message, "Pulling image")
+		assert.False(t, slow.StartFailure)
+	}
+	bad := byName["bad"].State.Waiting
+	if assert.NotNil(t, bad) {
+		assert.True(t, bad.StartFailure)
+		assert.Contains(t, bad.Reason, "manifest unknown")
+	}
+	good := byName["good"].State.Waiting
+	if assert.NotNil(t, good) {
+		assert.False(t, good.StartFailure)
+		assert.NotEqual(t, UnitCreatingReason, good.Reason)
+	}
+	close(release)
+	pc.createGroup.Wait()
+	pc.waitGroup.Wait()
+	assert.True(t, isStarted("slow"))
+	assert.False(t, isStarted("bad"))
+	assert.ElementsMatch(t, []string{"good", "slow"}, created)
+	assert.Len(t, pc.syncErrors, 1)
+	assert.Contains(t, pc.syncErrors, "bad")
+}
+
 func TestPodController_SyncPodUnits(t *testing.T) {
 	testCases := []struct {
 		name                 string
@@ -896,3 +1192,51 @@ func TestWaitForInitUnitReturnCases(t *testing.T) {
 		cancel()
 	}
 }
+
+func TestFailedInitUnitUpdate(t *testing.T) {
+	waitForInitUnitPollInterval = 1 * time.Millisecond
+	tmpdir, err := ioutil.TempDir("", "itzo-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	recorder := &startRecorder{started: make(map[string][]string)}
+	pc := newTestPodController(tmpdir, recorder, nil)
+	unitMgr := pc.runtime.(*runtime2.ItzoRuntime).UnitMgr.(*UnitMock)
+	unitMgr.Start = func(pod, hostname, name, workingdir, netns string, command, args, env []string, rp api.RestartPolicy) error {
+		if name == "init" {
+			// The init unit fails right away.
+			u, err := unit.OpenUnit(tmpdir, name)
+			assert.NoError(t, err)
+			err = u.SetState(api.UnitState{
+				Terminated: &api.UnitStateTerminated{ExitCode: 1},
+			}, nil)
+			assert.NoError(t, err)
+		}
+		return recorder.start(pod, hostname, name, workingdir, netns, command, args, env, rp)
+	}
+	// Updates used to wait forever for the failed init unit.
+	update := func(params *api.PodParameters) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			pc.doUpdate(params)
+			pc.waitGroup.Wait()
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "timed out waiting for update")
+		}
+	}
+	params := makeTestPodParameters(nil)
+	params.Spec.RestartPolicy = api.RestartPolicyNever
+	params.Spec.InitUnits = []api.Unit{{Name: "init", Image: "img0"}}
+	update(params)
+	assert.Contains(t, recorder.get(), "init")
+	assert.NotContains(t, recorder.get(), "unit1")
+	params = makeTestPodParameters(nil)
+	params.Spec.RestartPolicy = api.RestartPolicyNever
+	params.Spec.InitUnits = []api.Unit{{Name: "init", Image: "img0"}}
+	params.Spec.Units = append(params.Spec.Units, api.Unit{Name: "unit3", Image: "img3"})
+	update(params)
+	assert.Contains(t, recorder.get(), "unit3")
+}
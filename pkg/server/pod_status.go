@@ -0,0 +1,197 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/elotl/itzo/pkg/api"
+)
+
+// Reasons of pod conditions, the same ones kubelet uses.
+const (
+	UnitsNotInitializedReason = "ContainersNotInitialized"
+	UnitsNotReadyReason       = "ContainersNotReady"
+	PodCompletedReason        = "PodCompleted"
+	InitUnitFailedReason      = "InitContainerFailed"
+)
+
+// FillPodStatus adds the phase, conditions, restart count and start time of
+// the pod to reply, based on the unit statuses in it.
+func (pc *PodController) FillPodStatus(reply *api.PodStatusReply) {
+	pc.statusLock.Lock()
+	defer pc.statusLock.Unlock()
+	reply.RestartCount = pc.podRestartCount
+	reply.StartTime = pc.startTime
+	spec := pc.podStatus
+	if len(spec.Units) == 0 && len(spec.InitUnits) == 0 {
+		reply.Phase = api.PodPending
+		return
+	}
+	reply.Phase = getPodPhase(spec.RestartPolicy,
+		reply.InitUnitStatuses, reply.UnitStatuses, pc.initFailure != "")
+	if pc.deadlineExceeded {
+		reply.Phase = api.PodFailed
+		reply.Reason = DeadlineExceededReason
+		reply.Message = DeadlineExceededMessage
+	}
+	now := api.Now()
+	initialized := pc.initializedCondition(reply.InitUnitStatuses)
+	unitsReady := unitsReadyCondition(reply.Phase, reply.UnitStatuses)
+	ready := unitsReady
+	ready.Type = api.PodReady
+	var conditions []api.PodCondition
+	for _, cond := range []api.PodCondition{initialized, unitsReady, ready} {
+		conditions = append(conditions, pc.updateCondition(cond, now))
+	}
+	reply.Conditions = conditions
+}
+
+// updateCondition keeps the last transition time of the condition if its
+// status has not changed since the last time it was reported.
+func (pc *PodController) updateCondition(cond api.PodCondition, now api.Time) api.PodCondition {
+	if pc.conditions == nil {
+		pc.conditions = make(map[api.PodConditionType]api.PodCondition)
+	}
+	last, exists := pc.conditions[cond.Type]
+	if exists && last.Status == cond.Status {
+		cond.LastTransitionTime = last.LastTransitionTime
+	} else {
+		cond.LastTransitionTime = now
+	}
+	pc.conditions[cond.Type] = cond
+	return cond
+}
+
+// setInitFailure records that an init unit failed and won't be retried, which
+// makes the pod fail.
+func (pc *PodController) setInitFailure(msg string) {
+	pc.statusLock.Lock()
+	defer pc.statusLock.Unlock()
+	pc.initFailure = msg
+}
+
+func (pc *PodController) initializedCondition(initStatuses []api.UnitStatus) api.PodCondition {
+	cond := api.PodCondition{
+		Type:   api.PodInitialized,
+		Status: api.ConditionTrue,
+	}
+	if pc.initFailure != "" {
+		cond.Status = api.ConditionFalse
+		cond.Reason = InitUnitFailedReason
+		cond.Message = pc.initFailure
+		return cond
+	}
+	var incomplete []string
+	for _, status := range initStatuses {
+		if !succeeded(status) {
+			incomplete = append(incomplete, status.Name)
+		}
+	}
+	if len(incomplete) > 0 {
+		cond.Status = api.ConditionFalse
+		cond.Reason = UnitsNotInitializedReason
+		cond.Message = fmt.Sprintf("units with incomplete status: %s",
+			formatNames(incomplete))
+	}
+	return cond
+}
+
+func unitsReadyCondition(phase api.PodPhase, statuses []api.UnitStatus) api.PodCondition {
+	cond := api.PodCondition{
+		Type:   api.ContainersReady,
+		Status: api.ConditionTrue,
+	}
+	if phase == api.PodSucceeded {
+		cond.Status = api.ConditionFalse
+		cond.Reason = PodCompletedReason
+		return cond
+	}
+	var unready []string
+	for _, status := range statuses {
+		if !status.Ready {
+			unready = append(unready, status.Name)
+		}
+	}
+	if len(unready) > 0 {
+		cond.Status = api.ConditionFalse
+		cond.Reason = UnitsNotReadyReason
+		cond.Message = fmt.Sprintf("units with unready status: %s",
+			formatNames(unready))
+	}
+	return cond
+}
+
+func formatNames(names []string) string {
+	sort.Strings(names)
+	return "[" + strings.Join(names, " ") + "]"
+}
+
+func succeeded(status api.UnitStatus) bool {
+	return status.State.Terminated != nil &&
+		status.State.Terminated.ExitCode == 0
+}
+
+// getPodPhase computes the phase of the pod from the statuses of its units,
+// following the rules kubelet uses.
+func getPodPhase(policy api.RestartPolicy, initStatuses, statuses []api.UnitStatus, initFailed bool) api.PodPhase {
+	if initFailed {
+		return api.PodFailed
+	}
+	for _, status := range initStatuses {
+		if !succeeded(status) {
+			return api.PodPending
+		}
+	}
+	waiting, running, stopped, succeededUnits := 0, 0, 0, 0
+	for _, status := range statuses {
+		switch {
+		case status.State.Running != nil:
+			running++
+		case status.State.Terminated != nil:
+			stopped++
+			if status.State.Terminated.ExitCode == 0 {
+				succeededUnits++
+			}
+		default:
+			waiting++
+		}
+	}
+	switch {
+	case waiting > 0:
+		return api.PodPending
+	case running > 0:
+		return api.PodRunning
+	case stopped > 0:
+		// All units have exited.
+		if policy == api.RestartPolicyAlways {
+			// They are about to be restarted.
+			return api.PodRunning
+		}
+		if stopped == succeededUnits {
+			return api.PodSucceeded
+		}
+		if policy == api.RestartPolicyNever {
+			return api.PodFailed
+		}
+		// Failed units are restarted with OnFailure.
+		return api.PodRunning
+	}
+	return api.PodPending
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func waitingStatus(name string) api.UnitStatus {
+	return *api.MakeStillCreatingStatus(name, "img", "ContainerCreating")
+}
+
+func runningStatus(name string, ready bool) api.UnitStatus {
+	return api.UnitStatus{
+		Name:  name,
+		State: api.UnitState{Running: &api.UnitStateRunning{StartedAt: api.Now()}},
+		Ready: ready,
+	}
+}
+
+func terminatedStatus(name string, exitCode int32) api.UnitStatus {
+	return api.UnitStatus{
+		Name: name,
+		State: api.UnitState{
+			Terminated: &api.UnitStateTerminated{ExitCode: exitCode},
+		},
+	}
+}
+
+func TestGetPodPhase(t *testing.T) {
+	testCases := []struct {
+		name         string
+		policy       api.RestartPolicy
+		initStatuses []api.UnitStatus
+		statuses     []api.UnitStatus
+		initFailed   bool
+		phase        api.PodPhase
+	}{
+		{
+			name:     "pulling images",
+			policy:   api.RestartPolicyAlways,
+			statuses: []api.UnitStatus{waitingStatus("u1"), runningStatus("u2", true)},
+			phase:    api.PodPending,
+		},
+		{
+			name:         "init unit running",
+			policy:       api.RestartPolicyAlways,
+			initStatuses: []api.UnitStatus{terminatedStatus("i1", 0), runningStatus("i2", false)},
+			statuses:     []api.UnitStatus{waitingStatus("u1")},
+			phase:        api.PodPending,
+		},
+		{
+			name:       "init unit failed",
+			policy:     api.RestartPolicyNever,
+			statuses:   []api.UnitStatus{waitingStatus("u1")},
+			initFailed: true,
+			phase:      api.PodFailed,
+		},
+		{
+			name:         "running",
+			policy:       api.RestartPolicyNever,
+			initStatuses: []api.UnitStatus{terminatedStatus("i1", 0)},
+			statuses:     []api.UnitStatus{runningStatus("u1", true), terminatedStatus("u2", 1)},
+			phase:        api.PodRunning,
+		},
+		{
+			name:     "succeeded",
+			policy:   api.RestartPolicyOnFailure,
+			statuses: []api.UnitStatus{terminatedStatus("u1", 0), terminatedStatus("u2", 0)},
+			phase:    api.PodSucceeded,
+		},
+		{
+			name:     "failed",
+			policy:   api.RestartPolicyNever,
+			statuses: []api.UnitStatus{terminatedStatus("u1", 0), terminatedStatus("u2", 2)},
+			phase:    api.PodFailed,
+		},
+		{
+			name:     "restarting on failure",
+			policy:   api.RestartPolicyOnFailure,
+			statuses: []api.UnitStatus{terminatedStatus("u1", 2)},
+			phase:    api.PodRunning,
+		},
+		{
+			name:     "restarting always",
+			policy:   api.RestartPolicyAlways,
+			statuses: []api.UnitStatus{terminatedStatus("u1", 0)},
+			phase:    api.PodRunning,
+		},
+	}
+	for _, tc := range testCases {
+		phase := getPodPhase(tc.policy, tc.initStatuses, tc.statuses, tc.initFailed)
+		assert.Equal(t, tc.phase, phase, tc.name)
+	}
+}
+
+func findCondition(conditions []api.PodCondition, condType api.PodConditionType) api.PodCondition {
+	for _, cond := range conditions {
+		if cond.Type == condType {
+			return cond
+		}
+	}
+	return api.PodCondition{}
+}
+
+func TestFillPodStatus(t *testing.T) {
+	recorder := &startRecorder{started: make(map[string][]string)}
+	pc := newTestPodController(DEFAULT_ROOTDIR, recorder, nil)
+	var reply api.PodStatusReply
+	pc.FillPodStatus(&reply)
+	assert.Equal(t, api.PodPending, reply.Phase)
+	assert.Empty(t, reply.Conditions)
+
+	pc.podStatus = &api.PodSpec{
+		RestartPolicy: api.RestartPolicyAlways,
+		InitUnits:     []api.Unit{{Name: "i1"}},
+		Units:         []api.Unit{{Name: "u1"}, {Name: "u2"}},
+	}
+	pc.podRestartCount = 2
+	pc.startTime = api.Now()
+	reply = api.PodStatusReply{
+		InitUnitStatuses: []api.UnitStatus{runningStatus("i1", false)},
+		UnitStatuses:     []api.UnitStatus{waitingStatus("u1"), waitingStatus("u2")},
+	}
+	pc.FillPodStatus(&reply)
+	assert.Equal(t, api.PodPending, reply.Phase)
+	assert.Equal(t, int32(2), reply.RestartCount)
+	assert.Equal(t, pc.startTime, reply.StartTime)
+	assert.Len(t, reply.Conditions, 3)
+	initialized := findCondition(reply.Conditions, api.PodInitialized)
+	assert.Equal(t, api.ConditionFalse, initialized.Status)
+	assert.Equal(t, UnitsNotInitializedReason, initialized.Reason)
+	assert.Contains(t, initialized.Message, "[i1]")
+	unitsReady := findCondition(reply.Conditions, api.ContainersReady)
+	assert.Equal(t, api.ConditionFalse, unitsReady.Status)
+	assert.Contains(t, unitsReady.Message, "[u1 u2]")
+	firstTransition := unitsReady.LastTransitionTime
+	assert.False(t, firstTransition.IsZero())
+
+	// Still not ready, the transition time stays the same.
+	time.Sleep(10 * time.Millisecond)
+	reply = api.PodStatusReply{
+		InitUnitStatuses: []api.UnitStatus{terminatedStatus("i1", 0)},
+		UnitStatuses:     []api.UnitStatus{runningStatus("u1", true), runningStatus("u2", false)},
+	}
+	pc.FillPodStatus(&reply)
+	assert.Equal(t, api.PodRunning, reply.Phase)
+	initialized = findCondition(reply.Conditions, api.PodInitialized)
+	assert.Equal(t, api.ConditionTrue, initialized.Status)
+	unitsReady = findCondition(reply.Conditions, api.ContainersReady)
+	assert.Equal(t, api.ConditionFalse, unitsReady.Status)
+	assert.Contains(t, unitsReady.Message, "[u2]")
+	assert.Equal(t, firstTransition, unitsReady.LastTransitionTime)
+
+	reply = api.PodStatusReply{
+		InitUnitStatuses: []api.UnitStatus{terminatedStatus("i1", 0)},
+		UnitStatuses:     []api.UnitStatus{runningStatus("u1", true), runningStatus("u2", true)},
+	}
+	pc.FillPodStatus(&reply)
+	for _, cond := range reply.Conditions {
+		assert.Equal(t, api.ConditionTrue, cond.Status, cond.Type)
+	}
+	ready := findCondition(reply.Conditions, api.PodReady)
+	assert.True(t, ready.LastTransitionTime.After(firstTransition.Time))
+
+	// An init unit gave up.
+	pc.setInitFailure("init unit i1 failed")
+	pc.FillPodStatus(&reply)
+	assert.Equal(t, api.PodFailed, reply.Phase)
+	initialized = findCondition(reply.Conditions, api.PodInitialized)
+	assert.Equal(t, api.ConditionFalse, initialized.Status)
+	assert.Equal(t, InitUnitFailedReason, initialized.Reason)
+}
@@ -46,6 +46,7 @@ import (
 	"github.com/elotl/wsstream"
 	"github.com/golang/glog"
 	"github.com/gorilla/websocket"
+	"github.com/kr/pty"
 )
 
 const (
@@ -97,8 +98,7 @@ func New(rootdir string, runtime string) *Server {
 	}
 	pc, err := NewPodController(rootdir, runtime)
 	glog.Error(err)
-	pc.Start()
-	return &Server{
+	s := &Server{
 		env:            EnvStore{},
 		startTime:      time.Now().UTC(),
 		installRootdir: rootdir,
@@ -109,6 +109,56 @@ func New(rootdir string, runtime string) *Server {
 		},
 		lastMetricTime: time.Now().Add(-minMetricPeriod),
 	}
+	// The network has to be in place before units of a restored pod are
+	// started.
+	err = s.restoreNetworkState()
+	if err != nil {
+		glog.Errorf("restoring network state: %v", err)
+	}
+	pc.Start()
+	return s
+}
+
+func (s *Server) stateDir() string {
+	return filepath.Join(s.installRootdir, stateDirName)
+}
+
+// saveNetworkState saves the network of the pod. The network namespace is
+// only set for pods that don't use host networking.
+func (s *Server) saveNetworkState() {
+	state := networkState{
+		PrimaryIP:           s.primaryIP,
+		SecondaryIP:         s.secondaryIP,
+		PodIP:               s.podIP,
+		PodNetworkInterface: s.podNetworkInterface,
+		PodNS:               s.podController.netNS,
+	}
+	err := saveState(s.stateDir(), networkStateFile, &state)
+	if err != nil {
+		glog.Errorf("saving network state: %v", err)
+	}
+}
+
+// restoreNetworkState picks up the network of the pod set up by a previous
+// instance of the agent, so it's not set up again.
+func (s *Server) restoreNetworkState() error {
+	var state networkState
+	found, err := loadState(s.stateDir(), networkStateFile, &state)
+	if err != nil || !found {
+		return err
+	}
+	s.primaryIP = state.PrimaryIP
+	s.secondaryIP = state.SecondaryIP
+	s.podIP = state.PodIP
+	s.podNetworkInterface = state.PodNetworkInterface
+	if state.PodNS != "" {
+		s.podController.SetPodNetwork(state.PodNS, s.podIP)
+	} else {
+		s.podController.SetPodIP(s.podIP)
+	}
+	glog.Infof("restored IP addresses: %q %q pod network namespace: %q",
+		s.primaryIP, s.podIP, state.PodNS)
+	return nil
 }
 
 func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
@@ -145,6 +195,7 @@ func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
 			ResourceUsage:    resourceUsage,
 			PodIP:            s.podIP,
 		}
+		s.podController.FillPodStatus(&reply)
 		buf, err := json.Marshal(&reply)
 		if err != nil {
 			serverError(w, err)
@@ -182,6 +233,17 @@ func (s *Server) updateHandler(w http.ResponseWriter, r *http.Request) {
 				fmt.Sprintf("Error decoding pod update request: %v", err))
 			return
 		}
+		// Reject invalid updates before the network or the pod is touched.
+		if allErrs := s.podController.ValidatePodParameters(&params); len(allErrs) > 0 {
+			glog.Warningf("rejecting pod update: %v", allErrs.ToAggregate())
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			err = json.NewEncoder(w).Encode(validationErrorReply(allErrs))
+			if err != nil {
+				glog.Errorf("writing validation errors: %v", err)
+			}
+			return
+		}
 		glog.Infof("primary & secondary: %s & %s", s.primaryIP, s.secondaryIP)
 
 		if s.primaryIP == "" && s.secondaryIP == "" {
@@ -203,10 +265,12 @@ func (s *Server) updateHandler(w http.ResponseWriter, r *http.Request) {
 					netif = "eth0"
 				}
 				s.podNetworkInterface = netif
+				s.podController.SetPodIP(s.podIP)
 			} else {
 				s.podIP = s.secondaryIP
 				s.podController.SetPodNetwork(podNS, s.podIP)
 			}
+			s.saveNetworkState()
 			glog.Infof("IP addresses: %q %q pod network namespace: %q",
 				s.primaryIP, s.podIP, podNS)
 		}
@@ -330,6 +394,76 @@ func (s *Server) RunLogTailer(w http.ResponseWriter, r *http.Request, unitName s
 	}
 }
 
+// eventsHandler returns the events of the pod recorded after the cursor in
+// the since parameter. With watch=true the connection is upgraded to a
+// websocket, and new events are sent as they are recorded.
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		var since int64
+		if value := r.FormValue("since"); value != "" {
+			var err error
+			since, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || since < 0 {
+				badRequest(w, fmt.Sprintf("invalid since parameter %q", value))
+				return
+			}
+		}
+		if watch := r.FormValue("watch"); watch == "true" || watch == "1" {
+			s.runEventWatcher(w, r, since)
+			return
+		}
+		events, cursor := s.podController.ReadEvents(since)
+		buf, err := json.Marshal(api.EventsReply{
+			Events: events,
+			Cursor: cursor,
+		})
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%s", buf)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) runEventWatcher(w http.ResponseWriter, r *http.Request, since int64) {
+	ws, err := s.doUpgrade(w, r)
+	if err != nil {
+		return // Do upgrade will write errors to the client
+	}
+	defer ws.CloseAndCleanup()
+
+	ticker := time.NewTicker(logTailPeriod)
+	defer ticker.Stop()
+	cursor := since
+	for {
+		events, next := s.podController.ReadEvents(cursor)
+		if len(events) > 0 {
+			buf, err := json.Marshal(api.EventsReply{
+				Events: events,
+				Cursor: next,
+			})
+			if err != nil {
+				glog.Errorln("Error serializing events:", err)
+				return
+			}
+			if err := ws.WriteMsg(wsstream.StdoutChan, buf); err != nil {
+				glog.Errorln("Error writing events:", err)
+				return
+			}
+		}
+		cursor = next
+		select {
+		case <-ws.Closed():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func (s *Server) fileHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
@@ -486,6 +620,27 @@ func (s *Server) servePortForward(w http.ResponseWriter, r *http.Request) {
 	ws.RunDispatch()
 }
 
+// resizeUnitTerminal passes terminal resize messages from an attach session to
+// the unit.
+func resizeUnitTerminal(u *unit.Unit, termChanges io.Reader) {
+	decoder := json.NewDecoder(termChanges)
+	for {
+		var size pty.Winsize
+		err := decoder.Decode(&size)
+		if err != nil {
+			if err != io.EOF {
+				glog.Warningf("error unmarshalling pty resize: %s", err)
+			}
+			return
+		}
+		err = u.ResizeTerminal(size.Rows, size.Cols)
+		if err != nil {
+			glog.Warningf("error resizing terminal of unit %s: %v", u.Name, err)
+			return
+		}
+	}
+}
+
 func (s *Server) runAttach(ws *wsstream.WSReadWriter, params api.AttachParams) {
 	// todo encapsulate this in more highlevel podController function
 	unitName, err := s.podController.GetUnitName(params.UnitName)
@@ -505,11 +660,16 @@ func (s *Server) runAttach(ws *wsstream.WSReadWriter, params api.AttachParams) {
 		return
 	}
 
+	u, err := unit.OpenUnit(s.installRootdir, unitName)
+	if err != nil {
+		msg := fmt.Sprintf("Could not open unit %s: %v\n", unitName, err)
+		writeWSError(ws, msg)
+		return
+	}
+	dispatch := false
 	if params.Interactive {
-		u, err := unit.OpenUnit(s.installRootdir, unitName)
-		if err != nil {
-			msg := fmt.Sprintf("Could not open unit %s: %v\n", unitName, err)
-			writeWSError(ws, msg)
+		if !u.HasStdin() {
+			writeWSError(ws, "Unit %s does not have stdin enabled\n", unitName)
 			return
 		}
 		inWriter, err := u.OpenStdinWriter()
@@ -519,8 +679,26 @@ func (s *Server) runAttach(ws *wsstream.WSReadWriter, params api.AttachParams) {
 			return
 		}
 		wsStdinReader := ws.CreateReader(wsstream.StdinChan)
+		go func() {
+			io.Copy(inWriter, wsStdinReader)
+			inWriter.Close()
+			if u.IsStdinOnce() {
+				// The unit gets EOF once all data from the session has
+				// been read.
+				if err := u.CloseStdin(); err != nil {
+					glog.Warningf("closing stdin of unit %s: %v", unitName, err)
+				}
+			}
+		}()
+		dispatch = true
+	}
+	if params.TTY && u.IsTTY() {
+		termChanges := ws.CreateReader(wsTTYControlChan)
+		go resizeUnitTerminal(u, termChanges)
+		dispatch = true
+	}
+	if dispatch {
 		go ws.RunDispatch()
-		go io.Copy(inWriter, wsStdinReader)
 	}
 
 	// copy our stdout and stderr (from logbuffer) to the websocket
@@ -604,6 +782,8 @@ func (s *Server) getHandlers() {
 	s.mux.HandleFunc("/rest/v1/resizevolume", s.resizevolumeHandler)
 	s.mux.HandleFunc("/rest/v1/ping", s.pingHandler)
 	s.mux.HandleFunc("/rest/v1/version", s.versionHandler)
+	// Events of the pod, with a websocket watch mode.
+	s.mux.HandleFunc("/rest/v1/events", s.eventsHandler)
 
 	// streaming endpoints
 	s.mux.HandleFunc("/rest/v1/portforward/", s.servePortForward)
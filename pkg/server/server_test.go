@@ -240,6 +240,47 @@ func TestUpdateHandlerAddUnit(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rr.Code)
 }
 
+func TestUpdateHandlerInvalidSpec(t *testing.T) {
+	if *testAgainstPodman {
+		return
+	}
+	params := api.PodParameters{
+		Spec: api.PodSpec{
+			RestartPolicy: "Sometimes",
+			Units: []api.Unit{
+				{
+					Name:  "unit1",
+					Image: "library/alpine",
+					VolumeMounts: []api.VolumeMount{
+						{Name: "missing", MountPath: "/data"},
+					},
+				},
+				{
+					Name:  "unit1",
+					Image: "library/alpine",
+				},
+			},
+		},
+	}
+	buf, err := json.Marshal(params)
+	assert.NoError(t, err)
+	body := strings.NewReader(string(buf))
+	rr := sendRequest(t, "POST", "/rest/v1/updatepod", body)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var reply api.ValidationErrorReply
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &reply))
+	fields := []string{}
+	for _, fieldErr := range reply.Errors {
+		fields = append(fields, fieldErr.Field)
+	}
+	assert.ElementsMatch(t, []string{
+		"spec.units[0].volumeMounts[0].name",
+		"spec.units[1].name",
+		"spec.restartPolicy",
+	}, fields)
+}
+
 func TestStatusHandler(t *testing.T) {
 	if *testAgainstPodman {
 		return
@@ -762,3 +803,65 @@ func TestExec(t *testing.T) {
 //		assert.FailNow(t, "reading timed out")
 //	}
 //}
+
+func TestEventsHandler(t *testing.T) {
+	if *testAgainstPodman {
+		return
+	}
+	rr := sendRequest(t, "GET", "/rest/v1/events?since=foo", nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	recorder := s.podController.recorder
+	_, start := recorder.ReadSince(0)
+	recorder.Event("unit1", api.EventTypeNormal, "Pulling", "Pulling image")
+	recorder.Event("unit1", api.EventTypeWarning, "Failed", "Failed to pull image")
+	rr = sendRequest(t, "GET", fmt.Sprintf("/rest/v1/events?since=%d", start), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var reply api.EventsReply
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &reply))
+	assert.Len(t, reply.Events, 2)
+	assert.Equal(t, "Pulling", reply.Events[0].Reason)
+	assert.Equal(t, "unit1", reply.Events[1].Unit)
+
+	rr = sendRequest(t, "GET", fmt.Sprintf("/rest/v1/events?since=%d", reply.Cursor), nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	reply = api.EventsReply{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &reply))
+	assert.Empty(t, reply.Events)
+}
+
+func TestWatchEvents(t *testing.T) {
+	if *testAgainstPodman {
+		return
+	}
+	ss, closer, port := runServer()
+	defer closer()
+	defer ss.httpServer.Close()
+	ss.podController.recorder.Event("", api.EventTypeNormal, "Old", "old")
+	_, cursor := ss.podController.recorder.ReadSince(0)
+
+	u := url.URL{
+		Scheme:   "ws",
+		Host:     fmt.Sprintf(":%d", port),
+		Path:     "/rest/v1/events",
+		RawQuery: fmt.Sprintf("watch=true&since=%d", cursor),
+	}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{})
+	assert.NoError(t, err)
+	ws := wsstream.NewWSStream(c)
+	defer ws.CloseAndCleanup()
+
+	ss.podController.recorder.Event("unit1", api.EventTypeWarning, "BackOff", "Back-off")
+	select {
+	case f := <-ws.ReadMsg():
+		c, m, err := wsstream.UnpackMessage(f)
+		assert.NoError(t, err)
+		assert.Equal(t, wsstream.StdoutChan, c)
+		var reply api.EventsReply
+		assert.NoError(t, json.Unmarshal(m, &reply))
+		assert.Len(t, reply.Events, 1)
+		assert.Equal(t, "BackOff", reply.Events[0].Reason)
+	case <-time.After(3 * time.Second):
+		assert.FailNow(t, "reading timed out")
+	}
+}
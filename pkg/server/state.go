@@ -0,0 +1,106 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/elotl/itzo/pkg/api"
+)
+
+// State of the agent is saved in this directory under the rootdir, so a new
+// instance of the agent can take over the pod after a restart. Unit names
+// can't start with a dot, so it never clashes with a unit.
+const (
+	stateDirName     = ".state"
+	podStateFile     = "pod.json"
+	networkStateFile = "network.json"
+)
+
+// podState is the last pod update applied by the pod controller. Secrets and
+// registry credentials are never saved.
+type podState struct {
+	Params       api.PodParameters `json:"params"`
+	RestartCount int32             `json:"restartCount"`
+	StartTime    api.Time          `json:"startTime"`
+}
+
+// networkState is the network configuration of the pod set up by the server.
+type networkState struct {
+	PrimaryIP           string `json:"primaryIP"`
+	SecondaryIP         string `json:"secondaryIP"`
+	PodIP               string `json:"podIP"`
+	PodNetworkInterface string `json:"podNetworkInterface"`
+	PodNS               string `json:"podNS,omitempty"`
+}
+
+// stripPodParameters returns a deep copy of params without secrets and
+// registry credentials.
+func stripPodParameters(params *api.PodParameters) (*api.PodParameters, error) {
+	stripped := *params
+	stripped.Secrets = nil
+	stripped.Credentials = nil
+	buf, err := json.Marshal(&stripped)
+	if err != nil {
+		return nil, err
+	}
+	var result api.PodParameters
+	err = json.Unmarshal(buf, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// saveState writes v as JSON into name in dir. The file is replaced
+// atomically, so a crash never leaves a partially written file behind.
+func saveState(dir, name string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadState reads name in dir into v. Returns false if it has not been saved.
+func loadState(dir, name string, v interface{}) (bool, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	err = json.Unmarshal(buf, v)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/elotl/itzo/pkg/api"
+	runtime2 "github.com/elotl/itzo/pkg/runtime"
+	"github.com/elotl/itzo/pkg/util/conmap"
+	"github.com/stretchr/testify/assert"
+)
+
+func secretEnv() []api.EnvVar {
+	return []api.EnvVar{
+		{
+			Name: "password",
+			ValueFrom: &api.EnvVarSource{
+				SecretKeyRef: &api.SecretKeySelector{
+					Name: "mysecret",
+					Key:  "password",
+				},
+			},
+		},
+	}
+}
+
+func makeTestPodParameters(env []api.EnvVar) *api.PodParameters {
+	return &api.PodParameters{
+		Secrets: map[string]map[string][]byte{
+			"mysecret": {"password": []byte("hunter2")},
+		},
+		Credentials: map[string]api.RegistryCredentials{
+			"registry": {Server: "registry", Username: "user", Password: "s3cr3t"},
+		},
+		PodName:     "default_mypod",
+		PodHostname: "mypod",
+		Spec: api.PodSpec{
+			RestartPolicy: api.RestartPolicyAlways,
+			Units: []api.Unit{
+				{Name: "unit1", Image: "img1"},
+				{Name: "unit2", Image: "img2", Env: env},
+			},
+		},
+	}
+}
+
+func TestStripPodParameters(t *testing.T) {
+	params := makeTestPodParameters(secretEnv())
+	stripped, err := stripPodParameters(params)
+	assert.NoError(t, err)
+	assert.Nil(t, stripped.Secrets)
+	assert.Nil(t, stripped.Credentials)
+	assert.Equal(t, params.PodName, stripped.PodName)
+	assert.NotNil(t, params.Secrets)
+	// The copy is not affected by resolving the environment of units.
+	newEnvResolver(params, "", "").resolveUnits(&params.Spec)
+	assert.Equal(t, "hunter2", params.Spec.Units[1].Env[0].Value)
+	assert.Equal(t, secretEnv(), stripped.Spec.Units[1].Env)
+}
+
+func TestSaveLoadState(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "itzo-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	dir := filepath.Join(tmpdir, stateDirName)
+	var state networkState
+	found, err := loadState(dir, networkStateFile, &state)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	saved := networkState{PrimaryIP: "10.0.0.1", PodIP: "10.0.0.2", PodNS: "ns"}
+	assert.NoError(t, saveState(dir, networkStateFile, &saved))
+	found, err = loadState(dir, networkStateFile, &state)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, saved, state)
+}
+
+type startRecorder struct {
+	sync.Mutex
+	started map[string][]string
+}
+
+func (r *startRecorder) start(pod, hostname, name, workingdir, netns string, command, args, env []string, rp api.RestartPolicy) error {
+	r.Lock()
+	defer r.Unlock()
+	r.started[name] = env
+	return nil
+}
+
+func (r *startRecorder) get() map[string][]string {
+	r.Lock()
+	defer r.Unlock()
+	return r.started
+}
+
+func newTestPodController(rootdir string, recorder *startRecorder, adopted map[string]bool) *PodController {
+	unitMgr := NewUnitMock()
+	unitMgr.Start = recorder.start
+	unitMgr.Adopt = func(pod, name string) (bool, error) {
+		return adopted[name], nil
+	}
+	return &PodController{
+		rootdir:                  rootdir,
+		runtime:                  runtime2.NewItzoRuntime(rootdir, unitMgr, NewMountMock(), NewImagePullMock()),
+		syncErrors:               make(map[string]api.UnitStatus),
+		podStatus:                &api.PodSpec{},
+		currentlyRestartingUnits: conmap.NewKeyTypeValueType(),
+		stateDir:                 filepath.Join(rootdir, stateDirName),
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	testCases := []struct {
+		name    string
+		env     []api.EnvVar
+		adopted map[string]bool
+		// Units started right after the restart.
+		started []string
+	}{
+		{
+			name:    "all units adopted",
+			adopted: map[string]bool{"unit1": true, "unit2": true},
+			started: []string{},
+		},
+		{
+			name:    "unit not started yet",
+			adopted: map[string]bool{"unit1": true},
+			started: []string{"unit2"},
+		},
+		{
+			name:    "unit waiting for secrets",
+			env:     secretEnv(),
+			adopted: map[string]bool{"unit1": true},
+			started: []string{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "itzo-test")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tmpdir)
+			recorder := &startRecorder{started: make(map[string][]string)}
+			pc := newTestPodController(tmpdir, recorder, nil)
+			pc.doUpdate(makeTestPodParameters(tc.env))
+			pc.waitGroup.Wait()
+			assert.Len(t, recorder.get(), 2)
+			buf, err := ioutil.ReadFile(
+				filepath.Join(tmpdir, stateDirName, podStateFile))
+			assert.NoError(t, err)
+			assert.NotContains(t, string(buf), "hunter2")
+			assert.NotContains(t, string(buf), "s3cr3t")
+
+			// The agent has been restarted.
+			recorder = &startRecorder{started: make(map[string][]string)}
+			pc = newTestPodController(tmpdir, recorder, tc.adopted)
+			assert.NoError(t, pc.restoreState())
+			pc.waitGroup.Wait()
+			assert.Equal(t, "default_mypod", pc.podName)
+			assert.Equal(t, "mypod", pc.podHostname)
+			assert.Len(t, pc.podStatus.Units, 2)
+			var started []string
+			for name := range recorder.get() {
+				started = append(started, name)
+			}
+			assert.ElementsMatch(t, tc.started, started)
+			if tc.env == nil {
+				return
+			}
+			// The next update brings the secrets.
+			pc.doUpdate(makeTestPodParameters(tc.env))
+			pc.waitGroup.Wait()
+			assert.Equal(t, []string{"password=hunter2"}, recorder.get()["unit2"])
+			assert.NotContains(t, recorder.get(), "unit1")
+		})
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/elotl/itzo/pkg/caps"
+	"github.com/elotl/itzo/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/kubernetes/pkg/util/parsers"
+)
+
+// ValidatePodParameters checks a pod update for errors that would otherwise
+// only show up once the update loop gets to it, e.g. a unit that can't be
+// created or a unit overwriting another one with the same name.
+func (pc *PodController) ValidatePodParameters(params *api.PodParameters) field.ErrorList {
+	// Images of anka VMs are URLs of the registry followed by the VM ID, not
+	// image references.
+	checkImages := pc.runtimeName != runtime.AnkaRuntimeName
+	return validatePodSpec(&params.Spec, field.NewPath("spec"), checkImages)
+}
+
+func validatePodSpec(spec *api.PodSpec, path *field.Path, checkImages bool) field.ErrorList {
+	allErrs, volumes := validateVolumes(spec.Volumes, path.Child("volumes"))
+	unitNames := sets.NewString()
+	for i := range spec.InitUnits {
+		allErrs = append(allErrs, validateUnit(&spec.InitUnits[i],
+			path.Child("initUnits").Index(i), unitNames, volumes, checkImages)...)
+	}
+	for i := range spec.Units {
+		allErrs = append(allErrs, validateUnit(&spec.Units[i],
+			path.Child("units").Index(i), unitNames, volumes, checkImages)...)
+	}
+	switch spec.RestartPolicy {
+	case "", api.RestartPolicyAlways, api.RestartPolicyOnFailure, api.RestartPolicyNever:
+	default:
+		allErrs = append(allErrs, field.NotSupported(
+			path.Child("restartPolicy"), spec.RestartPolicy, []string{
+				string(api.RestartPolicyAlways),
+				string(api.RestartPolicyOnFailure),
+				string(api.RestartPolicyNever),
+			}))
+	}
+	if spec.ActiveDeadlineSeconds != nil && *spec.ActiveDeadlineSeconds <= 0 {
+		allErrs = append(allErrs, field.Invalid(
+			path.Child("activeDeadlineSeconds"), *spec.ActiveDeadlineSeconds,
+			"must be greater than 0"))
+	}
+	allErrs = append(allErrs, validateGracePeriod(
+		spec.TerminationGracePeriodSeconds,
+		path.Child("terminationGracePeriodSeconds"))...)
+	return allErrs
+}
+
+func validateVolumes(volumes []api.Volume, path *field.Path) (field.ErrorList, sets.String) {
+	allErrs := field.ErrorList{}
+	names := sets.NewString()
+	for i, volume := range volumes {
+		namePath := path.Index(i).Child("name")
+		switch {
+		case volume.Name == "":
+			allErrs = append(allErrs, field.Required(namePath, ""))
+		case names.Has(volume.Name):
+			allErrs = append(allErrs, field.Duplicate(namePath, volume.Name))
+		}
+		names.Insert(volume.Name)
+	}
+	return allErrs, names
+}
+
+// validateUnit checks a unit, and adds its name to unitNames: names have to
+// be unique across init and regular units, since both live in the same unit
+// directory.
+func validateUnit(unit *api.Unit, path *field.Path, unitNames, volumes sets.String, checkImages bool) field.ErrorList {
+	allErrs := field.ErrorList{}
+	namePath := path.Child("name")
+	switch {
+	case unit.Name == "":
+		allErrs = append(allErrs, field.Required(namePath, ""))
+	case unitNames.Has(unit.Name):
+		allErrs = append(allErrs, field.Duplicate(namePath, unit.Name))
+	default:
+		for _, msg := range validation.IsDNS1123Label(unit.Name) {
+			allErrs = append(allErrs, field.Invalid(namePath, unit.Name, msg))
+		}
+	}
+	unitNames.Insert(unit.Name)
+	imagePath := path.Child("image")
+	if unit.Image == "" {
+		allErrs = append(allErrs, field.Required(imagePath, ""))
+	} else if checkImages {
+		if _, _, _, err := parsers.ParseImageName(unit.Image); err != nil {
+			allErrs = append(allErrs, field.Invalid(
+				imagePath, unit.Image, err.Error()))
+		}
+	}
+	for i, env := range unit.Env {
+		// Only the name, values might be secrets.
+		namePath := path.Child("env").Index(i).Child("name")
+		if env.Name == "" {
+			allErrs = append(allErrs, field.Required(namePath, ""))
+			continue
+		}
+		for _, msg := range validation.IsEnvVarName(env.Name) {
+			allErrs = append(allErrs, field.Invalid(namePath, env.Name, msg))
+		}
+	}
+	mountPaths := sets.NewString()
+	for i, mount := range unit.VolumeMounts {
+		mountPath := path.Child("volumeMounts").Index(i)
+		if mount.Name == "" {
+			allErrs = append(allErrs, field.Required(mountPath.Child("name"), ""))
+		} else if !volumes.Has(mount.Name) {
+			allErrs = append(allErrs, field.NotFound(
+				mountPath.Child("name"), mount.Name))
+		}
+		switch {
+		case mount.MountPath == "":
+			allErrs = append(allErrs, field.Required(
+				mountPath.Child("mountPath"), ""))
+		case mountPaths.Has(mount.MountPath):
+			allErrs = append(allErrs, field.Invalid(
+				mountPath.Child("mountPath"), mount.MountPath,
+				"must be unique"))
+		}
+		mountPaths.Insert(mount.MountPath)
+	}
+	if sc := unit.SecurityContext; sc != nil && sc.Capabilities != nil {
+		capsPath := path.Child("securityContext", "capabilities")
+		allErrs = append(allErrs, validateCapabilities(
+			sc.Capabilities.Add, capsPath.Child("add"))...)
+		allErrs = append(allErrs, validateCapabilities(
+			sc.Capabilities.Drop, capsPath.Child("drop"))...)
+	}
+	if sc := unit.SecurityContext; sc != nil && sc.ProcMount != nil {
+		switch *sc.ProcMount {
+		case api.ProcMountTypeDefault, api.ProcMountTypeUnmasked:
+		default:
+			allErrs = append(allErrs, field.NotSupported(
+				path.Child("securityContext", "procMount"), *sc.ProcMount,
+				[]string{
+					string(api.ProcMountTypeDefault),
+					string(api.ProcMountTypeUnmasked),
+				}))
+		}
+	}
+	switch unit.TerminationMessagePolicy {
+	case "", api.TerminationMessageReadFile, api.TerminationMessageFallbackToLogsOnError:
+	default:
+		allErrs = append(allErrs, field.NotSupported(
+			path.Child("terminationMessagePolicy"),
+			unit.TerminationMessagePolicy, []string{
+				string(api.TerminationMessageReadFile),
+				string(api.TerminationMessageFallbackToLogsOnError),
+			}))
+	}
+	allErrs = append(allErrs, validateGracePeriod(
+		unit.TerminationGracePeriodSeconds,
+		path.Child("terminationGracePeriodSeconds"))...)
+	return allErrs
+}
+
+// validateCapabilities accepts the same capabilities the unit is started
+// with: with or without the CAP_ prefix in any case, or ALL.
+func validateCapabilities(capabilities []string, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, c := range capabilities {
+		if _, err := caps.NormalizeLegacyCapabilities([]string{c}); err != nil {
+			allErrs = append(allErrs, field.Invalid(
+				path.Index(i), c, "unknown capability"))
+		}
+	}
+	return allErrs
+}
+
+func validateGracePeriod(seconds *int64, path *field.Path) field.ErrorList {
+	if seconds != nil && *seconds < 0 {
+		return field.ErrorList{field.Invalid(path, *seconds,
+			"must be greater than or equal to 0")}
+	}
+	return nil
+}
+
+func validationErrorReply(allErrs field.ErrorList) api.ValidationErrorReply {
+	reply := api.ValidationErrorReply{
+		Message: "invalid pod update",
+		Errors:  make([]api.FieldError, 0, len(allErrs)),
+	}
+	for _, err := range allErrs {
+		reply.Errors = append(reply.Errors, api.FieldError{
+			Field:  err.Field,
+			Type:   string(err.Type),
+			Detail: err.ErrorBody(),
+		})
+	}
+	return reply
+}
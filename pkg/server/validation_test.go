@@ -0,0 +1,206 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func validTestPodSpec() api.PodSpec {
+	return api.PodSpec{
+		RestartPolicy: api.RestartPolicyAlways,
+		Volumes: []api.Volume{
+			{
+				Name: "data",
+				VolumeSource: api.VolumeSource{
+					EmptyDir: &api.EmptyDir{},
+				},
+			},
+		},
+		InitUnits: []api.Unit{
+			{
+				Name:  "init",
+				Image: "library/alpine",
+			},
+		},
+		Units: []api.Unit{
+			{
+				Name:  "main",
+				Image: "docker.io/library/nginx:1.19",
+				Env: []api.EnvVar{
+					{Name: "FOO", Value: "bar"},
+				},
+				VolumeMounts: []api.VolumeMount{
+					{Name: "data", MountPath: "/data"},
+				},
+				SecurityContext: &api.SecurityContext{
+					Capabilities: &api.Capabilities{
+						Add:  []string{"NET_ADMIN", "CAP_SYS_TIME"},
+						Drop: []string{"ALL"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestValidatePodSpec(t *testing.T) {
+	int64Ptr := func(i int64) *int64 { return &i }
+	testCases := []struct {
+		name   string
+		modify func(spec *api.PodSpec)
+		errors map[string]field.ErrorType
+	}{
+		{
+			name:   "valid",
+			modify: func(spec *api.PodSpec) {},
+		},
+		{
+			name: "duplicate unit name",
+			modify: func(spec *api.PodSpec) {
+				spec.Units[0].Name = "init"
+			},
+			errors: map[string]field.ErrorType{
+				"spec.units[0].name": field.ErrorTypeDuplicate,
+			},
+		},
+		{
+			name: "invalid unit names",
+			modify: func(spec *api.PodSpec) {
+				spec.InitUnits[0].Name = ""
+				spec.Units[0].Name = "Main_Unit"
+			},
+			errors: map[string]field.ErrorType{
+				"spec.initUnits[0].name": field.ErrorTypeRequired,
+				"spec.units[0].name":     field.ErrorTypeInvalid,
+			},
+		},
+		{
+			name: "unknown volume",
+			modify: func(spec *api.PodSpec) {
+				spec.Units[0].VolumeMounts = append(spec.Units[0].VolumeMounts,
+					api.VolumeMount{Name: "missing", MountPath: "/data"})
+			},
+			errors: map[string]field.ErrorType{
+				"spec.units[0].volumeMounts[1].name":      field.ErrorTypeNotFound,
+				"spec.units[0].volumeMounts[1].mountPath": field.ErrorTypeInvalid,
+			},
+		},
+		{
+			name: "duplicate volume",
+			modify: func(spec *api.PodSpec) {
+				spec.Volumes = append(spec.Volumes, spec.Volumes[0])
+			},
+			errors: map[string]field.ErrorType{
+				"spec.volumes[1].name": field.ErrorTypeDuplicate,
+			},
+		},
+		{
+			name: "invalid capabilities",
+			modify: func(spec *api.PodSpec) {
+				spec.Units[0].SecurityContext.Capabilities.Add = []string{
+					"sys_admin", "CAP_FLY"}
+				spec.Units[0].SecurityContext.Capabilities.Drop = []string{"NONE"}
+			},
+			errors: map[string]field.ErrorType{
+				"spec.units[0].securityContext.capabilities.add[1]":  field.ErrorTypeInvalid,
+				"spec.units[0].securityContext.capabilities.drop[0]": field.ErrorTypeInvalid,
+			},
+		},
+		{
+			name: "invalid proc mount",
+			modify: func(spec *api.PodSpec) {
+				procMount := api.ProcMountType("Masked")
+				spec.Units[0].SecurityContext.ProcMount = &procMount
+			},
+			errors: map[string]field.ErrorType{
+				"spec.units[0].securityContext.procMount": field.ErrorTypeNotSupported,
+			},
+		},
+		{
+			name: "invalid restart policy",
+			modify: func(spec *api.PodSpec) {
+				spec.RestartPolicy = "Sometimes"
+			},
+			errors: map[string]field.ErrorType{
+				"spec.restartPolicy": field.ErrorTypeNotSupported,
+			},
+		},
+		{
+			name: "invalid images",
+			modify: func(spec *api.PodSpec) {
+				spec.InitUnits[0].Image = ""
+				spec.Units[0].Image = "library/Alpine:"
+			},
+			errors: map[string]field.ErrorType{
+				"spec.initUnits[0].image": field.ErrorTypeRequired,
+				"spec.units[0].image":     field.ErrorTypeInvalid,
+			},
+		},
+		{
+			name: "invalid env var name",
+			modify: func(spec *api.PodSpec) {
+				spec.Units[0].Env[0].Name = "1=FOO"
+			},
+			errors: map[string]field.ErrorType{
+				"spec.units[0].env[0].name": field.ErrorTypeInvalid,
+			},
+		},
+		{
+			name: "invalid durations",
+			modify: func(spec *api.PodSpec) {
+				spec.ActiveDeadlineSeconds = int64Ptr(0)
+				spec.TerminationGracePeriodSeconds = int64Ptr(-1)
+				spec.Units[0].TerminationGracePeriodSeconds = int64Ptr(-1)
+			},
+			errors: map[string]field.ErrorType{
+				"spec.activeDeadlineSeconds":                  field.ErrorTypeInvalid,
+				"spec.terminationGracePeriodSeconds":          field.ErrorTypeInvalid,
+				"spec.units[0].terminationGracePeriodSeconds": field.ErrorTypeInvalid,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := validTestPodSpec()
+			tc.modify(&spec)
+			allErrs := validatePodSpec(&spec, field.NewPath("spec"), true)
+			errors := make(map[string]field.ErrorType)
+			for _, err := range allErrs {
+				errors[err.Field] = err.Type
+			}
+			if tc.errors == nil {
+				assert.Empty(t, errors)
+			} else {
+				assert.Equal(t, tc.errors, errors)
+			}
+		})
+	}
+}
+
+func TestValidatePodSpecAnkaImage(t *testing.T) {
+	spec := validTestPodSpec()
+	spec.Units[0].Image = "http://registry.example.com:8089/c0847bc9-5d2d-4dbc-ba6a-240f7ff08032"
+	allErrs := validatePodSpec(&spec, field.NewPath("spec"), true)
+	assert.Len(t, allErrs, 1)
+	allErrs = validatePodSpec(&spec, field.NewPath("spec"), false)
+	assert.Empty(t, allErrs)
+}
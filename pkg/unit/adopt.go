@@ -0,0 +1,128 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const helperPidFile = "helper.pid"
+
+var (
+	// How often processes we are not the parent of are checked, to see if
+	// they have exited.
+	adoptPollInterval = 500 * time.Millisecond
+)
+
+// processRef identifies a process that might outlive the agent. The start
+// time protects against the PID being reused by another process.
+type processRef struct {
+	Pid       int    `json:"pid"`
+	StartTime uint64 `json:"startTime"`
+}
+
+// processStartTime returns the start time of a process, in clock ticks since
+// boot. Zombies are considered to be gone.
+func processStartTime(pid int) (uint64, error) {
+	buf, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name might contain spaces or parentheses, so fields are
+	// counted from the last closing parenthesis.
+	stat := string(buf)
+	i := strings.LastIndexByte(stat, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("invalid stat of process %d: %q", pid, stat)
+	}
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("invalid stat of process %d: %q", pid, stat)
+	}
+	if fields[0] == "Z" {
+		return 0, fmt.Errorf("process %d is a zombie", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+func newProcessRef(pid int) (*processRef, error) {
+	startTime, err := processStartTime(pid)
+	if err != nil {
+		return nil, err
+	}
+	return &processRef{Pid: pid, StartTime: startTime}, nil
+}
+
+// alive returns whether the process is still running.
+func (r *processRef) alive() bool {
+	startTime, err := processStartTime(r.Pid)
+	return err == nil && startTime == r.StartTime
+}
+
+// wait returns once the process has exited. The process is not reaped.
+func (r *processRef) wait() {
+	for r.alive() {
+		time.Sleep(adoptPollInterval)
+	}
+}
+
+func saveProcessRef(path string, pid int) error {
+	ref, err := newProcessRef(pid)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadProcessRef returns nil if there is no saved process.
+func loadProcessRef(path string) (*processRef, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ref processRef
+	err = json.Unmarshal(buf, &ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid process reference in %s: %v", path, err)
+	}
+	return &ref, nil
+}
+
+func (u *Unit) helperPidPath() string {
+	return filepath.Join(u.Directory, helperPidFile)
+}
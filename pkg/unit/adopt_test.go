@@ -0,0 +1,133 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func waitForCondition(t *testing.T, cond func() bool) bool {
+	start := time.Now()
+	for !cond() {
+		if time.Since(start) > 5*time.Second {
+			return assert.Fail(t, "timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func TestProcessRef(t *testing.T) {
+	ref, err := newProcessRef(os.Getpid())
+	assert.NoError(t, err)
+	assert.True(t, ref.alive())
+	// Same PID, different process.
+	other := processRef{Pid: ref.Pid, StartTime: ref.StartTime + 1}
+	assert.False(t, other.alive())
+	path := filepath.Join(os.TempDir(), "itzo-test-processref")
+	defer os.Remove(path)
+	err = saveProcessRef(path, os.Getpid())
+	assert.NoError(t, err)
+	loaded, err := loadProcessRef(path)
+	assert.NoError(t, err)
+	assert.Equal(t, ref, loaded)
+	loaded, err = loadProcessRef(path + ".missing")
+	assert.NoError(t, err)
+	assert.Nil(t, loaded)
+}
+
+func TestProcessRefZombie(t *testing.T) {
+	cmd := exec.Command("true")
+	assert.NoError(t, cmd.Start())
+	defer cmd.Wait()
+	ref := processRef{Pid: cmd.Process.Pid}
+	// Not reaped yet.
+	waitForCondition(t, func() bool {
+		_, err := processStartTime(ref.Pid)
+		return err != nil
+	})
+	assert.False(t, ref.alive())
+}
+
+func TestAdoptUnit(t *testing.T) {
+	savedSleep := LOG_PIPE_FINISH_READ_SLEEP
+	defer func() { LOG_PIPE_FINISH_READ_SLEEP = savedSleep }()
+	LOG_PIPE_FINISH_READ_SLEEP = 0
+	u, closer := mkTestUnit(t)
+	defer closer()
+	um := NewUnitManager(filepath.Dir(u.Directory))
+	// Never started.
+	started, err := um.AdoptUnit("mypod", u.Name)
+	assert.NoError(t, err)
+	assert.False(t, started)
+	assert.False(t, um.UnitRunning(u.Name))
+	// A helper left running by the previous agent.
+	cmd := exec.Command("sleep", "1000")
+	assert.NoError(t, cmd.Start())
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	assert.NoError(t, saveProcessRef(u.helperPidPath(), cmd.Process.Pid))
+	started, err = um.AdoptUnit("mypod", u.Name)
+	assert.NoError(t, err)
+	assert.True(t, started)
+	assert.True(t, um.UnitRunning(u.Name))
+	pid, ok := um.GetPid(u.Name)
+	assert.True(t, ok)
+	assert.Equal(t, cmd.Process.Pid, pid)
+	_, err = um.GetLogBuffer(u.Name)
+	assert.NoError(t, err)
+	assert.NoError(t, cmd.Process.Kill())
+	waitForCondition(t, func() bool {
+		return !um.UnitRunning(u.Name)
+	})
+	// The helper has exited while the agent was gone.
+	um = NewUnitManager(filepath.Dir(u.Directory))
+	started, err = um.AdoptUnit("mypod", u.Name)
+	assert.NoError(t, err)
+	assert.True(t, started)
+	assert.False(t, um.UnitRunning(u.Name))
+}
+
+func TestAdoptPodNamespaces(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "itzo-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	p := &podNamespaces{pidFile: filepath.Join(tmpdir, ".pause.pid")}
+	assert.NoError(t, p.adopt())
+	assert.False(t, p.running())
+	cmd := exec.Command("sleep", "1000")
+	assert.NoError(t, cmd.Start())
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	assert.NoError(t, saveProcessRef(p.pidFile, cmd.Process.Pid))
+	assert.NoError(t, p.adopt())
+	assert.True(t, p.running())
+	assert.Equal(t, cmd.Process.Pid, p.pause.Pid)
+	assert.NoError(t, p.stop())
+	assert.False(t, p.running())
+	_, err = os.Stat(p.pidFile)
+	assert.True(t, os.IsNotExist(err))
+}
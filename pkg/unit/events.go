@@ -0,0 +1,147 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// Events of a unit are appended to this file in the unit directory as JSON
+// lines, by the helper of the unit and by the unit manager. The agent picks
+// them up and truncates the file. Nobody reads the file if the agent is
+// never asked for events, so it's capped in size.
+const (
+	eventsFileName    = "events"
+	maxEventsFileSize = 1024 * 1024
+)
+
+func (u *Unit) eventsPath() string {
+	return filepath.Join(u.Directory, eventsFileName)
+}
+
+// openEventsFile keeps the events file open in the helper, so events can
+// still be recorded once the helper is in the rootfs of the unit. The file is
+// closed on exec, processes of the unit don't get it.
+func (u *Unit) openEventsFile() error {
+	f, err := os.OpenFile(
+		u.eventsPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	u.eventsFile = f
+	return nil
+}
+
+// RecordEvent saves an event about the unit for the agent to pick up.
+func (u *Unit) RecordEvent(eventType api.EventType, reason, message string) {
+	err := u.recordEvent(eventType, reason, message)
+	if err != nil {
+		glog.Warningf("recording %s event of %s: %v", reason, u.Name, err)
+	}
+}
+
+func (u *Unit) recordEvent(eventType api.EventType, reason, message string) error {
+	now := api.Now()
+	buf, err := json.Marshal(api.Event{
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Unit:           u.Name,
+		Count:          1,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+	})
+	if err != nil {
+		return err
+	}
+	f := u.eventsFile
+	if f == nil {
+		f, err = os.OpenFile(
+			u.eventsPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	if err := lockStatusFile(f, unix.LOCK_EX); err != nil {
+		return err
+	}
+	defer unlockStatusFile(f)
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() >= maxEventsFileSize {
+		return fmt.Errorf("events file is full")
+	}
+	_, err = f.Write(append(buf, '\n'))
+	return err
+}
+
+// ReadEvents returns the events recorded for the unit since the last call,
+// and removes them from the events file.
+func (u *Unit) ReadEvents() ([]api.Event, error) {
+	f, err := os.OpenFile(u.eventsPath(), os.O_RDWR, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := lockStatusFile(f, unix.LOCK_EX); err != nil {
+		return nil, err
+	}
+	defer unlockStatusFile(f)
+	var events []api.Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event api.Event
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			glog.Warningf("invalid event of %s: %v", u.Name, err)
+			continue
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return events, err
+	}
+	return events, f.Truncate(0)
+}
+
+// ReadUnitEvents returns the events recorded for a unit since the last call.
+func (um *UnitManager) ReadUnitEvents(unitName string) ([]api.Event, error) {
+	if !IsUnitExist(um.rootDir, unitName) {
+		return nil, nil
+	}
+	unit, err := OpenUnit(um.rootDir, unitName)
+	if err != nil {
+		return nil, err
+	}
+	return unit.ReadEvents()
+}
@@ -0,0 +1,64 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitEvents(t *testing.T) {
+	u, closer := mkTestUnit(t)
+	defer closer()
+	um := NewUnitManager(filepath.Dir(u.Directory))
+	events, err := um.ReadUnitEvents(u.Name)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	u.RecordEvent(api.EventTypeNormal, "Started", "Started unit foobar")
+	// The helper keeps the file open.
+	assert.NoError(t, u.openEventsFile())
+	defer u.eventsFile.Close()
+	u.RecordEvent(api.EventTypeWarning, "BackOff", "Back-off restarting failed unit")
+	events, err = um.ReadUnitEvents(u.Name)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, "Started", events[0].Reason)
+	assert.Equal(t, api.EventTypeWarning, events[1].Type)
+	assert.Equal(t, "foobar", events[1].Unit)
+	assert.Equal(t, int32(1), events[1].Count)
+	assert.False(t, events[1].FirstTimestamp.IsZero())
+
+	// Events are only returned once, and the file can be appended to after
+	// it has been read.
+	events, err = um.ReadUnitEvents(u.Name)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	u.RecordEvent(api.EventTypeWarning, "BackOff", "Back-off restarting failed unit")
+	events, err = u.ReadEvents()
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+
+	events, err = um.ReadUnitEvents("missing")
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+}
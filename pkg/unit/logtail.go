@@ -0,0 +1,129 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// logTail keeps the most recent output of a unit process, so the helper can
+// use it as the termination message of the unit. The log buffer itself lives
+// in the agent, out of reach of the helper.
+//
+// Output is captured via pipes: the process writes into them, and everything
+// read from the other end is copied both to the original destination and to
+// the tail.
+type logTail struct {
+	sync.Mutex
+	buf      []byte
+	maxBytes int
+	maxLines int
+	writers  []*os.File
+	wg       sync.WaitGroup
+}
+
+func newLogTail(maxBytes, maxLines int) *logTail {
+	return &logTail{
+		maxBytes: maxBytes,
+		maxLines: maxLines,
+	}
+}
+
+func (t *logTail) Write(p []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.maxBytes {
+		t.buf = append([]byte{}, t.buf[len(t.buf)-t.maxBytes:]...)
+	}
+	return len(p), nil
+}
+
+// tee returns a pipe for the process to write into. Everything written to it
+// ends up in w too, unless w is nil.
+func (t *logTail) tee(w io.Writer) (*os.File, error) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	t.writers = append(t.writers, pw)
+	t.copy(r, w)
+	return pw, nil
+}
+
+// copy copies everything from r to the tail, and to w too unless it's nil,
+// until r returns an error. It closes r when done.
+func (t *logTail) copy(r io.ReadCloser, w io.Writer) {
+	var dst io.Writer = t
+	if w != nil {
+		dst = io.MultiWriter(t, w)
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer r.Close()
+		io.Copy(dst, r)
+	}()
+}
+
+// closeWriters closes our side of the pipes, once the process has been
+// started with its own copies.
+func (t *logTail) closeWriters() {
+	for _, w := range t.writers {
+		w.Close()
+	}
+	t.writers = nil
+}
+
+// wait waits until all output has been copied, which happens once every
+// process holding the pipes has exited. Returns false on timeout.
+func (t *logTail) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// String returns the last maxLines lines of output.
+func (t *logTail) String() string {
+	t.Lock()
+	defer t.Unlock()
+	buf := bytes.TrimRight(t.buf, "\n")
+	lines := 0
+	for i := len(buf) - 1; i >= 0; i-- {
+		if buf[i] != '\n' {
+			continue
+		}
+		lines++
+		if lines >= t.maxLines {
+			buf = buf[i+1:]
+			break
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogTail(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    []string
+		maxBytes int
+		maxLines int
+		expected string
+	}{
+		{
+			name:     "empty",
+			input:    nil,
+			maxBytes: 100,
+			maxLines: 10,
+			expected: "",
+		},
+		{
+			name:     "fits",
+			input:    []string{"foo\n", "bar\n"},
+			maxBytes: 100,
+			maxLines: 10,
+			expected: "foo\nbar",
+		},
+		{
+			name:     "line limit",
+			input:    []string{"one\ntwo\n", "three\nfour\n"},
+			maxBytes: 100,
+			maxLines: 2,
+			expected: "three\nfour",
+		},
+		{
+			name:     "byte limit",
+			input:    []string{"0123456789", "abcdef"},
+			maxBytes: 8,
+			maxLines: 10,
+			expected: "89abcdef",
+		},
+	}
+	for _, tc := range testCases {
+		tail := newLogTail(tc.maxBytes, tc.maxLines)
+		for _, s := range tc.input {
+			fmt.Fprint(tail, s)
+		}
+		assert.Equal(t, tc.expected, tail.String(), tc.name)
+	}
+}
+
+func TestLogTailTee(t *testing.T) {
+	tail := newLogTail(100, 10)
+	var out bytes.Buffer
+	w, err := tail.tee(&out)
+	assert.NoError(t, err)
+	fmt.Fprintln(w, "hello")
+	tail.closeWriters()
+	assert.True(t, tail.wait(5*time.Second))
+	assert.Equal(t, "hello\n", out.String())
+	assert.Equal(t, "hello", tail.String())
+}
+
+func TestLogTailTeeTimeout(t *testing.T) {
+	tail := newLogTail(100, 10)
+	_, err := tail.tee(nil)
+	assert.NoError(t, err)
+	// The write end of the pipe is still open.
+	assert.False(t, tail.wait(10*time.Millisecond))
+	tail.closeWriters()
+	assert.True(t, tail.wait(5*time.Second))
+	assert.Equal(t, "", tail.String())
+}
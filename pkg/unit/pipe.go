@@ -72,7 +72,22 @@ func (l *LogPipe) OpenWriter(name string) (fp *os.File, err error) {
 	return fp, nil
 }
 
-func (l *LogPipe) readFromPipe(name string, callback func(string)) {
+// OpenSpareReader opens the read end of a pipe, without ever reading from it.
+// The helper keeps one open, so the unit doesn't get EPIPE or SIGPIPE writing
+// its output while the agent is not reading it, e.g. during a restart of the
+// agent. Output is buffered by the pipe until the agent reads it again.
+func (l *LogPipe) OpenSpareReader(name string) (*os.File, error) {
+	checkName(name)
+	pipepath := filepath.Join(l.Unitdir, name)
+	fp, err := os.OpenFile(pipepath, os.O_RDONLY|syscall.O_NONBLOCK, 0600)
+	if err != nil {
+		glog.Errorf("Error opening %s: %v", pipepath, err)
+		return nil, err
+	}
+	return fp, nil
+}
+
+func (l *LogPipe) readFromPipe(name string, raw bool, callback func(string)) {
 	pipepath := filepath.Join(l.Unitdir, name)
 	pf, err := os.OpenFile(pipepath, os.O_RDONLY, 0600)
 	if err != nil {
@@ -80,6 +95,22 @@ func (l *LogPipe) readFromPipe(name string, callback func(string)) {
 		return
 	}
 	defer pf.Close()
+	if raw {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := pf.Read(buf)
+			if n > 0 {
+				callback(string(buf[:n]))
+			}
+			if err != nil {
+				if err != io.EOF {
+					glog.Errorf("Error reading from pipe %v: %v", pipepath, err)
+				}
+				break
+			}
+		}
+		return
+	}
 	r := bufio.NewReader(pf)
 	for {
 		line, err := r.ReadString('\n')
@@ -145,7 +176,14 @@ func NewLogPipe(dir string) (*LogPipe, error) {
 
 func (l *LogPipe) StartReader(name string, cb func(string)) {
 	checkName(name)
-	go l.readFromPipe(name, cb)
+	go l.readFromPipe(name, false, cb)
+}
+
+// StartRawReader passes output to cb as soon as it's read, instead of line by
+// line. Used for terminals, where e.g. prompts are not followed by a newline.
+func (l *LogPipe) StartRawReader(name string, cb func(string)) {
+	checkName(name)
+	go l.readFromPipe(name, true, cb)
 }
 
 func (l *LogPipe) StartAllReaders(cb func(string)) {
@@ -0,0 +1,240 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	pauseStopTimeout = 5 * time.Second
+	// Command for starting the pause process, it can be mocked out in tests.
+	pauseCommand = []string{"/proc/self/exe", "--pause"}
+)
+
+// podNamespaces keeps track of the PID and IPC namespaces shared by the units
+// of the pod. A PID namespace can't be joined anymore once its init process
+// has exited, so a pause process is kept running as the init of the pod
+// namespaces. It also reaps orphaned processes of the units.
+type podNamespaces struct {
+	sync.Mutex
+	pause *os.Process
+	done  chan struct{}
+	// The pause process is saved here, so it can be adopted after a restart
+	// of the agent.
+	pidFile string
+}
+
+// Pause runs as the init process of the pod namespaces, until it's asked to
+// stop. Orphaned processes are reaped by the reaper of the agent.
+func Pause() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	<-sigChan
+}
+
+func (p *podNamespaces) running() bool {
+	if p.pause == nil {
+		return false
+	}
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// ensure starts the pause process, unless it's already running, and returns
+// its PID.
+func (p *podNamespaces) ensure() (int, error) {
+	if p.running() {
+		return p.pause.Pid, nil
+	}
+	cmd := exec.Command(pauseCommand[0], pauseCommand[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC,
+	}
+	err := cmd.Start()
+	if err != nil {
+		return 0, fmt.Errorf("starting pause process: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		glog.Infof("pause process %d exited: %v", cmd.Process.Pid, err)
+		close(done)
+	}()
+	p.pause = cmd.Process
+	p.done = done
+	glog.Infof("started pause process %d for the pod namespaces", p.pause.Pid)
+	if p.pidFile != "" {
+		err = saveProcessRef(p.pidFile, p.pause.Pid)
+		if err != nil {
+			glog.Warningf("saving pause process %d: %v", p.pause.Pid, err)
+		}
+	}
+	return p.pause.Pid, nil
+}
+
+// adopt takes over a pause process started by a previous instance of the
+// agent, if it's still running.
+func (p *podNamespaces) adopt() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.pidFile == "" || p.running() {
+		return nil
+	}
+	ref, err := loadProcessRef(p.pidFile)
+	if err != nil {
+		return err
+	}
+	if ref == nil || !ref.alive() {
+		return nil
+	}
+	proc, err := os.FindProcess(ref.Pid)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		ref.wait()
+		glog.Infof("pause process %d exited", ref.Pid)
+		close(done)
+	}()
+	p.pause = proc
+	p.done = done
+	glog.Infof("adopted pause process %d of the pod namespaces", ref.Pid)
+	return nil
+}
+
+// enter calls cb with the calling thread in the namespaces of the pod that
+// are shared according to pidMode and ipcMode. Processes started by cb will
+// be created in these namespaces.
+func (p *podNamespaces) enter(pidMode, ipcMode api.NamespaceMode, cb func() error) error {
+	var names []string
+	if pidMode == api.NamespaceModePod {
+		names = append(names, "pid")
+	}
+	if ipcMode == api.NamespaceModePod {
+		names = append(names, "ipc")
+	}
+	if len(names) == 0 {
+		return cb()
+	}
+	p.Lock()
+	defer p.Unlock()
+	pid, err := p.ensure()
+	if err != nil {
+		return err
+	}
+	runtime.LockOSThread()
+	tid := unix.Gettid()
+	var origs []int
+	defer func() {
+		// If the namespaces of the thread can't be restored, it stays
+		// locked, and is thrown away once the goroutine exits.
+		restored := true
+		for _, orig := range origs {
+			if err := unix.Setns(orig, 0); err != nil {
+				glog.Errorf("restoring namespaces of thread %d: %v", tid, err)
+				restored = false
+			}
+			unix.Close(orig)
+		}
+		if restored {
+			runtime.UnlockOSThread()
+		}
+	}()
+	for _, name := range names {
+		orig, err := openNamespace(fmt.Sprintf("/proc/self/task/%d/ns/%s", tid, name))
+		if err != nil {
+			return err
+		}
+		origs = append(origs, orig)
+		err = setns(fmt.Sprintf("/proc/%d/ns/%s", pid, name))
+		if err != nil {
+			return err
+		}
+	}
+	return cb()
+}
+
+func openNamespace(path string) (int, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("opening namespace %s: %v", path, err)
+	}
+	return fd, nil
+}
+
+func setns(path string) error {
+	fd, err := openNamespace(path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	err = unix.Setns(fd, 0)
+	if err != nil {
+		return fmt.Errorf("joining namespace %s: %v", path, err)
+	}
+	return nil
+}
+
+// stop stops the pause process. Any processes still left in the PID
+// namespace of the pod are killed by the kernel.
+func (p *podNamespaces) stop() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.pidFile != "" {
+		os.Remove(p.pidFile)
+	}
+	if !p.running() {
+		return nil
+	}
+	err := p.pause.Signal(syscall.SIGTERM)
+	if err == nil {
+		select {
+		case <-p.done:
+			p.pause = nil
+			return nil
+		case <-time.After(pauseStopTimeout):
+		}
+	}
+	glog.Warningf("killing pause process %d", p.pause.Pid)
+	err = p.pause.Kill()
+	if err != nil {
+		return fmt.Errorf("killing pause process %d: %v", p.pause.Pid, err)
+	}
+	p.pause = nil
+	return nil
+}
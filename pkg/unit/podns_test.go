@@ -0,0 +1,131 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCloneflags(t *testing.T) {
+	base := uintptr(syscall.CLONE_NEWUTS | syscall.CLONE_NEWNS)
+	testCases := []struct {
+		pid   api.NamespaceMode
+		ipc   api.NamespaceMode
+		flags uintptr
+	}{
+		{api.NamespaceModeContainer, api.NamespaceModePod, base | syscall.CLONE_NEWPID},
+		{api.NamespaceModePod, api.NamespaceModePod, base},
+		{api.NamespaceModeNode, api.NamespaceModeNode, base},
+		{api.NamespaceModeNode, api.NamespaceModeContainer, base | syscall.CLONE_NEWIPC},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.flags, getCloneflags(tc.pid, tc.ipc))
+	}
+}
+
+func TestGetNamespaceModes(t *testing.T) {
+	u, closer := mkTestUnit(t)
+	defer closer()
+	pid, ipc := u.GetNamespaceModes()
+	assert.Equal(t, api.NamespaceModeContainer, pid)
+	assert.Equal(t, api.NamespaceModePod, ipc)
+	// Only the network of the node, e.g. a hostNetwork pod.
+	u.unitConfig.PodSecurityContext.NamespaceOptions = &api.NamespaceOption{
+		Network: api.NamespaceModeNode,
+	}
+	pid, ipc = u.GetNamespaceModes()
+	assert.Equal(t, api.NamespaceModeContainer, pid)
+	assert.Equal(t, api.NamespaceModePod, ipc)
+	share := true
+	u.unitConfig.PodSecurityContext.ShareProcessNamespace = &share
+	u.unitConfig.PodSecurityContext.NamespaceOptions = &api.NamespaceOption{
+		Ipc: api.NamespaceModeNode,
+	}
+	pid, ipc = u.GetNamespaceModes()
+	assert.Equal(t, api.NamespaceModePod, pid)
+	assert.Equal(t, api.NamespaceModeNode, ipc)
+	// The PID namespace of the node wins.
+	u.unitConfig.PodSecurityContext.NamespaceOptions.Pid = api.NamespaceModeNode
+	pid, _ = u.GetNamespaceModes()
+	assert.Equal(t, api.NamespaceModeNode, pid)
+}
+
+func readNamespace(t *testing.T, pid int, name string) string {
+	ns, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", pid, name))
+	assert.NoError(t, err)
+	return ns
+}
+
+func TestPodNamespaces(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating namespaces requires root")
+	}
+	savedPauseCommand, savedPauseStopTimeout := pauseCommand, pauseStopTimeout
+	defer func() {
+		pauseCommand, pauseStopTimeout = savedPauseCommand, savedPauseStopTimeout
+	}()
+	// Signals are ignored by sleep as an init process, it will be killed.
+	pauseCommand = []string{"sleep", "1000"}
+	pauseStopTimeout = 100 * time.Millisecond
+	p := &podNamespaces{}
+	defer p.stop()
+	// Two processes in the namespaces of the pod, and one outside.
+	var pids []int
+	for _, mode := range []api.NamespaceMode{
+		api.NamespaceModePod,
+		api.NamespaceModePod,
+		api.NamespaceModeNode,
+	} {
+		cmd := exec.Command("sleep", "1000")
+		err := p.enter(mode, mode, cmd.Start)
+		assert.NoError(t, err)
+		defer cmd.Wait()
+		defer cmd.Process.Kill()
+		pids = append(pids, cmd.Process.Pid)
+	}
+	assert.True(t, p.running())
+	self := os.Getpid()
+	for _, name := range []string{"pid", "ipc"} {
+		podNS := readNamespace(t, p.pause.Pid, name)
+		assert.NotEqual(t, readNamespace(t, self, name), podNS)
+		assert.Equal(t, podNS, readNamespace(t, pids[0], name))
+		assert.Equal(t, podNS, readNamespace(t, pids[1], name))
+		assert.Equal(t, readNamespace(t, self, name), readNamespace(t, pids[2], name))
+	}
+	// The calling thread is back in its own namespaces.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	for _, name := range []string{"pid_for_children", "ipc"} {
+		ns, err := os.Readlink(
+			fmt.Sprintf("/proc/self/task/%d/ns/%s", syscall.Gettid(), name))
+		assert.NoError(t, err)
+		assert.Equal(t, readNamespace(t, self, name), ns)
+	}
+	assert.NoError(t, p.stop())
+	assert.False(t, p.running())
+}
@@ -0,0 +1,207 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/elotl/itzo/pkg/api"
+	"golang.org/x/sys/unix"
+)
+
+const rlimitUnlimited = "unlimited"
+
+var (
+	// Resource limits of units that don't set them explicitly. Set via the
+	// command line of itzo.
+	DefaultRlimits []api.Rlimit
+
+	rlimitResources = map[string]int{
+		"as":         unix.RLIMIT_AS,
+		"core":       unix.RLIMIT_CORE,
+		"cpu":        unix.RLIMIT_CPU,
+		"data":       unix.RLIMIT_DATA,
+		"fsize":      unix.RLIMIT_FSIZE,
+		"locks":      unix.RLIMIT_LOCKS,
+		"memlock":    unix.RLIMIT_MEMLOCK,
+		"msgqueue":   unix.RLIMIT_MSGQUEUE,
+		"nice":       unix.RLIMIT_NICE,
+		"nofile":     unix.RLIMIT_NOFILE,
+		"nproc":      unix.RLIMIT_NPROC,
+		"rss":        unix.RLIMIT_RSS,
+		"rtprio":     unix.RLIMIT_RTPRIO,
+		"rttime":     unix.RLIMIT_RTTIME,
+		"sigpending": unix.RLIMIT_SIGPENDING,
+		"stack":      unix.RLIMIT_STACK,
+	}
+)
+
+// ParseRlimits parses a comma separated list of resource limits in the form
+// of name=soft:hard, e.g. "nofile=1024:4096,core=0". If there is only one
+// value, it's used both as the soft and the hard limit. Values can also be
+// "unlimited".
+func ParseRlimits(s string) ([]api.Rlimit, error) {
+	var rlimits []api.Rlimit
+	if s == "" {
+		return rlimits, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid resource limit %q", item)
+		}
+		values := strings.SplitN(parts[1], ":", 2)
+		if len(values) == 1 {
+			values = append(values, values[0])
+		}
+		soft, err := parseRlimitValue(values[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid resource limit %q: %v", item, err)
+		}
+		hard, err := parseRlimitValue(values[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid resource limit %q: %v", item, err)
+		}
+		rlimits = append(rlimits, api.Rlimit{
+			Name: parts[0],
+			Soft: soft,
+			Hard: hard,
+		})
+	}
+	err := ValidateRlimits(rlimits)
+	if err != nil {
+		return nil, err
+	}
+	return rlimits, nil
+}
+
+func parseRlimitValue(s string) (uint64, error) {
+	if s == rlimitUnlimited {
+		return unix.RLIM_INFINITY, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+func formatRlimitValue(value uint64) string {
+	if value == unix.RLIM_INFINITY {
+		return rlimitUnlimited
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+// FormatRlimits is the inverse of ParseRlimits.
+func FormatRlimits(rlimits []api.Rlimit) string {
+	items := make([]string, len(rlimits))
+	for i, rl := range rlimits {
+		items[i] = fmt.Sprintf("%s=%s:%s",
+			rl.Name, formatRlimitValue(rl.Soft), formatRlimitValue(rl.Hard))
+	}
+	return strings.Join(items, ",")
+}
+
+// ValidateRlimits checks that the resources are known, and that soft limits
+// don't exceed hard limits.
+func ValidateRlimits(rlimits []api.Rlimit) error {
+	for _, rl := range rlimits {
+		if _, ok := rlimitResources[rl.Name]; !ok {
+			return fmt.Errorf("unknown resource limit %q", rl.Name)
+		}
+		if rl.Soft > rl.Hard {
+			return fmt.Errorf("soft limit of %s is higher than the hard limit",
+				rl.Name)
+		}
+	}
+	return nil
+}
+
+// MergeRlimits returns the limits in rlimits, plus the ones in defaults that
+// are not set in rlimits, sorted by name.
+func MergeRlimits(defaults, rlimits []api.Rlimit) []api.Rlimit {
+	merged := make(map[string]api.Rlimit)
+	for _, rl := range defaults {
+		merged[rl.Name] = rl
+	}
+	for _, rl := range rlimits {
+		merged[rl.Name] = rl
+	}
+	result := make([]api.Rlimit, 0, len(merged))
+	for _, rl := range merged {
+		result = append(result, rl)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// setRlimits sets resource limits for the process pid, or for the calling
+// process if pid is 0. They are inherited by its children.
+func setRlimits(pid int, rlimits []api.Rlimit) error {
+	for _, rl := range rlimits {
+		resource, ok := rlimitResources[rl.Name]
+		if !ok {
+			return fmt.Errorf("unknown resource limit %q", rl.Name)
+		}
+		err := prlimit(pid, resource, &unix.Rlimit{Cur: rl.Soft, Max: rl.Hard})
+		if err != nil {
+			return fmt.Errorf("setting resource limit %s: %v", rl.Name, err)
+		}
+	}
+	return nil
+}
+
+// prlimit is prlimit(2) without getting the old limit, which
+// golang.org/x/sys/unix doesn't export in the version we use.
+func prlimit(pid, resource int, rlim *unix.Rlimit) error {
+	_, _, errno := unix.RawSyscall6(unix.SYS_PRLIMIT64, uintptr(pid),
+		uintptr(resource), uintptr(unsafe.Pointer(rlim)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ExecWithRlimits sets the resource limits in rlimits (in the format of
+// ParseRlimits) and executes argv. Used for running commands in units, so
+// they get the same limits as the unit.
+func ExecWithRlimits(rlimits string, argv []string) error {
+	if len(argv) == 0 {
+		return fmt.Errorf("no command to execute")
+	}
+	rl, err := ParseRlimits(rlimits)
+	if err != nil {
+		return err
+	}
+	err = setRlimits(0, rl)
+	if err != nil {
+		return err
+	}
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, argv, os.Environ())
+}
@@ -0,0 +1,222 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/elotl/itzo/pkg/api"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseRlimits(t *testing.T) {
+	testCases := []struct {
+		input   string
+		rlimits []api.Rlimit
+		err     bool
+	}{
+		{
+			input:   "",
+			rlimits: nil,
+		},
+		{
+			input: "nofile=1024:4096,core=0",
+			rlimits: []api.Rlimit{
+				{Name: "nofile", Soft: 1024, Hard: 4096},
+				{Name: "core", Soft: 0, Hard: 0},
+			},
+		},
+		{
+			input: "memlock=unlimited",
+			rlimits: []api.Rlimit{
+				{Name: "memlock", Soft: unix.RLIM_INFINITY, Hard: unix.RLIM_INFINITY},
+			},
+		},
+		{
+			input: "nofile",
+			err:   true,
+		},
+		{
+			input: "nofile=foo",
+			err:   true,
+		},
+		{
+			input: "foo=1",
+			err:   true,
+		},
+		{
+			input: "nofile=4096:1024",
+			err:   true,
+		},
+	}
+	for _, tc := range testCases {
+		rlimits, err := ParseRlimits(tc.input)
+		if tc.err {
+			assert.Error(t, err, tc.input)
+			continue
+		}
+		assert.NoError(t, err, tc.input)
+		assert.Equal(t, tc.rlimits, rlimits, tc.input)
+	}
+}
+
+func TestFormatRlimits(t *testing.T) {
+	rlimits := []api.Rlimit{
+		{Name: "nofile", Soft: 1024, Hard: 4096},
+		{Name: "stack", Soft: 8192, Hard: unix.RLIM_INFINITY},
+	}
+	s := FormatRlimits(rlimits)
+	assert.Equal(t, "nofile=1024:4096,stack=8192:unlimited", s)
+	parsed, err := ParseRlimits(s)
+	assert.NoError(t, err)
+	assert.Equal(t, rlimits, parsed)
+}
+
+func TestMergeRlimits(t *testing.T) {
+	defaults := []api.Rlimit{
+		{Name: "nproc", Soft: 100, Hard: 100},
+		{Name: "nofile", Soft: 1024, Hard: 4096},
+	}
+	rlimits := []api.Rlimit{
+		{Name: "nofile", Soft: 65536, Hard: 65536},
+		{Name: "core", Soft: 0, Hard: 0},
+	}
+	assert.Equal(t, []api.Rlimit{
+		{Name: "core", Soft: 0, Hard: 0},
+		{Name: "nofile", Soft: 65536, Hard: 65536},
+		{Name: "nproc", Soft: 100, Hard: 100},
+	}, MergeRlimits(defaults, rlimits))
+	assert.Empty(t, MergeRlimits(nil, nil))
+}
+
+// The test binary doubles as the shim of units.
+func TestMain(m *testing.M) {
+	prefix := "--" + ShimFlag + "="
+	if len(os.Args) > 3 && strings.HasPrefix(os.Args[1], prefix) {
+		fd, err := strconv.Atoi(strings.TrimPrefix(os.Args[1], prefix))
+		if err == nil {
+			err = ExecUnitCommand(fd, os.Args[3:])
+		}
+		fmt.Fprintf(os.Stderr, "shim: %v\n", err)
+		os.Exit(127)
+	}
+	shimExecutable = os.Args[0]
+	os.Exit(m.Run())
+}
+
+func TestRunUnitLoopRlimits(t *testing.T) {
+	var saved unix.Rlimit
+	assert.NoError(t, unix.Getrlimit(unix.RLIMIT_CORE, &saved))
+	u, closer := mkTestUnit(t)
+	defer closer()
+	u.unitConfig.Rlimits = []api.Rlimit{
+		{Name: "core", Soft: 0, Hard: 0},
+	}
+	var stdout bytes.Buffer
+	u.RunUnitLoop(
+		[]string{"sh", "-c", "ulimit -c -H; ulimit -c"},
+		nil, 0, 0, nil, nil, &stdout, nil, api.RestartPolicyNever)
+	assert.Equal(t, "0\n0", strings.TrimSpace(stdout.String()))
+	// The limits of the helper are left alone.
+	var current unix.Rlimit
+	assert.NoError(t, unix.Getrlimit(unix.RLIMIT_CORE, &current))
+	assert.Equal(t, saved, current)
+}
+
+func TestRunUnitLoopSeccomp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "itzo-test-seccomp-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	u, closer := mkTestUnit(t)
+	defer closer()
+	u.unitConfig.SeccompProfile = &api.SeccompProfile{
+		Type: api.SeccompProfileTypeLocalhost,
+	}
+	u.unitConfig.SeccompLocalhostProfile = &specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Syscalls: []specs.LinuxSyscall{
+			{
+				Names:  []string{"mkdir", "mkdirat"},
+				Action: specs.ActErrno,
+			},
+		},
+	}
+	unitDir := filepath.Join(dir, "unit")
+	u.RunUnitLoop(
+		[]string{"mkdir", unitDir},
+		nil, 0, 0, nil, nil, nil, nil, api.RestartPolicyNever)
+	_, err = os.Stat(unitDir)
+	assert.True(t, os.IsNotExist(err))
+	// The filter is not installed on the helper.
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "helper"), 0755))
+}
+
+func TestShimMessage(t *testing.T) {
+	filter := []bpf.RawInstruction{
+		{Op: 0x20, K: 4},
+		{Op: 0x06, K: 0x7fff0000},
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, writeShimMessage(&buf, filter))
+	msg := buf.Bytes()
+	received, err := readShimMessage(bytes.NewReader(msg))
+	assert.NoError(t, err)
+	assert.Equal(t, filter, received)
+	// A message cut short, e.g. because the helper went away, is rejected.
+	_, err = readShimMessage(bytes.NewReader(msg[:len(msg)-1]))
+	assert.Error(t, err)
+	buf.Reset()
+	assert.NoError(t, writeShimMessage(&buf, nil))
+	received, err = readShimMessage(&buf)
+	assert.NoError(t, err)
+	assert.Empty(t, received)
+}
+
+func TestShimCommandNotFound(t *testing.T) {
+	// The error shows up when the unit is started, not in the shim.
+	_, _, err := shimCommand(exec.Command("/does/not/exist"))
+	assert.Error(t, err)
+}
+
+// ExecWithRlimits() replaces the process, so it's run in a child.
+func TestExecWithRlimits(t *testing.T) {
+	if os.Getenv("ITZO_TEST_RLIMITS_CHILD") == "1" {
+		err := ExecWithRlimits("core=0:0", []string{"sh", "-c", "ulimit -c -H"})
+		if err != nil {
+			os.Exit(2)
+		}
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExecWithRlimits$")
+	cmd.Env = append(os.Environ(), "ITZO_TEST_RLIMITS_CHILD=1")
+	output, err := cmd.Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "0", strings.TrimSpace(string(output)))
+}
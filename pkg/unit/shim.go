@@ -0,0 +1,147 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"github.com/elotl/itzo/pkg/seccomp"
+	"golang.org/x/net/bpf"
+)
+
+// The command of a unit is started via a shim if the process has to be set up
+// before the command runs, e.g. with resource limits that the user of the unit
+// could not raise on its own, or with a seccomp filter. The helper sets up the
+// shim process, then tells it to go ahead, sending it the seccomp filter of the
+// unit if there is one. The shim installs the filter and executes the command
+// in its place. The helper itself, along with its hooks and probes, is left
+// alone.
+
+const (
+	// Command line flag of itzo for running as a shim, with the file
+	// descriptor the shim waits on as its value.
+	ShimFlag = "unit-shim"
+	// Sent by the helper to the shim once the process is set up.
+	shimReady = 'r'
+)
+
+// Executable of the shim, replaced in tests.
+var shimExecutable = "/proc/self/exe"
+
+// shimCommand changes cmd to start the command via the shim. It returns both
+// ends of the pipe the shim waits on: the read end is closed once the process
+// has been started, and writeShimMessage() is called with the other one once
+// it has been set up.
+func shimCommand(cmd *exec.Cmd) (*os.File, *os.File, error) {
+	path, err := exec.LookPath(cmd.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	args := []string{
+		shimExecutable,
+		fmt.Sprintf("--%s=%d", ShimFlag, fd),
+		"--",
+		path,
+	}
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = shimExecutable
+	return r, w, nil
+}
+
+// writeShimMessage tells the shim to go ahead. The message is shimReady,
+// followed by the number of instructions in filter and the instructions
+// themselves.
+func writeShimMessage(w io.Writer, filter []bpf.RawInstruction) error {
+	var buf bytes.Buffer
+	buf.WriteByte(shimReady)
+	err := binary.Write(&buf, binary.LittleEndian, uint32(len(filter)))
+	if err != nil {
+		return err
+	}
+	err = binary.Write(&buf, binary.LittleEndian, filter)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// readShimMessage waits for the message of the helper on r, and returns the
+// seccomp filter in it.
+func readShimMessage(r io.Reader) ([]bpf.RawInstruction, error) {
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != shimReady {
+		return nil, fmt.Errorf("unexpected message %q", buf[0])
+	}
+	var n uint32
+	err = binary.Read(r, binary.LittleEndian, &n)
+	if err != nil {
+		return nil, err
+	}
+	filter := make([]bpf.RawInstruction, n)
+	err = binary.Read(r, binary.LittleEndian, filter)
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// ExecUnitCommand is the shim: it waits for the helper on the file descriptor
+// fd, installs the seccomp filter it gets from the helper, if any, then
+// executes argv[0] with the arguments in argv[1:]. If the helper goes away
+// before it's done, the command is not executed.
+func ExecUnitCommand(fd int, argv []string) error {
+	if len(argv) < 2 {
+		return fmt.Errorf("no command to execute")
+	}
+	f := os.NewFile(uintptr(fd), "shim-"+strconv.Itoa(fd))
+	filter, err := readShimMessage(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("waiting for unit helper: %v", err)
+	}
+	if len(filter) > 0 {
+		// no_new_privs might have to be set for the filter, which is per
+		// thread.
+		runtime.LockOSThread()
+		err = seccomp.InstallFilter(filter)
+		if err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(argv[0], argv[1:], os.Environ())
+}
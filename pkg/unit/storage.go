@@ -0,0 +1,480 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/elotl/itzo/pkg/events"
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// Project quotas are managed via the XFS quota interface, which the kernel
+// also provides for ext4. These are missing from x/sys/unix.
+const (
+	fsIocFsgetxattr     = 0x801c581f
+	fsIocFssetxattr     = 0x401c5820
+	fsXflagProjinherit  = 0x00000200
+	prjQuota            = 2
+	qXgetquota          = 0x5803
+	qXsetqlim           = 0x5804
+	fsDquotVersion      = 1
+	fsProjQuota         = 2
+	fsDqBhard           = 1 << 3
+	fsDqBsoft           = 1 << 2
+	quotaBasicBlockSize = 512
+)
+
+var (
+	// How often the usage of the writable layer of units with a storage
+	// limit is checked, when project quotas are not available.
+	storagePollInterval = 10 * time.Second
+	// Overlay mounts of unit root filesystems are looked up here.
+	mountinfoPath = "/proc/self/mountinfo"
+)
+
+// ErrNoWritableLayer is returned for units whose image has been extracted
+// into their root filesystem instead of being mounted via overlayfs. Writes of
+// these units can't be told apart from the files of the image.
+var ErrNoWritableLayer = errors.New("unit has no writable layer")
+
+type fsxattr struct {
+	xflags   uint32
+	extsize  uint32
+	nextents uint32
+	projid   uint32
+	pad      [12]byte
+}
+
+// fsDiskQuota is struct fs_disk_quota from linux/dqblk_xfs.h.
+type fsDiskQuota struct {
+	version      int8
+	flags        int8
+	fieldmask    uint16
+	id           uint32
+	blkHardlimit uint64
+	blkSoftlimit uint64
+	inoHardlimit uint64
+	inoSoftlimit uint64
+	bcount       uint64
+	icount       uint64
+	itimer       int32
+	btimer       int32
+	iwarns       uint16
+	bwarns       uint16
+	padding2     int32
+	rtbHardlimit uint64
+	rtbSoftlimit uint64
+	rtbcount     uint64
+	rtbtimer     int32
+	rtbwarns     uint16
+	padding3     int16
+	padding4     [8]byte
+}
+
+func quotaCmd(cmd int) uintptr {
+	return uintptr(cmd<<8 | prjQuota)
+}
+
+func quotactl(cmd int, dev string, id uint32, quota *fsDiskQuota) error {
+	p, err := unix.BytePtrFromString(dev)
+	if err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, quotaCmd(cmd),
+		uintptr(unsafe.Pointer(p)), uintptr(id), uintptr(unsafe.Pointer(quota)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func fsxattrIoctl(dir string, req uintptr, attr *fsxattr) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(attr)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// getProjectID returns the project of dir, 0 if it has not been assigned to
+// one.
+func getProjectID(dir string) (uint32, error) {
+	var attr fsxattr
+	err := fsxattrIoctl(dir, fsIocFsgetxattr, &attr)
+	if err != nil {
+		return 0, fmt.Errorf("getting project of %s: %v", dir, err)
+	}
+	return attr.projid, nil
+}
+
+// setProjectID assigns dir to a project. Files created below dir inherit it.
+func setProjectID(dir string, id uint32) error {
+	var attr fsxattr
+	err := fsxattrIoctl(dir, fsIocFsgetxattr, &attr)
+	if err != nil {
+		return fmt.Errorf("getting project of %s: %v", dir, err)
+	}
+	attr.projid = id
+	attr.xflags |= fsXflagProjinherit
+	err = fsxattrIoctl(dir, fsIocFssetxattr, &attr)
+	if err != nil {
+		return fmt.Errorf("setting project of %s: %v", dir, err)
+	}
+	return nil
+}
+
+// projectQuotas sets and reads project quotas on the filesystems of the
+// writable layers of units.
+type projectQuotas struct {
+	// Block device nodes for quotactl are created here.
+	devDir string
+}
+
+// device returns a block device node for the filesystem of dir.
+func (q *projectQuotas) device(dir string) (string, error) {
+	var st unix.Stat_t
+	err := unix.Stat(dir, &st)
+	if err != nil {
+		return "", err
+	}
+	dev := filepath.Join(q.devDir, fmt.Sprintf(".quotadev-%d", st.Dev))
+	err = unix.Mknod(dev, unix.S_IFBLK|0600, int(st.Dev))
+	if err != nil && err != unix.EEXIST {
+		return "", fmt.Errorf("creating device node for %s: %v", dir, err)
+	}
+	return dev, nil
+}
+
+// nextProjectID returns a project ID that's not used by any other unit.
+func (q *projectQuotas) nextProjectID(rootdir string) uint32 {
+	var next uint32 = 1
+	if id, err := getProjectID(rootdir); err == nil {
+		next = id + 1
+	}
+	entries, err := ioutil.ReadDir(rootdir)
+	if err != nil {
+		return next
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !IsUnitExist(rootdir, entry.Name()) {
+			continue
+		}
+		layer, ok := writableLayer(filepath.Join(rootdir, entry.Name(), "ROOTFS"))
+		if !ok {
+			continue
+		}
+		if id, err := getProjectID(layer); err == nil && id >= next {
+			next = id + 1
+		}
+	}
+	return next
+}
+
+// apply assigns dir to a new project, limited to limit bytes. A zero limit
+// only accounts for usage.
+func (q *projectQuotas) apply(rootdir, dir string, limit uint64) error {
+	dev, err := q.device(dir)
+	if err != nil {
+		return err
+	}
+	id := q.nextProjectID(rootdir)
+	blocks := (limit + quotaBasicBlockSize - 1) / quotaBasicBlockSize
+	quota := fsDiskQuota{
+		version:      fsDquotVersion,
+		flags:        fsProjQuota,
+		fieldmask:    fsDqBhard | fsDqBsoft,
+		id:           id,
+		blkHardlimit: blocks,
+		blkSoftlimit: blocks,
+	}
+	err = quotactl(qXsetqlim, dev, id, &quota)
+	if err != nil {
+		return fmt.Errorf("setting quota of project %d: %v", id, err)
+	}
+	return setProjectID(dir, id)
+}
+
+// usage returns the space used by the project of dir, which has to be
+// assigned to one.
+func (q *projectQuotas) usage(dir string) (uint64, error) {
+	id, err := getProjectID(dir)
+	if err != nil {
+		return 0, err
+	}
+	if id == 0 {
+		return 0, fmt.Errorf("%s has no project", dir)
+	}
+	dev, err := q.device(dir)
+	if err != nil {
+		return 0, err
+	}
+	var quota fsDiskQuota
+	err = quotactl(qXgetquota, dev, id, &quota)
+	if err != nil {
+		return 0, fmt.Errorf("getting quota of project %d: %v", id, err)
+	}
+	return quota.bcount * quotaBasicBlockSize, nil
+}
+
+// dirUsage returns the disk space used by the files below dir, like du. Other
+// filesystems mounted below dir are skipped.
+func dirUsage(dir string) (uint64, error) {
+	var root syscall.Stat_t
+	err := syscall.Lstat(dir, &root)
+	if err != nil {
+		return 0, err
+	}
+	var usage uint64
+	seen := make(map[uint64]bool)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed in the meantime.
+				return nil
+			}
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		if st.Dev != root.Dev {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if st.Nlink > 1 && !info.IsDir() {
+			if seen[st.Ino] {
+				return nil
+			}
+			seen[st.Ino] = true
+		}
+		usage += uint64(st.Blocks) * 512
+		return nil
+	})
+	return usage, err
+}
+
+// findOverlayUpperdir returns the upper directory of the overlay filesystem
+// mounted at mountpoint, based on mountinfo.
+func findOverlayUpperdir(mountinfo io.Reader, mountpoint string) string {
+	upperdir := ""
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		// 36 35 98:0 / /mnt rw - overlay overlay rw,lowerdir=...,upperdir=...
+		parts := strings.SplitN(scanner.Text(), " - ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[0])
+		super := strings.Fields(parts[1])
+		if len(fields) < 5 || len(super) < 3 || super[0] != "overlay" {
+			continue
+		}
+		if unescapeMountinfo(fields[4]) != mountpoint {
+			continue
+		}
+		// Later mounts hide earlier ones, keep looking.
+		upperdir = ""
+		for _, opt := range strings.Split(super[2], ",") {
+			if strings.HasPrefix(opt, "upperdir=") {
+				upperdir = unescapeMountinfo(strings.TrimPrefix(opt, "upperdir="))
+			}
+		}
+	}
+	return upperdir
+}
+
+// unescapeMountinfo decodes the octal escapes of whitespace and backslashes
+// in mountinfo.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// writableLayer returns the directory where changes to rootfs end up, the
+// upper directory of the overlay mounted at rootfs. False if the image has
+// been extracted into rootfs, there is no such directory then.
+func writableLayer(rootfs string) (string, bool) {
+	f, err := os.Open(mountinfoPath)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	upperdir := findOverlayUpperdir(f, rootfs)
+	return upperdir, upperdir != ""
+}
+
+// GetEphemeralStorageLimit returns the limit of the writable layer of the
+// unit in bytes, or 0 if there is none.
+func (u *Unit) GetEphemeralStorageLimit() uint64 {
+	q, ok := u.unitConfig.Resources.Limits[api.ResourceEphemeralStorage]
+	if !ok || q.Value() <= 0 {
+		return 0
+	}
+	return uint64(q.Value())
+}
+
+// setEvicted marks the unit as evicted, after it has been stopped.
+func (u *Unit) setEvicted(message string) error {
+	return u.updateStatus(func(status *api.UnitStatus) {
+		terminated := status.State.Terminated
+		if terminated == nil {
+			terminated = &api.UnitStateTerminated{
+				ExitCode:   137,
+				FinishedAt: api.Now(),
+			}
+			if status.State.Running != nil {
+				terminated.StartedAt = status.State.Running.StartedAt
+			}
+		}
+		terminated.Reason = "Evicted"
+		terminated.Message = message
+		status.State = api.UnitState{Terminated: terminated}
+	})
+}
+
+// setupStorage enforces the ephemeral storage limit of a unit, before its
+// helper is started. A project quota is set on the writable layer of the unit
+// if the filesystem supports it. Units without a limit still get a project
+// for accounting their usage. Adopted units already have their quota in
+// place. Returns the writable layer if the unit has a limit but no quota: its
+// usage has to be watched via watchStorage then. Limits of units without a
+// writable layer are not enforced.
+func (um *UnitManager) setupStorage(podname string, unit *Unit, adopted bool) string {
+	rootfs := unit.GetRootfs()
+	if _, err := os.Stat(rootfs); err != nil {
+		return ""
+	}
+	limit := unit.GetEphemeralStorageLimit()
+	layer, ok := writableLayer(rootfs)
+	if !ok {
+		if limit > 0 {
+			glog.Warningf("not enforcing storage limit of %s/%s: "+
+				"its image is not mounted via overlayfs", podname, unit.Name)
+		}
+		return ""
+	}
+	hasQuota := false
+	if adopted {
+		id, err := getProjectID(layer)
+		hasQuota = err == nil && id != 0
+	} else {
+		um.storageLock.Lock()
+		err := um.quotas.apply(um.rootDir, layer, limit)
+		um.storageLock.Unlock()
+		if err != nil {
+			glog.V(2).Infof("no project quota for %s/%s: %v", podname, unit.Name, err)
+		} else {
+			hasQuota = true
+		}
+	}
+	if limit == 0 || hasQuota {
+		return ""
+	}
+	glog.Infof("checking storage usage of %s/%s in %s, limit %d",
+		podname, unit.Name, layer, limit)
+	return layer
+}
+
+// watchStorage evicts the unit if its writable layer grows beyond limit,
+// until the helper of the unit exits.
+func (um *UnitManager) watchStorage(podname string, unit *Unit, proc *os.Process, layer string, limit uint64) {
+	for {
+		time.Sleep(storagePollInterval)
+		if !um.helperRunning(unit.Name, proc) {
+			return
+		}
+		usage, err := dirUsage(layer)
+		if err != nil {
+			glog.Warningf("getting storage usage of %s/%s: %v", podname, unit.Name, err)
+			continue
+		}
+		if usage <= limit {
+			continue
+		}
+		msg := fmt.Sprintf(
+			"Unit %s exceeded its local ephemeral storage limit of %d bytes, using %d bytes",
+			unit.Name, limit, usage)
+		glog.Warningf("evicting %s/%s: %s", podname, unit.Name, msg)
+		unit.RecordEvent(api.EventTypeWarning, events.UnitEvicted, msg)
+		err = um.StopUnit(unit.Name)
+		if err != nil {
+			glog.Errorf("stopping %s/%s: %v", podname, unit.Name, err)
+		}
+		err = unit.setEvicted(msg)
+		if err != nil {
+			glog.Errorf("updating status of %s/%s: %v", podname, unit.Name, err)
+		}
+		return
+	}
+}
+
+// GetFsUsage returns the disk space used by the writable layer of a unit,
+// ErrNoWritableLayer if it has none.
+func (um *UnitManager) GetFsUsage(unitName string) (uint64, error) {
+	if !IsUnitExist(um.rootDir, unitName) {
+		return 0, fmt.Errorf("unit %s does not exist", unitName)
+	}
+	rootfs := filepath.Join(um.rootDir, unitName, "ROOTFS")
+	if _, err := os.Stat(rootfs); err != nil {
+		return 0, err
+	}
+	layer, ok := writableLayer(rootfs)
+	if !ok {
+		return 0, ErrNoWritableLayer
+	}
+	if usage, err := um.quotas.usage(layer); err == nil {
+		return usage, nil
+	}
+	return dirUsage(layer)
+}
@@ -0,0 +1,196 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestFindOverlayUpperdir(t *testing.T) {
+	mountinfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+95 22 0:45 / /units/foo/ROOTFS rw,relatime - overlay overlay rw,lowerdir=/l1:/l2,upperdir=/tosi/foo/upper,workdir=/tosi/foo/work
+96 22 0:46 / /units/my\040unit/ROOTFS rw,relatime - overlay overlay rw,lowerdir=/l1,upperdir=/tosi/my\040unit/upper,workdir=/tosi/work
+97 95 0:4 / /units/foo/ROOTFS/proc rw - proc proc rw
+`
+	testCases := []struct {
+		mountpoint string
+		upperdir   string
+	}{
+		{"/units/foo/ROOTFS", "/tosi/foo/upper"},
+		{"/units/my unit/ROOTFS", "/tosi/my unit/upper"},
+		{"/units/bar/ROOTFS", ""},
+		{"/", ""},
+	}
+	for _, tc := range testCases {
+		upperdir := findOverlayUpperdir(strings.NewReader(mountinfo), tc.mountpoint)
+		assert.Equal(t, tc.upperdir, upperdir, tc.mountpoint)
+	}
+}
+
+func TestDirUsage(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "itzo-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	empty, err := dirUsage(tmpdir)
+	assert.NoError(t, err)
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	path := filepath.Join(tmpdir, "data")
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+	// Hard links are counted once.
+	assert.NoError(t, os.Link(path, filepath.Join(tmpdir, "link")))
+	usage, err := dirUsage(tmpdir)
+	assert.NoError(t, err)
+	assert.True(t, usage-empty >= uint64(len(data)), "usage %d", usage)
+	assert.True(t, usage-empty < 2*uint64(len(data)), "usage %d", usage)
+	_, err = dirUsage(filepath.Join(tmpdir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestGetEphemeralStorageLimit(t *testing.T) {
+	u, closer := mkTestUnit(t)
+	defer closer()
+	assert.Equal(t, uint64(0), u.GetEphemeralStorageLimit())
+	u.unitConfig.Resources.Limits = api.ResourceList{
+		api.ResourceEphemeralStorage: resource.MustParse("1Mi"),
+	}
+	assert.Equal(t, uint64(1024*1024), u.GetEphemeralStorageLimit())
+}
+
+func TestWatchStorage(t *testing.T) {
+	savedInterval, savedSleep := storagePollInterval, LOG_PIPE_FINISH_READ_SLEEP
+	defer func() {
+		storagePollInterval, LOG_PIPE_FINISH_READ_SLEEP = savedInterval, savedSleep
+	}()
+	storagePollInterval = 10 * time.Millisecond
+	LOG_PIPE_FINISH_READ_SLEEP = 0
+	u, closer := mkTestUnit(t)
+	defer closer()
+	um := NewUnitManager(filepath.Dir(u.Directory))
+	rootfs := u.GetRootfs()
+	assert.NoError(t, os.MkdirAll(rootfs, 0755))
+	assert.NoError(t, u.SetState(api.UnitState{
+		Running: &api.UnitStateRunning{StartedAt: api.Now()},
+	}, nil))
+	cmd := exec.Command("sleep", "1000")
+	assert.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+	um.RunningUnits.Set(u.Name, cmd.Process)
+	go um.watchHelper("mypod", u, cmd.Process, cmd.Wait)
+	go um.watchStorage("mypod", u, cmd.Process, rootfs, 64*1024)
+	// Below the limit.
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, um.UnitRunning(u.Name))
+	data := []byte(strings.Repeat("x", 128*1024))
+	err := ioutil.WriteFile(filepath.Join(rootfs, "data"), data, 0600)
+	assert.NoError(t, err)
+	waitForCondition(t, func() bool {
+		status, err := u.GetStatus()
+		return err == nil && status.State.Terminated != nil
+	})
+	assert.False(t, um.UnitRunning(u.Name))
+	status, err := u.GetStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, "Evicted", status.State.Terminated.Reason)
+	assert.Contains(t, status.State.Terminated.Message, "ephemeral storage limit")
+	assert.NotZero(t, status.State.Terminated.StartedAt)
+	events, err := u.ReadEvents()
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "Evicted", events[0].Reason)
+}
+
+// fakeOverlayMount makes writableLayer find an overlay mounted at rootfs,
+// with its upper directory at upperdir.
+func fakeOverlayMount(t *testing.T, rootfs, upperdir string) func() {
+	saved := mountinfoPath
+	f, err := ioutil.TempFile("", "mountinfo")
+	assert.NoError(t, err)
+	_, err = f.WriteString(fmt.Sprintf(
+		"95 22 0:45 / %s rw - overlay overlay rw,lowerdir=/l1,upperdir=%s,workdir=/w\n",
+		rootfs, upperdir))
+	assert.NoError(t, err)
+	f.Close()
+	mountinfoPath = f.Name()
+	return func() {
+		mountinfoPath = saved
+		os.Remove(f.Name())
+	}
+}
+
+func TestGetFsUsage(t *testing.T) {
+	u, closer := mkTestUnit(t)
+	defer closer()
+	um := NewUnitManager(filepath.Dir(u.Directory))
+	_, err := um.GetFsUsage("missing")
+	assert.Error(t, err)
+	rootfs := u.GetRootfs()
+	assert.NoError(t, os.MkdirAll(rootfs, 0755))
+	image := []byte(strings.Repeat("x", 512*1024))
+	err = ioutil.WriteFile(filepath.Join(rootfs, "image"), image, 0600)
+	assert.NoError(t, err)
+	// The image has been extracted into rootfs.
+	_, err = um.GetFsUsage(u.Name)
+	assert.Equal(t, ErrNoWritableLayer, err)
+	// Only the upper directory of the overlay counts.
+	upperdir := filepath.Join(u.Directory, "upper")
+	assert.NoError(t, os.MkdirAll(upperdir, 0755))
+	defer fakeOverlayMount(t, rootfs, upperdir)()
+	data := []byte(strings.Repeat("x", 128*1024))
+	err = ioutil.WriteFile(filepath.Join(upperdir, "data"), data, 0600)
+	assert.NoError(t, err)
+	usage, err := um.GetFsUsage(u.Name)
+	assert.NoError(t, err)
+	assert.True(t, usage >= uint64(len(data)), "usage %d", usage)
+	assert.True(t, usage < uint64(len(image)), "usage %d", usage)
+}
+
+func TestSetupStorageWithoutWritableLayer(t *testing.T) {
+	u, closer := mkTestUnit(t)
+	defer closer()
+	um := NewUnitManager(filepath.Dir(u.Directory))
+	rootfs := u.GetRootfs()
+	assert.NoError(t, os.MkdirAll(rootfs, 0755))
+	u.unitConfig.Resources.Limits = api.ResourceList{
+		api.ResourceEphemeralStorage: resource.MustParse("1Ki"),
+	}
+	image := []byte(strings.Repeat("x", 64*1024))
+	err := ioutil.WriteFile(filepath.Join(rootfs, "image"), image, 0600)
+	assert.NoError(t, err)
+	// The image is larger than the limit, but it's not the unit that wrote
+	// it.
+	assert.Equal(t, "", um.setupStorage("mypod", u, false))
+	id, err := getProjectID(rootfs)
+	if err == nil {
+		assert.Zero(t, id)
+	}
+}
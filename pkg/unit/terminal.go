@@ -0,0 +1,345 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/kr/pty"
+)
+
+// The EOF character of terminals (^D), since the master side of a pty can't
+// be closed to signal the end of input.
+const ttyEOF = 0x04
+
+// controlMessage is sent by the agent to the helper of a unit via the control
+// pipe, one JSON object per line.
+type controlMessage struct {
+	// Close stdin of the unit, once the data already written to it has
+	// been read.
+	CloseStdin bool `json:"closeStdin,omitempty"`
+	// New size of the terminal of the unit.
+	Resize *pty.Winsize `json:"resize,omitempty"`
+}
+
+// stdinRelay forwards data from the stdin pipe of the unit to the current
+// process of the unit. Every process gets its own stdin (a pipe or a pty), so
+// closing stdin of one process does not affect the next one after a restart.
+type stdinRelay struct {
+	sync.Mutex
+	// Input of the current process, nil if there's no process running or
+	// its stdin has been closed.
+	w io.Writer
+	// Signals EOF to the current process.
+	eof func() error
+	// The master side of the pty of the current process, if the unit has
+	// a TTY, and the size of the terminal.
+	tty     *os.File
+	winsize *pty.Winsize
+	// Set once all writers of the stdin pipe are gone. The relay waits for
+	// resume before reading again.
+	closed bool
+	resume chan struct{}
+}
+
+func (r *stdinRelay) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.w == nil {
+		return len(p), nil
+	}
+	_, err := r.w.Write(p)
+	if err != nil {
+		glog.Warningf("writing to stdin of unit: %v", err)
+	}
+	// Errors are not propagated, so the relay keeps going for the next
+	// process.
+	return len(p), nil
+}
+
+// set makes w the input of the current process. eof is called to close it.
+func (r *stdinRelay) set(w io.Writer, eof func() error) {
+	r.Lock()
+	defer r.Unlock()
+	r.w = w
+	r.eof = eof
+}
+
+// closeLocked closes stdin of the current process.
+func (r *stdinRelay) closeLocked() {
+	if r.eof != nil {
+		if err := r.eof(); err != nil {
+			glog.Warningf("closing stdin of unit: %v", err)
+		}
+	}
+	r.w = nil
+	r.eof = nil
+}
+
+func (r *stdinRelay) setTTY(tty *os.File) {
+	r.Lock()
+	defer r.Unlock()
+	r.tty = tty
+	if tty != nil && r.winsize != nil {
+		if err := pty.Setsize(tty, r.winsize); err != nil {
+			glog.Warningf("resizing terminal of unit: %v", err)
+		}
+	}
+}
+
+func (r *stdinRelay) resize(winsize *pty.Winsize) error {
+	r.Lock()
+	defer r.Unlock()
+	r.winsize = winsize
+	if r.tty == nil {
+		return nil
+	}
+	return pty.Setsize(r.tty, winsize)
+}
+
+// run copies unitin to the current process. When unitin reaches EOF, stdin of
+// the current process is closed, and no more data is read until the unit is
+// restarted.
+func (r *stdinRelay) run(unitin io.Reader) {
+	for {
+		_, err := io.Copy(r, unitin)
+		if err != nil {
+			glog.Errorf("reading stdin of unit: %v", err)
+			return
+		}
+		r.Lock()
+		r.closed = true
+		r.closeLocked()
+		r.Unlock()
+		<-r.resume
+	}
+}
+
+// reset is called before a new process of the unit is started. Returns true
+// if the relay has been stopped by EOF, and it needs to be resumed once the
+// stdin pipe has been opened again.
+func (r *stdinRelay) reset() bool {
+	r.Lock()
+	defer r.Unlock()
+	r.w = nil
+	r.eof = nil
+	closed := r.closed
+	r.closed = false
+	return closed
+}
+
+func (u *Unit) createControl() error {
+	pipepath := filepath.Join(u.Directory, "unit-control")
+	err := syscall.Mkfifo(pipepath, 0600)
+	if err != nil && !os.IsExist(err) {
+		glog.Errorf("creating control pipe %s: %v", pipepath, err)
+		return err
+	}
+	u.controlPath = pipepath
+	return nil
+}
+
+// openControl opens the control pipe in the helper. It's opened for writing
+// too, so reads never return EOF when the agent closes its side.
+func (u *Unit) openControl() (*os.File, error) {
+	fp, err := os.OpenFile(u.controlPath, os.O_RDWR, 0600)
+	if err != nil {
+		glog.Errorf("opening control pipe %s: %v", u.controlPath, err)
+		return nil, err
+	}
+	return fp, nil
+}
+
+func (u *Unit) handleControlMessages(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var msg controlMessage
+		err := json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			glog.Warningf("invalid control message for %s: %v", u.Name, err)
+			continue
+		}
+		u.handleControlMessage(msg)
+	}
+	if err := scanner.Err(); err != nil {
+		glog.Errorf("reading control pipe of %s: %v", u.Name, err)
+	}
+}
+
+func (u *Unit) handleControlMessage(msg controlMessage) {
+	if msg.Resize != nil {
+		glog.V(2).Infof("resizing terminal of %s to %+v", u.Name, *msg.Resize)
+		err := u.stdin.resize(msg.Resize)
+		if err != nil {
+			glog.Warningf("resizing terminal of %s: %v", u.Name, err)
+		}
+	}
+	if msg.CloseStdin {
+		glog.Infof("closing stdin of %s", u.Name)
+		u.closeStdin()
+	}
+}
+
+// sendControlMessage is used by the agent to send a message to the helper.
+// It fails if the helper is not running.
+func (u *Unit) sendControlMessage(msg controlMessage) error {
+	buf, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(u.controlPath, os.O_WRONLY|syscall.O_NONBLOCK, 0600)
+	if err != nil {
+		return fmt.Errorf("opening control pipe of unit %s: %v", u.Name, err)
+	}
+	defer fp.Close()
+	// Messages are small enough to be written atomically.
+	_, err = fp.Write(append(buf, '\n'))
+	if err != nil {
+		return fmt.Errorf("writing control pipe of unit %s: %v", u.Name, err)
+	}
+	return nil
+}
+
+// CloseStdin asks the helper to close stdin of the unit, after everything
+// written to it so far has been read. Writers of stdin need to be closed
+// before the process of the unit gets EOF.
+func (u *Unit) CloseStdin() error {
+	return u.sendControlMessage(controlMessage{CloseStdin: true})
+}
+
+// ResizeTerminal resizes the terminal of a unit that has a TTY.
+func (u *Unit) ResizeTerminal(rows, cols uint16) error {
+	return u.sendControlMessage(controlMessage{
+		Resize: &pty.Winsize{Rows: rows, Cols: cols},
+	})
+}
+
+// HasStdin returns whether the unit accepts input via attach.
+func (u *Unit) HasStdin() bool {
+	return u.unitConfig.Stdin
+}
+
+// IsStdinOnce returns whether stdin of the unit is closed after the first
+// attach session.
+func (u *Unit) IsStdinOnce() bool {
+	return u.unitConfig.StdinOnce
+}
+
+// IsTTY returns whether the unit runs with a terminal.
+func (u *Unit) IsTTY() bool {
+	return u.unitConfig.TTY
+}
+
+// processStdio is the stdio of one process of the unit.
+type processStdio struct {
+	relay *stdinRelay
+	// Our copies of the files passed to the process.
+	childFiles []*os.File
+	// The input side of the stdin pipe of the process.
+	stdinWriter *os.File
+}
+
+// started closes our copies of the files passed to the process, once it has
+// been started.
+func (s *processStdio) started() {
+	for _, f := range s.childFiles {
+		f.Close()
+	}
+	s.childFiles = nil
+}
+
+// exited is called once the process has exited.
+func (s *processStdio) exited() {
+	s.started()
+	s.relay.set(nil, nil)
+	s.relay.setTTY(nil)
+	if s.stdinWriter != nil {
+		s.stdinWriter.Close()
+	}
+}
+
+// setupStdio connects stdin, and if the unit has a TTY, stdout and stderr of
+// cmd for a new process of the unit. Output from the terminal is copied to
+// unitout.
+func (u *Unit) setupStdio(cmd *exec.Cmd, unitout io.Writer) (*processStdio, error) {
+	stdio := &processStdio{relay: &u.stdin}
+	if u.unitConfig.TTY {
+		err := u.setupTTY(cmd, unitout, stdio)
+		if err != nil {
+			return nil, err
+		}
+		return stdio, nil
+	}
+	cmd.Stdin = nil
+	if !u.unitConfig.Stdin {
+		return stdio, nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating stdin pipe: %v", err)
+	}
+	cmd.Stdin = r
+	stdio.childFiles = append(stdio.childFiles, r)
+	stdio.stdinWriter = w
+	u.stdin.set(w, w.Close)
+	return stdio, nil
+}
+
+func (u *Unit) setupTTY(cmd *exec.Cmd, unitout io.Writer, stdio *processStdio) error {
+	master, slave, err := pty.Open()
+	if err != nil {
+		return fmt.Errorf("allocating pty: %v", err)
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	// The pty becomes the controlling terminal of the process, in a new
+	// session. Ctty refers to fd 0 in the child.
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+	stdio.childFiles = append(stdio.childFiles, slave)
+	u.stdin.setTTY(master)
+	if u.unitConfig.Stdin {
+		u.stdin.set(master, func() error {
+			_, err := master.Write([]byte{ttyEOF})
+			return err
+		})
+	}
+	// Once the process and its children have closed the slave side,
+	// reading the master fails with EIO, which ends the copy.
+	if u.outputTail != nil {
+		u.outputTail.copy(master, unitout)
+	} else {
+		go func() {
+			defer master.Close()
+			io.Copy(unitout, master)
+		}()
+	}
+	return nil
+}
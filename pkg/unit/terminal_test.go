@@ -0,0 +1,209 @@
+// +build !darwin
+
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unit
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elotl/itzo/pkg/api"
+	"github.com/kr/pty"
+	"github.com/stretchr/testify/assert"
+)
+
+// lockedBuffer is written by the goroutines copying output of the unit.
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func waitForOutput(t *testing.T, b *lockedBuffer, expected string) bool {
+	start := time.Now()
+	for !strings.Contains(b.String(), expected) {
+		if time.Since(start) > 5*time.Second {
+			return assert.Fail(t, "timed out waiting for output",
+				"expected %q in %q", expected, b.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func TestUnitStdinDisabled(t *testing.T) {
+	u, closer := mkTestUnit(t)
+	defer closer()
+	inr, err := u.OpenStdinReader()
+	assert.NoError(t, err)
+	inw, err := u.OpenStdinWriter()
+	assert.NoError(t, err)
+	defer inw.Close()
+	_, err = inw.Write([]byte("ignored\n"))
+	assert.NoError(t, err)
+	var stdout bytes.Buffer
+	err = u.RunUnitLoop(
+		[]string{"cat", "-"},
+		nil, 0, 0, nil, inr, &stdout, nil, api.RestartPolicyNever)
+	assert.NoError(t, err)
+	assert.Equal(t, "", stdout.String())
+}
+
+func TestUnitStdinOnce(t *testing.T) {
+	u, closer := mkTestUnit(t)
+	defer closer()
+	u.unitConfig.Stdin = true
+	u.unitConfig.StdinOnce = true
+	u.unitConfig.RestartBackoff = api.RestartBackoff{
+		Base: 10 * time.Millisecond,
+		Max:  10 * time.Millisecond,
+	}
+	marker := u.Directory + "/marker"
+	inr, err := u.OpenStdinReader()
+	assert.NoError(t, err)
+	stdout := &lockedBuffer{}
+	ch := make(chan error, 1)
+	go func() {
+		// Fails the first time, so it gets restarted.
+		ch <- u.RunUnitLoop(
+			[]string{"sh", "-c", "cat; [ -f " + marker + " ] && exit 0; touch " + marker + "; exit 1"},
+			nil, 0, 0, nil, inr, stdout, nil, api.RestartPolicyOnFailure)
+	}()
+	for _, input := range []string{"one\n", "two\n"} {
+		inw, err := u.OpenStdinWriter()
+		assert.NoError(t, err)
+		_, err = inw.Write([]byte(input))
+		assert.NoError(t, err)
+		assert.NoError(t, inw.Close())
+		// End of the attach session.
+		u.handleControlMessage(controlMessage{CloseStdin: true})
+		if !waitForOutput(t, stdout, input) {
+			return
+		}
+		if input == "one\n" {
+			// Stdin is open again after the restart.
+			start := time.Now()
+			for {
+				status, err := u.GetStatus()
+				assert.NoError(t, err)
+				if status.RestartCount == 1 && status.State.Running != nil {
+					break
+				}
+				if time.Since(start) > 5*time.Second {
+					assert.Fail(t, "timed out waiting for restart")
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+	select {
+	case err = <-ch:
+		assert.NoError(t, err)
+		assert.Equal(t, "one\ntwo\n", stdout.String())
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "timed out waiting for process")
+	}
+}
+
+func TestUnitTTY(t *testing.T) {
+	u, closer := mkTestUnit(t)
+	defer closer()
+	u.unitConfig.TTY = true
+	// The size is applied to the terminal when the process is started.
+	u.handleControlMessage(controlMessage{
+		Resize: &pty.Winsize{Rows: 30, Cols: 100},
+	})
+	stdout := &lockedBuffer{}
+	err := u.RunUnitLoop(
+		[]string{"sh", "-c", "tty >/dev/null && stty size"},
+		nil, 0, 0, nil, nil, stdout, nil, api.RestartPolicyNever)
+	assert.NoError(t, err)
+	waitForOutput(t, stdout, "30 100\r\n")
+}
+
+func TestUnitTTYStdin(t *testing.T) {
+	u, closer := mkTestUnit(t)
+	defer closer()
+	u.unitConfig.Stdin = true
+	u.unitConfig.TTY = true
+	inr, err := u.OpenStdinReader()
+	assert.NoError(t, err)
+	inw, err := u.OpenStdinWriter()
+	assert.NoError(t, err)
+	defer inw.Close()
+	stdout := &lockedBuffer{}
+	ch := make(chan error, 1)
+	go func() {
+		ch <- u.RunUnitLoop(
+			[]string{"sh", "-c", "read line; echo got $line"},
+			nil, 0, 0, nil, inr, stdout, nil, api.RestartPolicyNever)
+	}()
+	_, err = inw.Write([]byte("hello\n"))
+	assert.NoError(t, err)
+	select {
+	case err = <-ch:
+		assert.NoError(t, err)
+		waitForOutput(t, stdout, "got hello\r\n")
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "timed out waiting for process")
+	}
+}
+
+func TestControlMessages(t *testing.T) {
+	u, closer := mkTestUnit(t)
+	defer closer()
+	// The helper is not running.
+	err := u.ResizeTerminal(30, 100)
+	assert.Error(t, err)
+	ctl, err := u.openControl()
+	assert.NoError(t, err)
+	defer ctl.Close()
+	go u.handleControlMessages(ctl)
+	err = u.ResizeTerminal(30, 100)
+	assert.NoError(t, err)
+	start := time.Now()
+	for {
+		u.stdin.Lock()
+		winsize := u.stdin.winsize
+		u.stdin.Unlock()
+		if winsize != nil {
+			assert.Equal(t, pty.Winsize{Rows: 30, Cols: 100}, *winsize)
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			assert.Fail(t, "timed out waiting for control message")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
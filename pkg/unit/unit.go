@@ -19,39 +19,55 @@ limitations under the License.
 package unit
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 	"time"
 
-	"github.com/containerd/cgroups"
 	"github.com/elotl/itzo/pkg/api"
 	"github.com/elotl/itzo/pkg/caps"
+	"github.com/elotl/itzo/pkg/cgroup"
+	"github.com/elotl/itzo/pkg/events"
 	"github.com/elotl/itzo/pkg/helper"
 	"github.com/elotl/itzo/pkg/host"
 	imagecli "github.com/elotl/itzo/pkg/image"
 	"github.com/elotl/itzo/pkg/mount"
 	"github.com/elotl/itzo/pkg/prober"
+	"github.com/elotl/itzo/pkg/seccomp"
 	"github.com/elotl/itzo/pkg/util"
 	"github.com/elotl/itzo/pkg/util/kill"
 	"github.com/golang/glog"
 	sysctl "github.com/lorenzosaino/go-sysctl"
-	"github.com/opencontainers/runtime-spec/specs-go"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/syndtr/gocapability/capability"
+	"golang.org/x/net/bpf"
 	"golang.org/x/sys/unix"
 )
 
 const (
+	INITIAL_BACKOFF_TIME                 = 1 * time.Second
 	MAX_BACKOFF_TIME                     = 5 * time.Minute
 	BACKOFF_RESET_TIME                   = 10 * time.Minute
 	CHILD_OOM_SCORE                      = 15 // chosen arbitrarily... kernel will adjust this value
 	MaxContainerTerminationMessageLength = 1024 * 4
+	// Limits on the output used as the termination message with the
+	// FallbackToLogsOnError policy.
+	MaxContainerTerminationMessageLogLines = 80
+	// How long to wait for the output of a unit to be drained after it
+	// exited.
+	logTailTimeout = 2 * time.Second
+
+	statusLockTimeout       = 2 * time.Second
+	statusLockRetryInterval = 10 * time.Millisecond
 )
 
 var (
@@ -77,7 +93,7 @@ var (
 		"CAP_SETUID",
 		"CAP_SYS_CHROOT",
 	}
-	sleep = time.Sleep // Allow time.Sleep() to be mocked out in tests.
+	backOffTimer = time.After // Allow restart delays to be mocked out in tests.
 )
 
 // This is part of the config of docker images.
@@ -128,18 +144,65 @@ type UnitConfig struct {
 	TerminationMessagePath   string
 	PodIP                    string
 	UseOverlayfs             bool
+	// Seconds the unit is given to exit after it has been asked to stop,
+	// if it's set explicitly for the unit.
+	TerminationGracePeriodSeconds *int64 `json:",omitempty"`
+	// Pod level grace period, used if the unit doesn't specify one. It
+	// takes precedence over the StopTimeout of the image.
+	PodTerminationGracePeriodSeconds *int64 `json:",omitempty"`
+	// Signal overriding the StopSignal of the image.
+	StopSignal string `json:",omitempty"`
+	// PostStart and PreStop hooks of the unit.
+	Lifecycle *api.Lifecycle `json:",omitempty"`
+	// Resource requests and limits, applied via the cgroups of the unit.
+	Resources api.ResourceRequirements
+	// Backoff between restarts, zero values mean the defaults.
+	RestartBackoff api.RestartBackoff
+	// Seccomp profile of the unit, the one in the security context of the
+	// unit overriding the pod level one.
+	SeccompProfile *api.SeccompProfile `json:",omitempty"`
+	// Profile loaded from the package referenced in a Localhost profile.
+	// The helper can't access packages once it's in the rootfs of the unit.
+	SeccompLocalhostProfile *specs.LinuxSeccomp `json:",omitempty"`
+	// Resource limits of the unit, including the defaults of itzo.
+	Rlimits []api.Rlimit `json:",omitempty"`
+	// Whether the unit gets input via attach, whether stdin is closed
+	// after the first attach session, and whether it runs with a TTY.
+	Stdin     bool `json:",omitempty"`
+	StdinOnce bool `json:",omitempty"`
+	TTY       bool `json:",omitempty"`
 }
 
 type Unit struct {
 	*LogPipe
-	Directory   string
-	Name        string
-	Image       string
-	statusPath  string
-	config      *Config
-	unitConfig  UnitConfig
-	stdinPath   string
-	stdinCloser chan struct{}
+	Directory  string
+	Name       string
+	Image      string
+	statusPath string
+	config     *Config
+	unitConfig UnitConfig
+	stdinPath  string
+	// Helper side of stdin: the reader passed to the unit, our writer that
+	// keeps it from reaching EOF, and the relay to the current process.
+	stdinReader *os.File
+	stdinHold   *os.File
+	stdin       stdinRelay
+	controlPath string
+	// The helper receives SIGTERM on this channel when the unit needs to
+	// be stopped.
+	stopChan    chan os.Signal
+	stopping    bool
+	forceKilled bool
+	preStopErr  error
+	// The cgroup of the unit, and its OOM kill counter when the current
+	// process of the unit was started (nil if unknown).
+	control      cgroup.Cgroup
+	oomKillCount *uint64
+	// Recent output of the unit, if its termination message policy is
+	// FallbackToLogsOnError.
+	outputTail *logTail
+	// Kept open by the helper, see openEventsFile().
+	eventsFile *os.File
 }
 
 func IsUnitExist(rootdir, name string) bool {
@@ -177,6 +240,11 @@ func OpenUnit(rootdir, name string) (*Unit, error) {
 		lp.Remove()
 		return nil, err
 	}
+	err = u.createControl()
+	if err != nil {
+		lp.Remove()
+		return nil, err
+	}
 	u.config, err = u.getConfig()
 	if err != nil && !os.IsNotExist(err) {
 		glog.Warningf("getting unit %q config: %v", name, err)
@@ -200,6 +268,56 @@ func (u *Unit) SetUnitConfigOverlayfs(useOverlayfs bool) {
 	u.unitConfig.UseOverlayfs = useOverlayfs
 }
 
+// GetRlimits returns the resource limits of the processes of the unit.
+func (u *Unit) GetRlimits() []api.Rlimit {
+	return u.unitConfig.Rlimits
+}
+
+// GetNamespaceModes returns whether the unit gets its own PID and IPC
+// namespaces, or uses the ones of the pod or of the node.
+func (u *Unit) GetNamespaceModes() (pid, ipc api.NamespaceMode) {
+	sc := &u.unitConfig.PodSecurityContext
+	return api.GetPidNamespaceMode(sc), api.GetIpcNamespaceMode(sc)
+}
+
+// GetTerminationGracePeriod returns how long the unit is allowed to take to
+// shut down after it has been sent its stop signal. A grace period set on the
+// unit takes precedence over the grace period of the pod. The StopTimeout of
+// the image is only used if neither of them is set.
+func (u *Unit) GetTerminationGracePeriod() time.Duration {
+	seconds := api.DefaultTerminationGracePeriodSeconds
+	if u.unitConfig.TerminationGracePeriodSeconds != nil {
+		seconds = *u.unitConfig.TerminationGracePeriodSeconds
+	} else if u.unitConfig.PodTerminationGracePeriodSeconds != nil {
+		seconds = *u.unitConfig.PodTerminationGracePeriodSeconds
+	} else if u.config != nil && u.config.StopTimeout != nil {
+		seconds = int64(*u.config.StopTimeout)
+	}
+	if seconds < 0 {
+		seconds = 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// GetStopSignal returns the signal used to ask the unit to shut down: the one
+// set on the unit, the StopSignal of the image, or SIGTERM.
+func (u *Unit) GetStopSignal() syscall.Signal {
+	stopSignal := u.unitConfig.StopSignal
+	if stopSignal == "" && u.config != nil {
+		stopSignal = u.config.StopSignal
+	}
+	if stopSignal == "" {
+		return syscall.SIGTERM
+	}
+	sig, err := kill.ParseSignal(stopSignal)
+	if err != nil {
+		glog.Warningf("%s invalid stop signal %q, using SIGTERM: %v",
+			u.Name, stopSignal, err)
+		return syscall.SIGTERM
+	}
+	return sig
+}
+
 func (u *Unit) createStdin() error {
 	pipepath := filepath.Join(u.Directory, "unit-stdin")
 	err := syscall.Mkfifo(pipepath, 0600)
@@ -208,31 +326,24 @@ func (u *Unit) createStdin() error {
 		return err
 	}
 	u.stdinPath = pipepath
-	u.stdinCloser = make(chan struct{})
 	return nil
 }
 
-// This is only used internally to pass in an io.Reader to the process as its
-// stdin. We also start a writer so that opening the pipe for reading won't
-// block. This writer will be stopped via closeStdin().
+// OpenStdinReader opens the stdin pipe of the unit in the helper. The pipe is
+// also held open for writing, so reading it only returns EOF once this writer
+// has been closed via closeStdin(), and there are no other writers left.
 func (u *Unit) OpenStdinReader() (io.ReadCloser, error) {
-	go func() {
-		wfp, err := os.OpenFile(u.stdinPath, os.O_WRONLY, 0200)
-		if err != nil {
-			glog.Errorf("opening stdin pipe %s: %v", u.stdinPath, err)
-		} else {
-			defer wfp.Close()
-		}
-		select {
-		case _ = <-u.stdinCloser:
-			break
-		}
-	}()
-	fp, err := os.OpenFile(u.stdinPath, os.O_RDONLY, 0400)
+	fp, err := os.OpenFile(u.stdinPath, os.O_RDONLY|syscall.O_NONBLOCK, 0400)
 	if err != nil {
 		glog.Errorf("opening stdin pipe %s: %v", u.stdinPath, err)
 		return nil, err
 	}
+	err = u.holdStdin(u.stdinPath)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	u.stdinReader = fp
 	return fp, nil
 }
 
@@ -245,12 +356,48 @@ func (u *Unit) OpenStdinWriter() (io.WriteCloser, error) {
 	return fp, nil
 }
 
+func (u *Unit) holdStdin(path string) error {
+	fp, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0200)
+	if err != nil {
+		glog.Errorf("opening stdin pipe %s: %v", path, err)
+		return err
+	}
+	u.stdin.Lock()
+	defer u.stdin.Unlock()
+	u.stdinHold = fp
+	return nil
+}
+
+// reopenStdin holds stdin open again after it has been closed, for the next
+// process of the unit. The pipe is outside of the rootfs of the unit, so it's
+// reopened via the file descriptor of the reader.
+func (u *Unit) reopenStdin() error {
+	if u.stdinReader == nil {
+		return fmt.Errorf("stdin of unit %s is not open", u.Name)
+	}
+	conn, err := u.stdinReader.SyscallConn()
+	if err != nil {
+		return err
+	}
+	path := ""
+	err = conn.Control(func(fd uintptr) {
+		path = fmt.Sprintf("/proc/self/fd/%d", fd)
+	})
+	if err != nil {
+		return err
+	}
+	return u.holdStdin(path)
+}
+
 func (u *Unit) closeStdin() {
-	select {
-	case u.stdinCloser <- struct{}{}:
-	default:
+	u.stdin.Lock()
+	defer u.stdin.Unlock()
+	if u.stdinHold == nil {
 		glog.Warningf("stdin for unit %s has already been closed", u.Name)
+		return
 	}
+	u.stdinHold.Close()
+	u.stdinHold = nil
 }
 
 func (u *Unit) getUnitConfig() (UnitConfig, error) {
@@ -341,12 +488,9 @@ func (u *Unit) GetWorkingDir() string {
 
 func (u *Unit) SetImage(image string) error {
 	u.Image = image
-	status, err := u.GetStatus()
-	if err != nil {
-		return err
-	}
-	status.Image = u.Image
-	return u.SetStatus(status)
+	return u.updateStatus(func(status *api.UnitStatus) {
+		status.Image = u.Image
+	})
 }
 
 func (u *Unit) Destroy() error {
@@ -399,6 +543,25 @@ func (u *Unit) PullAndExtractImage(image, server, username, password string) err
 	return nil
 }
 
+// FetchImage pulls an image without creating a unit for it, saving its config
+// to configPath. It's used to make sure an image can be pulled, and to have
+// its layers cached, before tearing down the unit it's replacing.
+func FetchImage(image, server, username, password, configPath string) error {
+	glog.Infof("fetching image %s", image)
+	cli := imagecli.NewTosi()
+	if username != "" || password != "" {
+		err := cli.Login(server, username, password)
+		if err != nil {
+			return err
+		}
+	}
+	err := cli.Pull(server, image)
+	if err != nil {
+		return err
+	}
+	return cli.Fetch(image, configPath)
+}
+
 func (u *Unit) GetUser(lookup util.UserLookup) (uid, gid uint32, groups []uint32, homedir string, err error) {
 	homedir = "/"
 	// Check the image config for user/group.
@@ -453,36 +616,104 @@ func (u *Unit) copyFileFromHost(hostpath string, overwrite bool) error {
 	return nil
 }
 
-func (u *Unit) SetStatus(status *api.UnitStatus) error {
+// The status file of a unit is written by the unit helper process and read by
+// the agent, and it is bind mounted into the rootfs of the unit. Since the
+// file has to stay in place for the bind mount, access is serialized via
+// flock() on the status file itself: writers take an exclusive lock for the
+// whole read-modify-write cycle, and readers a shared one.
+func lockStatusFile(f *os.File, how int) error {
+	// Processes in the unit can see the status file too, don't wait forever
+	// on a lock we don't control.
+	deadline := time.Now().Add(statusLockTimeout)
+	for {
+		err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+		if err != unix.EWOULDBLOCK {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for lock on %s", f.Name())
+		}
+		time.Sleep(statusLockRetryInterval)
+	}
+}
+
+func unlockStatusFile(f *os.File) {
+	unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
+
+func (u *Unit) readStatus(f *os.File) (*api.UnitStatus, error) {
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		glog.Errorf("reading statusfile for %s\n", u.Name)
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return api.MakeStillCreatingStatus(u.Name, u.Image, "PodInitializing"), nil
+	}
+	var status api.UnitStatus
+	err = json.Unmarshal(buf, &status)
+	return &status, err
+}
+
+func (u *Unit) writeStatus(f *os.File, status *api.UnitStatus) error {
 	buf, err := json.Marshal(status)
 	if err != nil {
 		glog.Errorf("serializing status for %s\n", u.Name)
 		return err
 	}
-	if err := ioutil.WriteFile(u.statusPath, buf, 0600); err != nil {
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt(buf, 0)
+	}
+	if err != nil {
 		glog.Errorf("updating statusfile for %s\n", u.Name)
 		return err
 	}
 	return nil
 }
 
-func (u *Unit) UpdateStatusAttr(ready, started *bool) error {
-	status, err := u.GetStatus()
+// updateStatus applies update to the current status of the unit, and saves
+// the result while holding the lock on the status file.
+func (u *Unit) updateStatus(update func(status *api.UnitStatus)) error {
+	f, err := os.OpenFile(u.statusPath, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
-		glog.Errorf("getting current status for %s\n", u.Name)
+		glog.Errorf("opening statusfile for %s: %v", u.Name, err)
 		return err
 	}
-	if ready != nil {
-		status.Ready = *ready
+	defer f.Close()
+	if err := lockStatusFile(f, unix.LOCK_EX); err != nil {
+		glog.Errorf("locking statusfile for %s: %v", u.Name, err)
+		return err
 	}
-	if started != nil {
-		status.Started = started
+	defer unlockStatusFile(f)
+	status, err := u.readStatus(f)
+	if err != nil {
+		glog.Errorf("getting current status for %s\n", u.Name)
+		return err
 	}
-	return u.SetStatus(status)
+	update(status)
+	return u.writeStatus(f, status)
+}
+
+func (u *Unit) SetStatus(status *api.UnitStatus) error {
+	return u.updateStatus(func(s *api.UnitStatus) {
+		*s = *status
+	})
+}
+
+func (u *Unit) UpdateStatusAttr(ready, started *bool) error {
+	return u.updateStatus(func(status *api.UnitStatus) {
+		if ready != nil {
+			status.Ready = *ready
+		}
+		if started != nil {
+			status.Started = started
+		}
+	})
 }
 
 func (u *Unit) GetStatus() (*api.UnitStatus, error) {
-	buf, err := ioutil.ReadFile(u.statusPath)
+	f, err := os.Open(u.statusPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return api.MakeStillCreatingStatus(u.Name, u.Image, "PodInitializing"), nil
@@ -490,55 +721,215 @@ func (u *Unit) GetStatus() (*api.UnitStatus, error) {
 		glog.Errorf("reading statusfile for %s\n", u.Name)
 		return nil, err
 	}
-	var status api.UnitStatus
-	err = json.Unmarshal(buf, &status)
-	return &status, err
+	defer f.Close()
+	if err := lockStatusFile(f, unix.LOCK_SH); err != nil {
+		glog.Warningf("locking statusfile for %s: %v", u.Name, err)
+	} else {
+		defer unlockStatusFile(f)
+	}
+	return u.readStatus(f)
 }
 
 func (u *Unit) SetState(state api.UnitState, restarts *int) error {
 	// Check current status, and update status.State. Name and Image are
 	// immutable, and RestartCount is kept up to date automatically here.
 	// pass in a nil pointer to restarts to not update that value
-	status, err := u.GetStatus()
-	if err != nil {
-		glog.Errorf("getting current status for %s\n", u.Name)
-		return err
-	}
 	glog.V(5).Infof("updating state of unit '%s' to %v\n", u.Name, state)
-	status.State = state
-	if status.State.Terminated != nil {
-		status.LastTerminationState = state
+	return u.updateStatus(func(status *api.UnitStatus) {
+		// Once the unit moves on from a terminated state, that becomes its
+		// last termination state.
+		if status.State.Terminated != nil && state.Terminated == nil {
+			status.LastTerminationState = status.State
+		}
+		status.State = state
+		if restarts != nil && *restarts >= 0 {
+			status.RestartCount = int32(*restarts)
+		}
+	})
+}
+
+// getRestartBackoff returns the initial delay, the maximum delay and the reset
+// window for restarting the unit.
+func (u *Unit) getRestartBackoff() (base, max, reset time.Duration) {
+	base, max, reset = INITIAL_BACKOFF_TIME, MAX_BACKOFF_TIME, BACKOFF_RESET_TIME
+	rb := u.unitConfig.RestartBackoff
+	if rb.Base > 0 {
+		base = rb.Base
+	}
+	if rb.Max > 0 {
+		max = rb.Max
 	}
-	if restarts != nil && *restarts >= 0 {
-		status.RestartCount = int32(*restarts)
+	if max < base {
+		max = base
 	}
-	return u.SetStatus(status)
+	if rb.Reset > 0 {
+		reset = rb.Reset
+	}
+	return base, max, reset
 }
 
-func maybeBackOff(err error, command []string, backoff *time.Duration, runningTime time.Duration) {
-	if err == nil || runningTime >= BACKOFF_RESET_TIME {
+// maybeBackOff waits before the unit is restarted. Returns false if the unit
+// has been stopped in the meantime.
+func (u *Unit) maybeBackOff(err error, command []string, backoff *time.Duration, runningTime time.Duration) bool {
+	base, max, reset := u.getRestartBackoff()
+	if err == nil || runningTime >= reset {
 		// Reset backoff.
-		*backoff = 1 * time.Second
+		*backoff = base
 	} else {
 		*backoff *= 2
-		if *backoff > MAX_BACKOFF_TIME {
-			*backoff = MAX_BACKOFF_TIME
+		if *backoff < base {
+			*backoff = base
+		}
+		if *backoff > max {
+			*backoff = max
 		}
 	}
 	glog.Infof("waiting for %v before starting %s again", *backoff, command[0])
-	sleep(*backoff)
+	if err != nil {
+		u.RecordEvent(api.EventTypeWarning, events.BackOffStartUnit,
+			"Back-off restarting failed unit")
+	}
+	u.setBackOffState(*backoff, time.Now().Add(*backoff))
+	select {
+	case <-backOffTimer(*backoff):
+		return true
+	case <-u.stopChan:
+		glog.Infof("%s has been stopped while waiting to be restarted", command[0])
+		u.stopping = true
+		u.setStoppedState()
+		return false
+	}
+}
+
+// setStoppedState marks the unit as terminated after it has been stopped
+// while waiting to be restarted. Its last exit is its final state, unless it
+// could not be started.
+func (u *Unit) setStoppedState() {
+	err := u.updateStatus(func(status *api.UnitStatus) {
+		waiting := status.State.Waiting
+		if waiting == nil {
+			return
+		}
+		last := status.LastTerminationState.Terminated
+		var terminated api.UnitStateTerminated
+		if last != nil && !waiting.StartFailure {
+			terminated = *last
+		} else {
+			terminated = api.UnitStateTerminated{
+				ExitCode:   128,
+				FinishedAt: api.Now(),
+				Reason:     "StartError",
+				Message:    waiting.Reason,
+			}
+		}
+		status.State = api.UnitState{Terminated: &terminated}
+	})
+	if err != nil {
+		glog.Warningf("updating status of %s: %v", u.Name, err)
+	}
+}
+
+// setBackOffState marks the unit as waiting to be restarted. Start failures
+// keep their own waiting state, so that the reason for the failure is not
+// lost.
+func (u *Unit) setBackOffState(backoff time.Duration, next time.Time) {
+	msg := fmt.Sprintf("back-off %v restarting failed unit %s, next restart at %s",
+		backoff, u.Name, next.UTC().Format(time.RFC3339))
+	err := u.updateStatus(func(status *api.UnitStatus) {
+		if status.State.Waiting != nil && status.State.Waiting.StartFailure {
+			return
+		}
+		if status.State.Terminated != nil {
+			status.LastTerminationState = status.State
+		}
+		status.State = api.UnitState{
+			Waiting: &api.UnitStateWaiting{
+				Reason:  "CrashLoopBackOff",
+				Message: msg,
+			},
+		}
+	})
+	if err != nil {
+		glog.Warningf("updating status of %s: %v", u.Name, err)
+	}
+}
+
+// getSeccompProfile returns the seccomp profile to apply to the unit, or nil
+// if the unit is unconfined. Privileged units are always unconfined.
+func (u *Unit) getSeccompProfile(caplist []string) (*specs.LinuxSeccomp, error) {
+	profile := u.unitConfig.SeccompProfile
+	if profile == nil || u.isPrivileged() {
+		return nil, nil
+	}
+	switch profile.Type {
+	case api.SeccompProfileTypeUnconfined:
+		return nil, nil
+	case api.SeccompProfileTypeRuntimeDefault:
+		return seccomp.DefaultProfile(caplist), nil
+	case api.SeccompProfileTypeLocalhost:
+		if u.unitConfig.SeccompLocalhostProfile == nil {
+			return nil, fmt.Errorf("missing localhost seccomp profile")
+		}
+		return u.unitConfig.SeccompLocalhostProfile, nil
+	}
+	return nil, fmt.Errorf("invalid seccomp profile type %q", profile.Type)
+}
+
+// getSeccompFilter builds the seccomp filter of the unit, or returns nil if
+// the unit is unconfined. The filter is installed by the shim right before it
+// executes the command, so hooks and exec probes run via the helper are not
+// confined by it.
+func (u *Unit) getSeccompFilter(caplist []string) ([]bpf.RawInstruction, error) {
+	profile, err := u.getSeccompProfile(caplist)
+	if err != nil || profile == nil {
+		return nil, err
+	}
+	return seccomp.BuildFilter(profile)
 }
 
 func (u *Unit) RunUnitLoop(command, caplist []string, uid, gid uint32, groups []uint32, unitin io.Reader, unitout, uniterr io.Writer, policy api.RestartPolicy) (err error) {
+	filter, err := u.getSeccompFilter(caplist)
+	if err != nil {
+		u.setStateToStartFailure(err)
+		glog.Errorf("building seccomp filter for %s: %v", u.Name, err)
+		return err
+	}
+	if u.noNewPrivs() {
+		// The flag is per thread, and is inherited by the processes started
+		// from it. The thread is never unlocked, so it's not reused once
+		// the loop returns.
+		runtime.LockOSThread()
+		err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+		if err != nil {
+			u.setStateToStartFailure(err)
+			glog.Errorf("setting no_new_privs for %s: %v", u.Name, err)
+			return err
+		}
+	}
 	falseval := false
-	backoff := 1 * time.Second
+	backoff, _, _ := u.getRestartBackoff()
 	restarts := -1
+	// The unit manager sends SIGTERM to the helper when the unit is
+	// stopped. It is then forwarded to the process tree of the unit.
+	u.stopChan = make(chan os.Signal, 1)
+	signal.Notify(u.stopChan, syscall.SIGTERM)
+	defer signal.Stop(u.stopChan)
+	if u.unitConfig.Stdin && unitin != nil {
+		u.stdin.resume = make(chan struct{})
+		go u.stdin.run(unitin)
+	}
 	for {
 		restarts++
 		startTime := time.Now()
+		if u.stdin.reset() {
+			// Stdin has been closed for the previous process.
+			if err := u.reopenStdin(); err != nil {
+				glog.Warningf("reopening stdin of %s: %v", u.Name, err)
+			}
+			u.stdin.resume <- struct{}{}
+		}
 		cmd := exec.Command(command[0], command[1:]...)
 		cmd.Env = os.Environ()
-		cmd.Stdin = unitin
 		cmd.Stdout = unitout
 		cmd.Stderr = uniterr
 		cmd.SysProcAttr = &syscall.SysProcAttr{}
@@ -547,7 +938,9 @@ func (u *Unit) RunUnitLoop(command, caplist []string, uid, gid uint32, groups []
 			if err != nil {
 				u.setStateToStartFailure(err)
 				glog.Errorf("setting capabilities %v: %v", caplist, err)
-				maybeBackOff(err, command, &backoff, 0*time.Second)
+				if !u.maybeBackOff(err, command, &backoff, 0*time.Second) {
+					return nil
+				}
 				continue
 			}
 			cmd.SysProcAttr.AmbientCaps = mapUintptrCapabilities(caplist)
@@ -560,8 +953,34 @@ func (u *Unit) RunUnitLoop(command, caplist []string, uid, gid uint32, groups []
 			}
 		}
 		u.UpdateStatusAttr(&falseval, &falseval)
-		err = cmd.Start()
+		u.oomKillCount = nil
+		if count, ok := u.getOOMKillCount(); ok {
+			u.oomKillCount = &count
+		}
+		u.outputTail = nil
+		if u.unitConfig.TerminationMessagePolicy == api.TerminationMessageFallbackToLogsOnError {
+			u.captureOutput(cmd, unitout, uniterr)
+		}
+		stdio, err := u.setupStdio(cmd, unitout)
+		if err != nil {
+			u.setStateToStartFailure(err)
+			glog.Errorf("setting up stdio for %s: %v", u.Name, err)
+			if u.outputTail != nil {
+				u.outputTail.closeWriters()
+			}
+			if !u.maybeBackOff(err, command, &backoff, 0*time.Second) {
+				return nil
+			}
+			continue
+		}
+		err = u.startCmd(cmd, filter)
+		// The process has its own copies of the pipes now.
+		stdio.started()
+		if u.outputTail != nil {
+			u.outputTail.closeWriters()
+		}
 		if err != nil {
+			stdio.exited()
 			// Start() failed, it is either an error looking up the executable,
 			// or a resource allocation problem.
 			u.SetState(api.UnitState{
@@ -571,7 +990,11 @@ func (u *Unit) RunUnitLoop(command, caplist []string, uid, gid uint32, groups []
 				},
 			}, &restarts)
 			glog.Errorf("starting %s: %v", command[0], err)
-			maybeBackOff(err, command, &backoff, 0*time.Second)
+			u.RecordEvent(api.EventTypeWarning, events.FailedToStartUnit,
+				fmt.Sprintf("Error: %v", err))
+			if !u.maybeBackOff(err, command, &backoff, 0*time.Second) {
+				return nil
+			}
 			continue
 		}
 		u.SetState(api.UnitState{
@@ -579,6 +1002,8 @@ func (u *Unit) RunUnitLoop(command, caplist []string, uid, gid uint32, groups []
 				StartedAt: api.Now(),
 			},
 		}, &restarts)
+		u.RecordEvent(api.EventTypeNormal, events.StartedUnit,
+			fmt.Sprintf("Started unit %s", u.Name))
 		if cmd.Process != nil {
 			glog.V(5).Infof("command %s running as pid %d", command[0], cmd.Process.Pid)
 			err := util.SetOOMScore(cmd.Process.Pid, CHILD_OOM_SCORE)
@@ -588,13 +1013,126 @@ func (u *Unit) RunUnitLoop(command, caplist []string, uid, gid uint32, groups []
 		} else {
 			glog.Warningf("command %s has nil process", command[0])
 		}
-		cmdErr, probeErr := u.watchRunningCmd(cmd, u.unitConfig.StartupProbe, u.unitConfig.ReadinessProbe, u.unitConfig.LivenessProbe)
+		var cmdErr, probeErr error
+		if stopped, hookErr := u.runPostStartHook(); stopped {
+			cmdErr = u.stopCmd(cmd, waitForCmd(cmd))
+		} else if hookErr != nil {
+			glog.Warningf("%s: %v", u.Name, hookErr)
+			probeErr = hookErr
+			// Reap the process once handleCmdCleanup() has killed it.
+			waitForCmd(cmd)
+		} else {
+			cmdErr, probeErr = u.watchRunningCmd(cmd, u.unitConfig.StartupProbe, u.unitConfig.ReadinessProbe, u.unitConfig.LivenessProbe)
+		}
+		stdio.exited()
 		keepGoing := u.handleCmdCleanup(cmd, cmdErr, probeErr, policy, startTime)
+		if u.stopping {
+			glog.Infof("%s has been stopped", command[0])
+			return nil
+		}
 		if !keepGoing {
 			glog.Infof("giving up on %s", command[0])
 			return cmdErr
 		}
-		maybeBackOff(cmdErr, command, &backoff, time.Since(startTime))
+		if !u.maybeBackOff(cmdErr, command, &backoff, time.Since(startTime)) {
+			return nil
+		}
+	}
+}
+
+// startCmd starts the command of the unit. If the unit has resource limits or
+// a seccomp filter, the command is started via the shim, and the limits and
+// the filter are applied to the process before the command runs, instead of
+// to the helper.
+func (u *Unit) startCmd(cmd *exec.Cmd, filter []bpf.RawInstruction) error {
+	rlimits := u.unitConfig.Rlimits
+	if len(rlimits) == 0 && len(filter) == 0 {
+		return cmd.Start()
+	}
+	r, w, err := shimCommand(cmd)
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	r.Close()
+	if err != nil {
+		w.Close()
+		return err
+	}
+	err = setRlimits(cmd.Process.Pid, rlimits)
+	if err != nil {
+		err = fmt.Errorf("setting resource limits: %v", err)
+	} else {
+		err = writeShimMessage(w, filter)
+	}
+	w.Close()
+	if err != nil {
+		// The shim exits without running the command.
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return nil
+}
+
+// hookError is returned when a lifecycle hook of the unit fails.
+type hookError struct {
+	hook string
+	err  error
+}
+
+func (e *hookError) Error() string {
+	return fmt.Sprintf("%s hook failed: %v", e.hook, e.err)
+}
+
+func (e *hookError) Reason() string {
+	return "Failed" + e.hook + "Hook"
+}
+
+func (u *Unit) runHook(hook string, handler *api.Handler, timeout time.Duration) error {
+	glog.Infof("running %s hook for %s", hook, u.Name)
+	err := prober.RunHandler(u.Name, u.unitConfig.PodIP, handler, timeout)
+	if err != nil {
+		herr := &hookError{hook: hook, err: err}
+		u.RecordEvent(api.EventTypeWarning, herr.Reason(), herr.Error())
+		return herr
+	}
+	return nil
+}
+
+// runPostStartHook runs the PostStart hook of the unit, if it has one. The
+// unit is not considered started until the hook has finished. The hook has
+// the termination grace period of the unit to finish, or the default one if
+// the unit would be killed right away when stopped. Returns true if the unit
+// has been asked to stop in the meantime, the hook is abandoned then.
+func (u *Unit) runPostStartHook() (bool, error) {
+	lifecycle := u.unitConfig.Lifecycle
+	if lifecycle == nil || lifecycle.PostStart == nil {
+		return false, nil
+	}
+	timeout := u.GetTerminationGracePeriod()
+	if timeout <= 0 {
+		timeout = time.Duration(api.DefaultTerminationGracePeriodSeconds) * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	hookDoneChan := make(chan error, 1)
+	go func() {
+		hookDoneChan <- u.runHook("PostStart", lifecycle.PostStart, timeout)
+	}()
+	select {
+	case hookErr := <-hookDoneChan:
+		return false, hookErr
+	case <-u.stopChan:
+		glog.Infof("%s has been stopped while running its PostStart hook", u.Name)
+		return true, nil
+	case <-timer.C:
+		herr := &hookError{
+			hook: "PostStart",
+			err:  fmt.Errorf("did not finish in %v", timeout),
+		}
+		u.RecordEvent(api.EventTypeWarning, herr.Reason(), herr.Error())
+		return false, herr
 	}
 }
 
@@ -604,6 +1142,7 @@ func (u *Unit) watchRunningCmd(cmd *exec.Cmd, startupProbe, readinessProbe, live
 	if startupProbe != nil {
 		startupWorker := prober.NewWorker(
 			u.Name, podIP, prober.Startup, startupProbe)
+		startupWorker.SetEventRecorder(u)
 		startupWorker.Start()
 		defer startupWorker.Stop()
 	waitForStarted:
@@ -611,9 +1150,13 @@ func (u *Unit) watchRunningCmd(cmd *exec.Cmd, startupProbe, readinessProbe, live
 			select {
 			case cmdErr := <-cmdDoneChan:
 				return cmdErr, nil
+			case <-u.stopChan:
+				return u.stopCmd(cmd, cmdDoneChan), nil
 			case startupResult := <-startupWorker.Results():
 				if startupResult == prober.Failure {
 					glog.Warningln("startup probe failed")
+					u.RecordEvent(api.EventTypeNormal, events.KillingUnit,
+						fmt.Sprintf("Unit %s failed startup probe, will be restarted", u.Name))
 					return nil, fmt.Errorf("startup probe failed")
 				} else if startupResult == prober.Success {
 					break waitForStarted
@@ -629,19 +1172,25 @@ func (u *Unit) watchRunningCmd(cmd *exec.Cmd, startupProbe, readinessProbe, live
 
 	livenessWorker := prober.NewWorker(
 		u.Name, podIP, prober.Liveness, livenessProbe)
+	livenessWorker.SetEventRecorder(u)
 	livenessWorker.Start()
 	defer livenessWorker.Stop()
 	readinessWorker := prober.NewWorker(
 		u.Name, podIP, prober.Readiness, readinessProbe)
+	readinessWorker.SetEventRecorder(u)
 	readinessWorker.Start()
 	defer readinessWorker.Stop()
 	for {
 		select {
 		case cmdErr := <-cmdDoneChan:
 			return cmdErr, nil
+		case <-u.stopChan:
+			return u.stopCmd(cmd, cmdDoneChan), nil
 		case livenessResult := <-livenessWorker.Results():
 			if livenessResult == prober.Failure {
 				glog.Warningln("liveness probe failed")
+				u.RecordEvent(api.EventTypeNormal, events.KillingUnit,
+					fmt.Sprintf("Unit %s failed liveness probe, will be restarted", u.Name))
 				return nil, fmt.Errorf("liveness probe failed")
 			}
 		case readinessResult := <-readinessWorker.Results():
@@ -653,6 +1202,68 @@ func (u *Unit) watchRunningCmd(cmd *exec.Cmd, startupProbe, readinessProbe, live
 	return nil, nil
 }
 
+// stopCmd runs the PreStop hook of the unit if there is one, then sends the
+// stop signal to the process tree of the unit, and waits for the main process
+// to exit. If it is still running after the termination grace period (which
+// includes the time spent in the PreStop hook), the whole process tree gets
+// killed.
+func (u *Unit) stopCmd(cmd *exec.Cmd, cmdDoneChan chan error) error {
+	u.stopping = true
+	gracePeriod := u.GetTerminationGracePeriod()
+	stopSignal := u.GetStopSignal()
+	glog.Infof("stopping %s pid %d with %v, grace period %v",
+		cmd.Path, cmd.Process.Pid, stopSignal, gracePeriod)
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+	expired := false
+	if lifecycle := u.unitConfig.Lifecycle; lifecycle != nil && lifecycle.PreStop != nil {
+		hookDoneChan := make(chan error, 1)
+		go func() {
+			hookDoneChan <- u.runHook("PreStop", lifecycle.PreStop, gracePeriod)
+		}()
+		select {
+		case hookErr := <-hookDoneChan:
+			if hookErr != nil {
+				glog.Warningf("%s: %v", u.Name, hookErr)
+				u.preStopErr = hookErr
+			}
+		case cmdErr := <-cmdDoneChan:
+			return cmdErr
+		case <-timer.C:
+			herr := &hookError{
+				hook: "PreStop",
+				err:  fmt.Errorf("did not finish in %v", gracePeriod),
+			}
+			u.RecordEvent(api.EventTypeWarning, herr.Reason(), herr.Error())
+			u.preStopErr = herr
+			glog.Warningf("%s: %v", u.Name, u.preStopErr)
+			expired = true
+		}
+	}
+	ptk := kill.NewProcessTreeKiller(&kill.OSProcessHandler{})
+	if !expired {
+		err := ptk.SignalProcessTree(cmd.Process.Pid, stopSignal)
+		if err != nil {
+			glog.Warningf("%s sending %v to process tree for %s: %v",
+				u.Name, stopSignal, cmd.Path, err)
+		}
+		select {
+		case cmdErr := <-cmdDoneChan:
+			return cmdErr
+		case <-timer.C:
+		}
+	}
+	glog.Warningf("%s pid %d is still running after %v, killing it",
+		cmd.Path, cmd.Process.Pid, gracePeriod)
+	u.forceKilled = true
+	err := ptk.KillProcessTree(cmd.Process.Pid)
+	if err != nil {
+		glog.Warningf("%s killing process tree for %s: %v", u.Name, cmd.Path, err)
+		cmd.Process.Kill()
+	}
+	return <-cmdDoneChan
+}
+
 func waitForCmd(cmd *exec.Cmd) chan error {
 	// prevent leaking a goroutine by buffering the channel
 	doneChan := make(chan error, 1)
@@ -669,6 +1280,7 @@ func (u *Unit) handleCmdCleanup(cmd *exec.Cmd, cmdErr, probeErr error, policy ap
 	failure := false
 	exitCode := 0
 	reason := ""
+	message := ""
 	if cmdErr != nil {
 		failure = true
 		foundRc := false
@@ -685,6 +1297,19 @@ func (u *Unit) handleCmdCleanup(cmd *exec.Cmd, cmdErr, probeErr error, policy ap
 			glog.Infof("command %s pid %d exited with %v after %.2fs",
 				cmd.Path, cmd.Process.Pid, cmdErr, d.Seconds())
 		}
+		if u.oomKilled() {
+			glog.Infof("command %s pid %d has been killed by the OOM killer",
+				cmd.Path, cmd.Process.Pid)
+			reason = "OOMKilled"
+			u.RecordEvent(api.EventTypeWarning, events.UnitOOMKilled,
+				fmt.Sprintf("Unit %s has been killed by the OOM killer", u.Name))
+		}
+	} else if herr, ok := probeErr.(*hookError); ok {
+		glog.Infof("command %s saw a hook error %s after %.2fs",
+			cmd.Path, herr.Error(), d.Seconds())
+		failure = true
+		reason = herr.Reason()
+		message = herr.Error()
 	} else if probeErr != nil {
 		glog.Infof("command %s saw a probe error %s after %.2fs",
 			cmd.Path, probeErr.Error(), d.Seconds())
@@ -708,28 +1333,63 @@ func (u *Unit) handleCmdCleanup(cmd *exec.Cmd, cmdErr, probeErr error, policy ap
 
 	falseval := false
 	u.UpdateStatusAttr(&falseval, &falseval)
-	u.setTerminatedState(exitCode, reason, startTime)
+	if message == "" {
+		message = u.getTerminationLog()
+	}
+	if message == "" && cmdErr != nil {
+		message = u.getOutputTail()
+	}
+	if message == "" && u.preStopErr != nil {
+		message = u.preStopErr.Error()
+	}
+	u.setTerminatedState(exitCode, reason, message, startTime, u.forceKilled)
 
-	if policy == api.RestartPolicyNever ||
+	if u.stopping ||
+		policy == api.RestartPolicyNever ||
 		policy == api.RestartPolicyOnFailure && !failure {
 		keepGoing = false
 	}
 	return keepGoing
 }
 
-func (u *Unit) setTerminatedState(exitCode int, reason string, startedAt time.Time) {
+func (u *Unit) getOOMKillCount() (uint64, bool) {
+	if u.control == nil {
+		return 0, false
+	}
+	count, err := u.control.OOMKillCount()
+	if err != nil {
+		glog.V(2).Infof("getting OOM kill count for %s: %v", u.Name, err)
+		return 0, false
+	}
+	return count, true
+}
+
+// oomKilled checks whether the OOM killer has killed any process of the unit
+// since it was last started.
+func (u *Unit) oomKilled() bool {
+	if u.oomKillCount == nil {
+		return false
+	}
+	count, ok := u.getOOMKillCount()
+	return ok && count > *u.oomKillCount
+}
+
+func (u *Unit) setTerminatedState(exitCode int, reason, message string, startedAt time.Time, forceKilled bool) {
 	t := &api.UnitStateTerminated{
-		ExitCode:   int32(exitCode),
-		FinishedAt: api.Now(),
-		Reason:     reason,
-		Message:    u.getTerminationLog(),
-		StartedAt:  api.Time{startedAt},
+		ExitCode:    int32(exitCode),
+		FinishedAt:  api.Now(),
+		Reason:      reason,
+		Message:     message,
+		StartedAt:   api.Time{startedAt},
+		ForceKilled: forceKilled,
 	}
 	u.SetState(api.UnitState{Terminated: t}, nil)
 }
 
 func (u *Unit) getTerminationLog() string {
-	if u.unitConfig.TerminationMessagePolicy != api.TerminationMessageReadFile ||
+	policy := u.unitConfig.TerminationMessagePolicy
+	if policy != api.TerminationMessageReadFile &&
+		policy != api.TerminationMessageFallbackToLogsOnError ||
 		u.unitConfig.TerminationMessagePath == "" {
 		return ""
 	}
@@ -744,6 +1404,37 @@ func (u *Unit) getTerminationLog() string {
 	return data
 }
 
+// captureOutput makes cmd write its output via a logTail, so the end of it can
+// be used as the termination message of the unit.
+func (u *Unit) captureOutput(cmd *exec.Cmd, unitout, uniterr io.Writer) {
+	tail := newLogTail(
+		MaxContainerTerminationMessageLength,
+		MaxContainerTerminationMessageLogLines)
+	stdout, err := tail.tee(unitout)
+	if err == nil {
+		var stderr *os.File
+		stderr, err = tail.tee(uniterr)
+		if err == nil {
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			u.outputTail = tail
+			return
+		}
+	}
+	glog.Warningf("capturing output of %s: %v", u.Name, err)
+	tail.closeWriters()
+}
+
+func (u *Unit) getOutputTail() string {
+	if u.outputTail == nil {
+		return ""
+	}
+	if !u.outputTail.wait(logTailTimeout) {
+		glog.Warningf("timed out waiting for output of %s", u.Name)
+	}
+	return u.outputTail.String()
+}
+
 func createDir(dir string, uid, gid int) error {
 	err := os.MkdirAll(dir, 0755)
 	if err != nil {
@@ -778,6 +1469,8 @@ func changeToWorkdir(workingdir string, uid, gid uint32) error {
 
 func (u *Unit) setStateToStartFailure(err error) {
 	serr := fmt.Sprintf("Failed to start: %v", err)
+	u.RecordEvent(api.EventTypeWarning, events.FailedToStartUnit,
+		fmt.Sprintf("Error: %v", err))
 	u.SetState(api.UnitState{
 		Waiting: &api.UnitStateWaiting{
 			Reason:       serr,
@@ -814,7 +1507,7 @@ func (u *Unit) getCapabilities() ([]string, error) {
 		dropCaps = u.unitConfig.SecurityContext.Capabilities.Drop
 	}
 	capStringList, err := caps.TweakCapabilities(
-		defaultCapabilities, addCaps, dropCaps, nil, false)
+		defaultCapabilities, addCaps, dropCaps, nil, u.isPrivileged())
 	if err != nil {
 		return nil, err
 	}
@@ -867,16 +1560,23 @@ func (u *Unit) Run(podname, hostname string, command []string, workingdir string
 		},
 	}, nil)
 
-	control, err := cgroups.New(
-		cgroups.V1, cgroups.StaticPath("/"+u.Name), &specs.LinuxResources{})
+	if err := u.openEventsFile(); err != nil {
+		glog.Warningf("opening events file of %s: %v", u.Name, err)
+	} else {
+		defer u.eventsFile.Close()
+	}
+
+	resources := util.UnitResourcesToLinux(u.unitConfig.Resources)
+	control, err := cgroup.New(u.Name, resources)
 	if err != nil {
 		glog.Errorf("creating cgroups control for %q: %v", u.Name, err)
 		u.setStateToStartFailure(err)
 		return err
 	}
 	defer control.Delete()
+	u.control = control
 	pid := os.Getpid()
-	err = control.Add(cgroups.Process{Pid: pid})
+	err = control.Add(pid)
 	if err != nil {
 		glog.Errorf("adding pid %v to cgroups control: %v", pid, err)
 		u.setStateToStartFailure(err)
@@ -909,6 +1609,14 @@ func (u *Unit) Run(podname, hostname string, command []string, workingdir string
 		return err
 	}
 	defer uniterr.Close()
+	for _, name := range UNIT_PIPES {
+		spare, err := lp.OpenSpareReader(name)
+		if err != nil {
+			u.setStateToStartFailure(err)
+			return err
+		}
+		defer spare.Close()
+	}
 	unitin, err := u.OpenStdinReader()
 	if err != nil {
 		glog.Errorf("opening pipe: %v", err)
@@ -916,6 +1624,13 @@ func (u *Unit) Run(podname, hostname string, command []string, workingdir string
 		return err
 	}
 	defer unitin.Close()
+	ctl, err := u.openControl()
+	if err != nil {
+		u.setStateToStartFailure(err)
+		return err
+	}
+	defer ctl.Close()
+	go u.handleControlMessages(ctl)
 
 	if rootfs != "" {
 		oldrootfs := fmt.Sprintf("%s/.oldrootfs", rootfs)
@@ -1082,6 +1797,15 @@ func (u *Unit) Run(podname, hostname string, command []string, workingdir string
 		}
 	}
 
+	if rootfs != "" && u.isReadOnlyRootfs() {
+		err = u.makeRootfsReadOnly(mounter)
+		if err != nil {
+			glog.Errorf("making rootfs read-only: %v", err)
+			u.setStateToStartFailure(err)
+			return err
+		}
+	}
+
 	caplist, err := u.getCapabilities()
 	if err != nil {
 		glog.Errorf("getting capabilities: %v", err)
@@ -1096,9 +1820,114 @@ func (u *Unit) Run(podname, hostname string, command []string, workingdir string
 		return err
 	}
 
+	if rootfs != "" && u.maskProcPaths() {
+		err = mount.MaskPaths()
+		if err != nil {
+			glog.Errorf("masking paths: %v", err)
+			u.setStateToStartFailure(err)
+			return err
+		}
+	}
+
 	return u.RunUnitLoop(command, caplist, uid, gid, groups, unitin, unitout, uniterr, policy)
 }
 
+func (u *Unit) isPrivileged() bool {
+	privileged := u.unitConfig.SecurityContext.Privileged
+	return privileged != nil && *privileged
+}
+
+// maskProcPaths returns whether /proc and /sys need to be masked for the
+// unit. Units have always seen them unmasked, so it has to be asked for via
+// procMount.
+func (u *Unit) maskProcPaths() bool {
+	procMount := u.unitConfig.SecurityContext.ProcMount
+	return procMount != nil && *procMount == api.ProcMountTypeDefault &&
+		!u.isPrivileged()
+}
+
+// noNewPrivs returns whether no_new_privs needs to be set for the unit. It's
+// only set if privilege escalation is disabled explicitly.
+func (u *Unit) noNewPrivs() bool {
+	allow := u.unitConfig.SecurityContext.AllowPrivilegeEscalation
+	return allow != nil && !*allow && !u.isPrivileged()
+}
+
+func (u *Unit) isReadOnlyRootfs() bool {
+	ro := u.unitConfig.SecurityContext.ReadOnlyRootFilesystem
+	return ro != nil && *ro
+}
+
+// makeRootfsReadOnly remounts the root filesystem of the unit read-only,
+// once it has been pivoted into. Both the bind mount of an extracted rootfs
+// and an overlayfs rootfs are a mount of their own, and the remount only
+// affects that mount. Everything mounted below the root stays writable, and
+// the termination message file is bind mounted onto itself if it's not on one
+// of those mounts, so the unit can still write it.
+func (u *Unit) makeRootfsReadOnly(mounter mount.Mounter) error {
+	f, err := os.Open(mountinfoPath)
+	if err != nil {
+		return err
+	}
+	mountPoints := findMountPoints(f)
+	f.Close()
+	binds, writable := readOnlyRootfsMounts(
+		mountPoints, u.unitConfig.TerminationMessagePath)
+	glog.V(5).Infof("mounts of %s left writable: %v", u.Name, writable)
+	for _, path := range binds {
+		err := mounter.BindMount(path, path)
+		if err != nil {
+			return fmt.Errorf("bind mounting %s: %v", path, err)
+		}
+	}
+	return mount.RemountReadOnly("/")
+}
+
+// readOnlyRootfsMounts decides what needs to be done to keep the paths the
+// unit writes to writable, given the mount points of the unit. It returns the
+// paths that have to be bind mounted onto themselves before the root is
+// remounted read-only, and the mount points below the root, which are left
+// writable as they are.
+func readOnlyRootfsMounts(mountPoints []string, terminationMessagePath string) ([]string, []string) {
+	writable := []string{}
+	for _, mp := range mountPoints {
+		if mp != "/" {
+			writable = append(writable, mp)
+		}
+	}
+	binds := []string{}
+	if terminationMessagePath == "" {
+		return binds, writable
+	}
+	path := filepath.Clean(terminationMessagePath)
+	for _, mp := range writable {
+		if path == mp || strings.HasPrefix(path, mp+"/") {
+			return binds, writable
+		}
+	}
+	return append(binds, path), writable
+}
+
+// findMountPoints returns the mount points in mountinfo, in the order they
+// were mounted.
+func findMountPoints(mountinfo io.Reader) []string {
+	mountPoints := []string{}
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(mountinfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mp := unescapeMountinfo(fields[4])
+		if !seen[mp] {
+			seen[mp] = true
+			mountPoints = append(mountPoints, mp)
+		}
+	}
+	return mountPoints
+}
+
 func createEmptyFile(path string, mode os.FileMode) error {
 	os.MkdirAll(filepath.Dir(path), 0755)
 	_, err := os.Create(path)
@@ -21,6 +21,7 @@ import (
 	"github.com/elotl/itzo/pkg/util/conmap"
 	"io"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/elotl/itzo/pkg/api"
@@ -29,6 +30,7 @@ import (
 )
 
 const (
+	INITIAL_BACKOFF_TIME                 = 1 * time.Second
 	MAX_BACKOFF_TIME                     = 5 * time.Minute
 	BACKOFF_RESET_TIME                   = 10 * time.Minute
 	CHILD_OOM_SCORE                      = 15 // chosen arbitrarily... kernel will adjust this value
@@ -109,6 +111,30 @@ type UnitConfig struct {
 	TerminationMessagePath   string
 	PodIP                    string
 	UseOverlayfs             bool
+	// Seconds the unit is given to exit after it has been asked to stop,
+	// if it's set explicitly for the unit.
+	TerminationGracePeriodSeconds *int64 `json:",omitempty"`
+	// Pod level grace period, used if the unit doesn't specify one. It
+	// takes precedence over the StopTimeout of the image.
+	PodTerminationGracePeriodSeconds *int64 `json:",omitempty"`
+	// Signal overriding the StopSignal of the image.
+	StopSignal string `json:",omitempty"`
+	// PostStart and PreStop hooks of the unit.
+	Lifecycle *api.Lifecycle `json:",omitempty"`
+	// Resource requests and limits, applied via the cgroups of the unit.
+	Resources api.ResourceRequirements
+	// Backoff between restarts, zero values mean the defaults.
+	RestartBackoff api.RestartBackoff
+	// Seccomp profile of the unit, the one in the security context of the
+	// unit overriding the pod level one.
+	SeccompProfile *api.SeccompProfile `json:",omitempty"`
+	// Resource limits of the unit, including the defaults of itzo.
+	Rlimits []api.Rlimit `json:",omitempty"`
+	// Whether the unit gets input via attach, whether stdin is closed
+	// after the first attach session, and whether it runs with a TTY.
+	Stdin     bool `json:",omitempty"`
+	StdinOnce bool `json:",omitempty"`
+	TTY       bool `json:",omitempty"`
 }
 
 type Unit struct {
@@ -140,6 +166,22 @@ func (u *Unit) SetUnitConfigOverlayfs(useOverlayfs bool) {
 	return
 }
 
+func (u *Unit) GetTerminationGracePeriod() time.Duration {
+	return 0
+}
+
+func (u *Unit) GetNamespaceModes() (pid, ipc api.NamespaceMode) {
+	return api.NamespaceModeContainer, api.NamespaceModePod
+}
+
+func (u *Unit) GetRlimits() []api.Rlimit {
+	return nil
+}
+
+func (u *Unit) GetStopSignal() syscall.Signal {
+	return 0
+}
+
 func (u *Unit) CreateCommand(command []string, args []string) []string {
 	return []string{}
 }
@@ -200,6 +242,26 @@ func (u *Unit) OpenStdinWriter() (io.WriteCloser, error) {
 	return nil, nil
 }
 
+func (u *Unit) CloseStdin() error {
+	return nil
+}
+
+func (u *Unit) ResizeTerminal(rows, cols uint16) error {
+	return nil
+}
+
+func (u *Unit) HasStdin() bool {
+	return false
+}
+
+func (u *Unit) IsStdinOnce() bool {
+	return false
+}
+
+func (u *Unit) IsTTY() bool {
+	return false
+}
+
 type UnitManager struct {
 	rootDir      string
 	RunningUnits *conmap.StringOsProcess
@@ -234,6 +296,49 @@ func (u UnitManager) GetPid(s string) (int, bool) {
 	return 0, false
 }
 
+func (u UnitManager) RemovePodNamespaces() error {
+	return nil
+}
+
+func (u UnitManager) AdoptUnit(podname, unitname string) (bool, error) {
+	return false, nil
+}
+
+func (u UnitManager) AdoptPodNamespaces() error {
+	return nil
+}
+
+func (u UnitManager) GetFsUsage(unitName string) (uint64, error) {
+	return 0, nil
+}
+
+func (u UnitManager) ReadUnitEvents(unitName string) ([]api.Event, error) {
+	return nil, nil
+}
+
+func Pause() {
+}
+
+var DefaultRlimits []api.Rlimit
+
+func ParseRlimits(s string) ([]api.Rlimit, error) {
+	return nil, nil
+}
+
+func FormatRlimits(rlimits []api.Rlimit) string {
+	return ""
+}
+
+func ExecWithRlimits(rlimits string, argv []string) error {
+	return nil
+}
+
+const ShimFlag = "unit-shim"
+
+func ExecUnitCommand(fd int, argv []string) error {
+	return nil
+}
+
 func NewUnitManager(rootDir string) *UnitManager {
 	return &UnitManager{}
 }
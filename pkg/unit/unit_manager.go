@@ -22,7 +22,8 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"strings"
+	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -47,6 +48,10 @@ var (
 	ContainerLogDir = "/var/log/containers"
 	// Sleep length to allow log pipe to drain before closing
 	LOG_PIPE_FINISH_READ_SLEEP = time.Second * 3
+	// Extra time we give the helper on top of the grace period of the unit to
+	// clean up and exit before it is killed.
+	stopUnitSlack        = 5 * time.Second
+	stopUnitPollInterval = 100 * time.Millisecond
 )
 
 func StartUnit(rootdir, podname, hostname, unitname, workingdir, netns string, command []string, policy api.RestartPolicy) error {
@@ -72,6 +77,10 @@ type UnitManager struct {
 	rootDir      string
 	RunningUnits *conmap.StringOsProcess
 	LogBuf       *conmap.StringLogbufLogBuffer
+	podNS        podNamespaces
+	quotas       projectQuotas
+	// Serializes allocating project IDs for units.
+	storageLock sync.Mutex
 }
 
 func NewUnitManager(rootDir string) *UnitManager {
@@ -80,6 +89,12 @@ func NewUnitManager(rootDir string) *UnitManager {
 		rootDir:      rootDir,
 		RunningUnits: conmap.NewStringOsProcess(),
 		LogBuf:       conmap.NewStringLogbufLogBuffer(),
+		podNS: podNamespaces{
+			pidFile: filepath.Join(rootDir, ".pause.pid"),
+		},
+		quotas: projectQuotas{
+			devDir: rootDir,
+		},
 	}
 }
 
@@ -115,19 +130,33 @@ func (um *UnitManager) UnitRunning(unit string) bool {
 	return exists
 }
 
-// It's possible we need to set up some communication with the waiting
-// process that it doesn't need to clean up everything.  Lets see how
-// the logging works out...
+// StopUnit asks the helper process of the unit to shut the unit down. The
+// helper forwards SIGTERM to the processes of the unit, and kills them if they
+// don't exit within the termination grace period. If the helper itself is
+// still around after that, it gets killed too.
 func (um *UnitManager) StopUnit(name string) error {
 	proc, exists := um.RunningUnits.GetOK(name)
 	if !exists {
 		return fmt.Errorf("Could not stop unit %s: Unit does not exist", name)
 	}
 
-	_, err := OpenUnit(um.rootDir, name)
+	unit, err := OpenUnit(um.rootDir, name)
 	if err != nil {
 		return fmt.Errorf("Error opening unit %s for termination: %s", name, err)
 	}
+	err = proc.Signal(syscall.SIGTERM)
+	if err == nil {
+		deadline := time.Now().Add(unit.GetTerminationGracePeriod() + stopUnitSlack)
+		for um.helperRunning(name, proc) && time.Now().Before(deadline) {
+			time.Sleep(stopUnitPollInterval)
+		}
+		if !um.helperRunning(name, proc) {
+			glog.Infof("unit %s (helper pid %d) has been stopped", name, proc.Pid)
+			return nil
+		}
+		glog.Warningf("unit %s (helper pid %d) did not exit in time, killing it",
+			name, proc.Pid)
+	}
 	err = proc.Kill()
 	if err != nil {
 		// This happens if the process has already exited. Keep calm, log it
@@ -139,6 +168,11 @@ func (um *UnitManager) StopUnit(name string) error {
 	return nil
 }
 
+func (um *UnitManager) helperRunning(name string, proc *os.Process) bool {
+	p, exists := um.RunningUnits.GetOK(name)
+	return exists && p == proc
+}
+
 // This removes the unit and its files/directories from the filesystem.
 func (um *UnitManager) RemoveUnit(name string) error {
 	unit, err := OpenUnit(um.rootDir, name)
@@ -168,6 +202,10 @@ func (um *UnitManager) StartUnit(podname, hostname, unitname, workingdir, netns
 		workingdir = unit.GetWorkingDir()
 	}
 
+	// Default environment from image config, with the environment variables
+	// from the spec added.
+	env := util.MergeEnv(unit.GetEnv(), appenv)
+	command, args = util.ExpandContainerCommandAndArgs(command, args, env)
 	unitcmd := unit.CreateCommand(command, args)
 	quotedcmd := quote.Join(unitcmd...)
 	cmdline := []string{"--exec",
@@ -191,14 +229,6 @@ func (um *UnitManager) StartUnit(podname, hostname, unitname, workingdir, netns
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	env := unit.GetEnv() // Default environment from image config.
-	for _, e := range appenv {
-		// Add environment variables from the spec, overwriting default ones if
-		// necessary.
-		items := strings.SplitN(e, "=", 2)
-		key, value := items[0], items[1]
-		env = util.AddToEnvList(env, key, value, true)
-	}
 	cmd.Env = env
 
 	glog.Infof("unit %q workingdir %q policy %v", unitname, workingdir, policy)
@@ -211,7 +241,10 @@ func (um *UnitManager) StartUnit(podname, hostname, unitname, workingdir, netns
 		glog.Errorf("Error checking if rootdir %s is an empty directory: %v",
 			um.rootDir, err)
 	}
+	// Units without a rootfs run in the namespaces of the agent.
+	pidMode, ipcMode := api.NamespaceModeNode, api.NamespaceModeNode
 	if !isUnitRootfsMissing {
+		pidMode, ipcMode = unit.GetNamespaceModes()
 		// If the parent mount of rootfs is shared, pivot_root will fail with
 		// EINVAL. Adding CLONE_NEWNS to Unshareflags takes care of this, but
 		// it also does it recursively (MS_REC), which might interfere if the
@@ -219,46 +252,145 @@ func (um *UnitManager) StartUnit(podname, hostname, unitname, workingdir, netns
 		// parent mount private right before calling pivot_root instead. Also
 		// see https://go-review.googlesource.com/c/go/+/38471
 		cmd.SysProcAttr = &syscall.SysProcAttr{
-			Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+			Cloneflags: getCloneflags(pidMode, ipcMode),
 		}
 	}
 
-	um.CaptureLogs(podname, unitname, unit.LogPipe)
+	// The quota has to be in place before the unit can write anything.
+	watchedLayer := ""
+	if !isUnitRootfsMissing {
+		watchedLayer = um.setupStorage(podname, unit, false)
+	}
+
+	um.CaptureLogs(podname, unitname, unit.LogPipe, unit.IsTTY())
 
-	if err = cmd.Start(); err != nil {
+	// Namespaces shared by the pod are joined before starting the helper.
+	err = um.podNS.enter(pidMode, ipcMode, cmd.Start)
+	if err != nil {
 		glog.Errorf("Failed to start %s/%s: %v", podname, unitname, err)
 		unit.LogPipe.Remove()
 		return err
 	}
 	um.RunningUnits.Set(unitname, cmd.Process)
-	pid := cmd.Process.Pid
-	go func() {
-		err = cmd.Wait()
-		if err == nil {
-			glog.Infof("unit %s/%s (helper pid %d) exited", podname, unitname, pid)
-		} else {
-			glog.Errorf("unit %s/%s (helper pid %d) exited with error %v", podname, unitname, pid, err)
-		}
-		um.RunningUnits.Delete(unitname)
-		// sleep momentarily before removing the pipe to allow it to drain
-		time.Sleep(LOG_PIPE_FINISH_READ_SLEEP)
-		unit.LogPipe.Remove()
-	}()
+	// The helper keeps running if the agent is restarted, and it's adopted
+	// by the new instance of the agent.
+	err = saveProcessRef(unit.helperPidPath(), cmd.Process.Pid)
+	if err != nil {
+		glog.Warningf("saving helper pid of %s/%s: %v", podname, unitname, err)
+	}
+	go um.watchHelper(podname, unit, cmd.Process, func() error {
+		return cmd.Wait()
+	})
+	if watchedLayer != "" {
+		go um.watchStorage(podname, unit, cmd.Process, watchedLayer,
+			unit.GetEphemeralStorageLimit())
+	}
 	return nil
 }
 
-func (um *UnitManager) CaptureLogs(podName, unitName string, lp *LogPipe) {
+// watchHelper waits for the helper of a unit to exit, then cleans up after it.
+func (um *UnitManager) watchHelper(podname string, unit *Unit, proc *os.Process, wait func() error) {
+	pid := proc.Pid
+	err := wait()
+	if err == nil {
+		glog.Infof("unit %s/%s (helper pid %d) exited", podname, unit.Name, pid)
+	} else {
+		glog.Errorf("unit %s/%s (helper pid %d) exited with error %v", podname, unit.Name, pid, err)
+	}
+	if um.helperRunning(unit.Name, proc) {
+		um.RunningUnits.Delete(unit.Name)
+	}
+	// sleep momentarily before removing the pipe to allow it to drain
+	time.Sleep(LOG_PIPE_FINISH_READ_SLEEP)
+	unit.LogPipe.Remove()
+}
+
+// AdoptUnit takes over a unit whose helper has been started by a previous
+// instance of the agent. If the helper is still running, its output is
+// captured again, and it's tracked like the helpers started by StartUnit.
+// Returns whether the unit has been started before.
+func (um *UnitManager) AdoptUnit(podname, unitname string) (bool, error) {
+	if !IsUnitExist(um.rootDir, unitname) {
+		return false, nil
+	}
+	unit, err := OpenUnit(um.rootDir, unitname)
+	if err != nil {
+		return false, err
+	}
+	ref, err := loadProcessRef(unit.helperPidPath())
+	if err != nil {
+		return false, err
+	}
+	if ref == nil {
+		return false, nil
+	}
+	if !ref.alive() {
+		glog.Infof("helper of unit %s/%s (pid %d) is gone", podname, unitname, ref.Pid)
+		unit.LogPipe.Remove()
+		return true, nil
+	}
+	proc, err := os.FindProcess(ref.Pid)
+	if err != nil {
+		return true, err
+	}
+	um.CaptureLogs(podname, unitname, unit.LogPipe, unit.IsTTY())
+	um.RunningUnits.Set(unitname, proc)
+	glog.Infof("adopted unit %s/%s (helper pid %d)", podname, unitname, ref.Pid)
+	go um.watchHelper(podname, unit, proc, func() error {
+		ref.wait()
+		return nil
+	})
+	if watchedLayer := um.setupStorage(podname, unit, true); watchedLayer != "" {
+		go um.watchStorage(podname, unit, proc, watchedLayer,
+			unit.GetEphemeralStorageLimit())
+	}
+	return true, nil
+}
+
+// AdoptPodNamespaces takes over the PID and IPC namespaces of the pod created
+// by a previous instance of the agent, if they are still around.
+func (um *UnitManager) AdoptPodNamespaces() error {
+	return um.podNS.adopt()
+}
+
+// getCloneflags returns the namespaces to create for the helper of a unit.
+// Namespaces shared by the pod are joined instead, and the ones of the node
+// are inherited from the agent.
+func getCloneflags(pidMode, ipcMode api.NamespaceMode) uintptr {
+	flags := uintptr(syscall.CLONE_NEWUTS | syscall.CLONE_NEWNS)
+	if pidMode == api.NamespaceModeContainer {
+		flags |= syscall.CLONE_NEWPID
+	}
+	if ipcMode == api.NamespaceModeContainer {
+		flags |= syscall.CLONE_NEWIPC
+	}
+	return flags
+}
+
+// RemovePodNamespaces tears down the PID and IPC namespaces shared by the
+// units of the pod, if they have been created.
+func (um *UnitManager) RemovePodNamespaces() error {
+	return um.podNS.stop()
+}
+
+// CaptureLogs starts reading the output of the unit into its log buffer and
+// log file. Output of units with a TTY is not split into lines.
+func (um *UnitManager) CaptureLogs(podName, unitName string, lp *LogPipe, tty bool) {
 	namespace, name := util.SplitNamespaceAndName(podName)
 	cid := fmt.Sprintf("%d", time.Now().UnixNano())
 	logFileName := fmt.Sprintf(
 		"%s/%s_%s_%s-%s.log", ContainerLogDir, name, namespace, unitName, cid)
 	writer := containerlog.NewLogger(logFileName, 100, 1, 7, nil)
 	um.LogBuf.Set(unitName, logbuf.NewLogBuffer(logBuffSize))
-	lp.StartReader(PIPE_UNIT_STDOUT, func(line string) {
+	startReader := lp.StartReader
+	if tty {
+		startReader = lp.StartRawReader
+	}
+	startReader(PIPE_UNIT_STDOUT, func(line string) {
 		um.LogBuf.Get(unitName).Write(logbuf.StdoutLogSource, line, nil)
 		writer.Write(containerlog.Stdout, line)
 	})
-	lp.StartReader(PIPE_UNIT_STDERR, func(line string) {
+	startReader(PIPE_UNIT_STDERR, func(line string) {
 		um.LogBuf.Get(unitName).Write(logbuf.StderrLogSource, line, nil)
 		writer.Write(containerlog.Stderr, line)
 	})
@@ -25,8 +25,10 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -34,6 +36,7 @@ import (
 	"github.com/elotl/itzo/pkg/api"
 	"github.com/elotl/itzo/pkg/helper"
 	"github.com/elotl/itzo/pkg/util"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/syndtr/gocapability/capability"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -140,6 +143,47 @@ func TestSetStatus(t *testing.T) {
 	assert.Equal(t, us, *status)
 }
 
+func TestStatusConcurrentAccess(t *testing.T) {
+	u, closer := mkTestUnit(t)
+	defer closer()
+	err := u.SetState(api.UnitState{
+		Running: &api.UnitStateRunning{StartedAt: api.Now()},
+	}, nil)
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	n := 20
+	for i := 0; i < n; i++ {
+		wg.Add(3)
+		go func(restarts int) {
+			defer wg.Done()
+			err := u.SetState(api.UnitState{
+				Running: &api.UnitStateRunning{StartedAt: api.Now()},
+			}, &restarts)
+			assert.NoError(t, err)
+		}(i)
+		go func() {
+			defer wg.Done()
+			ready := true
+			err := u.UpdateStatusAttr(&ready, nil)
+			assert.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			status, err := u.GetStatus()
+			assert.NoError(t, err)
+			if assert.NotNil(t, status) {
+				assert.Equal(t, u.Name, status.Name)
+				assert.NotNil(t, status.State.Running)
+			}
+		}()
+	}
+	wg.Wait()
+	status, err := u.GetStatus()
+	assert.NoError(t, err)
+	assert.True(t, status.Ready)
+	assert.NotNil(t, status.State.Running)
+}
+
 func TestUnitStdin(t *testing.T) {
 	tmpdir, err := ioutil.TempDir("", "itzo-test")
 	assert.NoError(t, err)
@@ -147,6 +191,7 @@ func TestUnitStdin(t *testing.T) {
 	unit, err := OpenUnit(tmpdir, "myunit")
 	assert.NoError(t, err)
 	defer unit.Destroy()
+	unit.unitConfig.Stdin = true
 	ch := make(chan error)
 	inr, err := unit.OpenStdinReader()
 	assert.NoError(t, err)
@@ -268,6 +313,59 @@ func TestUnitRestartPolicyNever(t *testing.T) {
 	assert.True(t, pid > 0)
 }
 
+func TestTerminationMessageFallbackToLogs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		script   string
+		expected string
+	}{
+		{
+			name:     "error",
+			script:   "echo foo; echo bar; exit 1",
+			expected: "foo\nbar",
+		},
+		{
+			name:     "stderr",
+			script:   "echo foo; sleep 0.1; echo oops >&2; exit 2",
+			expected: "foo\noops",
+		},
+		{
+			name:     "success",
+			script:   "echo foo; exit 0",
+			expected: "",
+		},
+		{
+			name:     "termination message file",
+			script:   "echo foo; echo failed > %s; exit 1",
+			expected: "failed\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, closer := mkTestUnit(t)
+			defer closer()
+			msgPath := filepath.Join(u.Directory, "termination-log")
+			u.unitConfig.TerminationMessagePolicy = api.TerminationMessageFallbackToLogsOnError
+			u.unitConfig.TerminationMessagePath = msgPath
+			script := tc.script
+			if strings.Contains(script, "%s") {
+				script = fmt.Sprintf(script, msgPath)
+			}
+			var stdout bytes.Buffer
+			u.RunUnitLoop(
+				[]string{"sh", "-c", script},
+				nil, 0, 0, nil, nil, &stdout, nil, api.RestartPolicyNever)
+			status, err := u.GetStatus()
+			assert.NoError(t, err)
+			assert.NotNil(t, status.State.Terminated)
+			assert.Equal(t, tc.expected, status.State.Terminated.Message)
+			// Output still reaches the original writer.
+			assert.True(t, u.outputTail.wait(5*time.Second))
+			assert.Contains(t, stdout.String(), "foo")
+		})
+	}
+}
+
 func TestUnitRestartPolicyOnFailureHappy(t *testing.T) {
 	tmpfile, err := ioutil.TempFile("", "itzo-test")
 	assert.Nil(t, err)
@@ -359,27 +457,149 @@ func TestIsUnitExistEmpty(t *testing.T) {
 }
 
 func TestMaybeBackoff(t *testing.T) {
-	sleep = func(d time.Duration) {}
+	backOffTimer = func(d time.Duration) <-chan time.Time { return time.After(0) }
+	u, closer := mkTestUnit(t)
+	defer closer()
 	// No error.
 	backoff := 1 * time.Second
 	runningTime := BACKOFF_RESET_TIME / 2
-	maybeBackOff(nil, []string{"mycmd"}, &backoff, runningTime)
+	u.maybeBackOff(nil, []string{"mycmd"}, &backoff, runningTime)
 	assert.Equal(t, backoff, 1*time.Second)
 	// Error.
 	err := fmt.Errorf("Testing maybeBackOff()")
 	backoff = 1 * time.Second
-	maybeBackOff(err, []string{"mycmd"}, &backoff, runningTime)
+	u.maybeBackOff(err, []string{"mycmd"}, &backoff, runningTime)
 	assert.Equal(t, backoff, 2*time.Second)
 	// No error, backoff needs to be reset.
 	backoff = 1 * time.Second
 	runningTime = BACKOFF_RESET_TIME * 2
-	maybeBackOff(nil, []string{"mycmd"}, &backoff, runningTime)
+	u.maybeBackOff(nil, []string{"mycmd"}, &backoff, runningTime)
 	assert.Equal(t, backoff, 1*time.Second)
 	// Error, backoff needs to be reset.
 	backoff = 1 * time.Second
 	runningTime = BACKOFF_RESET_TIME * 2
-	maybeBackOff(err, []string{"mycmd"}, &backoff, runningTime)
+	u.maybeBackOff(err, []string{"mycmd"}, &backoff, runningTime)
 	assert.Equal(t, backoff, 1*time.Second)
+	// Error, backoff is capped.
+	backoff = MAX_BACKOFF_TIME
+	runningTime = 0
+	u.maybeBackOff(err, []string{"mycmd"}, &backoff, runningTime)
+	assert.Equal(t, backoff, MAX_BACKOFF_TIME)
+}
+
+func TestMaybeBackoffStopped(t *testing.T) {
+	backOffTimer = time.After
+	testCases := []struct {
+		name     string
+		state    api.UnitState
+		exitCode int32
+		reason   string
+	}{
+		{
+			name: "exited",
+			state: api.UnitState{
+				Terminated: &api.UnitStateTerminated{
+					ExitCode: 1,
+					Reason:   "Error",
+				},
+			},
+			exitCode: 1,
+			reason:   "Error",
+		},
+		{
+			name: "start failure",
+			state: api.UnitState{
+				Waiting: &api.UnitStateWaiting{
+					StartFailure: true,
+					Reason:       "executable file not found",
+				},
+			},
+			exitCode: 128,
+			reason:   "StartError",
+		},
+	}
+	for _, tc := range testCases {
+		u, closer := mkTestUnit(t)
+		defer closer()
+		assert.NoError(t, u.SetState(tc.state, nil))
+		u.stopChan = make(chan os.Signal, 1)
+		u.stopChan <- syscall.SIGTERM
+		backoff := MAX_BACKOFF_TIME
+		start := time.Now()
+		restart := u.maybeBackOff(fmt.Errorf("exit status 1"), []string{"mycmd"}, &backoff, 0)
+		assert.False(t, restart, tc.name)
+		assert.True(t, time.Since(start) < time.Second, tc.name)
+		assert.True(t, u.stopping, tc.name)
+		status, err := u.GetStatus()
+		assert.NoError(t, err)
+		assert.Nil(t, status.State.Waiting, tc.name)
+		if assert.NotNil(t, status.State.Terminated, tc.name) {
+			assert.Equal(t, tc.exitCode, status.State.Terminated.ExitCode, tc.name)
+			assert.Equal(t, tc.reason, status.State.Terminated.Reason, tc.name)
+		}
+	}
+}
+
+func TestMaybeBackoffConfigured(t *testing.T) {
+	backOffTimer = func(d time.Duration) <-chan time.Time { return time.After(0) }
+	u, closer := mkTestUnit(t)
+	defer closer()
+	u.unitConfig.RestartBackoff = api.RestartBackoff{
+		Base:  10 * time.Second,
+		Max:   30 * time.Second,
+		Reset: time.Minute,
+	}
+	err := fmt.Errorf("Testing maybeBackOff()")
+	backoff, _, _ := u.getRestartBackoff()
+	assert.Equal(t, 10*time.Second, backoff)
+	u.maybeBackOff(err, []string{"mycmd"}, &backoff, 0)
+	assert.Equal(t, 20*time.Second, backoff)
+	u.maybeBackOff(err, []string{"mycmd"}, &backoff, 0)
+	assert.Equal(t, 30*time.Second, backoff)
+	u.maybeBackOff(err, []string{"mycmd"}, &backoff, 0)
+	assert.Equal(t, 30*time.Second, backoff)
+	u.maybeBackOff(err, []string{"mycmd"}, &backoff, 2*time.Minute)
+	assert.Equal(t, 10*time.Second, backoff)
+}
+
+func TestMaybeBackoffState(t *testing.T) {
+	backOffTimer = func(d time.Duration) <-chan time.Time { return time.After(0) }
+	u, closer := mkTestUnit(t)
+	defer closer()
+	terminated := api.UnitState{
+		Terminated: &api.UnitStateTerminated{
+			ExitCode:   1,
+			FinishedAt: api.Now(),
+		},
+	}
+	err := u.SetState(terminated, nil)
+	assert.NoError(t, err)
+	backoff := 1 * time.Second
+	u.maybeBackOff(fmt.Errorf("exit status 1"), []string{"mycmd"}, &backoff, 0)
+	status, err := u.GetStatus()
+	assert.NoError(t, err)
+	assert.NotNil(t, status.State.Waiting)
+	assert.Equal(t, "CrashLoopBackOff", status.State.Waiting.Reason)
+	assert.Contains(t, status.State.Waiting.Message, "back-off 2s")
+	assert.Contains(t, status.State.Waiting.Message, "next restart at")
+	assert.NotNil(t, status.LastTerminationState.Terminated)
+	assert.Equal(t, int32(1), status.LastTerminationState.Terminated.ExitCode)
+	// The last termination state is kept once the unit is running again.
+	err = u.SetState(api.UnitState{
+		Running: &api.UnitStateRunning{StartedAt: api.Now()},
+	}, nil)
+	assert.NoError(t, err)
+	status, err = u.GetStatus()
+	assert.NoError(t, err)
+	assert.NotNil(t, status.State.Running)
+	assert.NotNil(t, status.LastTerminationState.Terminated)
+	// Start failures keep their waiting state.
+	u.setStateToStartFailure(fmt.Errorf("no such file or directory"))
+	u.maybeBackOff(fmt.Errorf("exit status 1"), []string{"mycmd"}, &backoff, 0)
+	status, err = u.GetStatus()
+	assert.NoError(t, err)
+	assert.NotNil(t, status.State.Waiting)
+	assert.True(t, status.State.Waiting.StartFailure)
 }
 
 func int64ptr(i int64) *int64 {
@@ -514,6 +734,72 @@ func TestGetCapabilities(t *testing.T) {
 	for _, c := range defaultCapabilities {
 		assert.Contains(t, caps, c)
 	}
+	// Privileged.
+	privileged := true
+	unit.unitConfig = UnitConfig{
+		SecurityContext: api.SecurityContext{
+			Capabilities: &api.Capabilities{
+				Drop: []string{"ALL"},
+			},
+			Privileged: &privileged,
+		},
+	}
+	caps, err = unit.getCapabilities()
+	assert.NoError(t, err)
+	assert.Len(t, caps, 38)
+}
+
+func TestNoNewPrivs(t *testing.T) {
+	falseval, trueval := false, true
+	testCases := []struct {
+		allowPrivilegeEscalation *bool
+		privileged               *bool
+		expected                 string
+	}{
+		{nil, nil, "0"},
+		{&trueval, nil, "0"},
+		{&falseval, nil, "1"},
+		{&falseval, &trueval, "0"},
+	}
+	for _, tc := range testCases {
+		u, closer := mkTestUnit(t)
+		defer closer()
+		u.unitConfig.SecurityContext.AllowPrivilegeEscalation = tc.allowPrivilegeEscalation
+		u.unitConfig.SecurityContext.Privileged = tc.privileged
+		var stdout bytes.Buffer
+		// RunUnitLoop() might lock the OS thread of the goroutine.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			u.RunUnitLoop(
+				[]string{"sh", "-c", "grep NoNewPrivs /proc/self/status"},
+				nil, 0, 0, nil, nil, &stdout, nil, api.RestartPolicyNever)
+		}()
+		<-done
+		assert.Equal(t, "NoNewPrivs:\t"+tc.expected+"\n", stdout.String())
+	}
+}
+
+func TestMaskProcPaths(t *testing.T) {
+	trueval := true
+	masked, unmasked := api.ProcMountTypeDefault, api.ProcMountTypeUnmasked
+	testCases := []struct {
+		procMount  *api.ProcMountType
+		privileged *bool
+		expected   bool
+	}{
+		{nil, nil, false},
+		{&unmasked, nil, false},
+		{&masked, nil, true},
+		{&masked, &trueval, false},
+	}
+	u, closer := mkTestUnit(t)
+	defer closer()
+	for _, tc := range testCases {
+		u.unitConfig.SecurityContext.ProcMount = tc.procMount
+		u.unitConfig.SecurityContext.Privileged = tc.privileged
+		assert.Equal(t, tc.expected, u.maskProcPaths())
+	}
 }
 
 //mapCapabilities(keys []string) []capability.Cap
@@ -822,3 +1108,502 @@ func TestCmdCleanupFailedProbe(t *testing.T) {
 	}
 	assert.False(t, keepGoing)
 }
+
+func TestStopCmd(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		cmd         []string
+		stopSignal  string
+		forceKilled bool
+	}{
+		{
+			name:        "exits on SIGTERM",
+			cmd:         []string{"/bin/bash", "-c", "trap 'exit 0' TERM; sleep 20 & wait"},
+			forceKilled: false,
+		},
+		{
+			name:        "ignores SIGTERM",
+			cmd:         []string{"/bin/bash", "-c", "trap '' TERM; sleep 20 & wait; sleep 20"},
+			forceKilled: true,
+		},
+		{
+			name:        "exits on image stop signal",
+			cmd:         []string{"/bin/bash", "-c", "trap 'exit 0' QUIT; trap '' TERM; sleep 20 & wait; sleep 20"},
+			stopSignal:  "SIGQUIT",
+			forceKilled: false,
+		},
+	}
+	for i, tc := range tests {
+		msg := fmt.Sprintf("test %d: %s", i, tc.name)
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			u, closer := mkTestUnit(t)
+			defer closer()
+			gracePeriod := int64(1)
+			u.unitConfig.TerminationGracePeriodSeconds = &gracePeriod
+			u.config = &Config{StopSignal: tc.stopSignal}
+			u.stopChan = make(chan os.Signal, 1)
+			cmd := exec.Command(tc.cmd[0], tc.cmd[1:]...)
+			err := cmd.Start()
+			assert.NoError(t, err, msg)
+			testStart := time.Now()
+			// Give bash a moment to set up its trap.
+			time.Sleep(200 * time.Millisecond)
+			u.stopChan <- syscall.SIGTERM
+			_, probeErr := u.watchRunningCmd(cmd, nil, nil, nil)
+			assert.NoError(t, probeErr, msg)
+			assert.True(t, u.stopping, msg)
+			assert.Equal(t, tc.forceKilled, u.forceKilled, msg)
+			if time.Since(testStart) > 10*time.Second {
+				assert.Fail(t, "did not stop command in time", msg)
+			}
+			keepGoing := u.handleCmdCleanup(cmd, nil, nil, api.RestartPolicyAlways, testStart)
+			assert.False(t, keepGoing, msg)
+			s, err := u.GetStatus()
+			assert.NoError(t, err, msg)
+			if assert.NotNil(t, s.State.Terminated, msg) {
+				assert.Equal(t, tc.forceKilled, s.State.Terminated.ForceKilled, msg)
+			}
+		})
+	}
+}
+
+func TestGetTerminationGracePeriod(t *testing.T) {
+	unitSeconds := int64(5)
+	podSeconds := int64(20)
+	imageSeconds := 10
+	testCases := []struct {
+		unitConfig UnitConfig
+		config     *Config
+		expected   time.Duration
+	}{
+		{
+			unitConfig: UnitConfig{},
+			config:     nil,
+			expected:   30 * time.Second,
+		},
+		{
+			unitConfig: UnitConfig{PodTerminationGracePeriodSeconds: &podSeconds},
+			config:     &Config{},
+			expected:   20 * time.Second,
+		},
+		{
+			unitConfig: UnitConfig{},
+			config:     &Config{StopTimeout: &imageSeconds},
+			expected:   10 * time.Second,
+		},
+		{
+			unitConfig: UnitConfig{PodTerminationGracePeriodSeconds: &podSeconds},
+			config:     &Config{StopTimeout: &imageSeconds},
+			expected:   20 * time.Second,
+		},
+		{
+			unitConfig: UnitConfig{
+				TerminationGracePeriodSeconds:    &unitSeconds,
+				PodTerminationGracePeriodSeconds: &podSeconds,
+			},
+			config:   &Config{StopTimeout: &imageSeconds},
+			expected: 5 * time.Second,
+		},
+	}
+	for i, tc := range testCases {
+		u := Unit{unitConfig: tc.unitConfig, config: tc.config}
+		assert.Equal(t, tc.expected, u.GetTerminationGracePeriod(), "test case #%d", i)
+	}
+}
+
+func TestGetStopSignal(t *testing.T) {
+	testCases := []struct {
+		unitConfig UnitConfig
+		config     *Config
+		expected   syscall.Signal
+	}{
+		{
+			unitConfig: UnitConfig{},
+			config:     nil,
+			expected:   syscall.SIGTERM,
+		},
+		{
+			unitConfig: UnitConfig{},
+			config:     &Config{StopSignal: "SIGQUIT"},
+			expected:   syscall.SIGQUIT,
+		},
+		{
+			unitConfig: UnitConfig{StopSignal: "INT"},
+			config:     &Config{StopSignal: "SIGQUIT"},
+			expected:   syscall.SIGINT,
+		},
+		{
+			unitConfig: UnitConfig{},
+			config:     &Config{StopSignal: "SIGBOGUS"},
+			expected:   syscall.SIGTERM,
+		},
+	}
+	for i, tc := range testCases {
+		u := Unit{unitConfig: tc.unitConfig, config: tc.config}
+		assert.Equal(t, tc.expected, u.GetStopSignal(), "test case #%d", i)
+	}
+}
+
+func TestPostStartHook(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		hookCmd  []string
+		reason   string
+		hookFail bool
+		message  string
+	}{
+		{
+			name:     "hook succeeds",
+			hookCmd:  []string{"/bin/true"},
+			reason:   "Completed",
+			hookFail: false,
+		},
+		{
+			name:     "hook fails",
+			hookCmd:  []string{"/bin/sh", "-c", "echo hook error; exit 1"},
+			reason:   "FailedPostStartHook",
+			hookFail: true,
+			message:  "hook error",
+		},
+		{
+			name:     "hook exceeds grace period",
+			hookCmd:  []string{"sleep", "20"},
+			reason:   "FailedPostStartHook",
+			hookFail: true,
+			message:  "did not finish in 1s",
+		},
+	}
+	for i, tc := range tests {
+		msg := fmt.Sprintf("test %d: %s", i, tc.name)
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			u, closer := mkTestUnit(t)
+			defer closer()
+			gracePeriod := int64(1)
+			u.unitConfig.TerminationGracePeriodSeconds = &gracePeriod
+			u.unitConfig.Lifecycle = &api.Lifecycle{
+				PostStart: &api.Handler{
+					Exec: &api.ExecAction{Command: tc.hookCmd},
+				},
+			}
+			ch := make(chan error)
+			go func() {
+				ch <- u.RunUnitLoop(
+					[]string{"sleep", "1"},
+					nil, 0, 0, nil, nil, nil, nil, api.RestartPolicyNever)
+			}()
+			select {
+			case <-ch:
+			case <-time.After(10 * time.Second):
+				assert.FailNow(t, "timed out waiting for unit", msg)
+			}
+			s, err := u.GetStatus()
+			assert.NoError(t, err, msg)
+			if assert.NotNil(t, s.State.Terminated, msg) {
+				assert.Equal(t, tc.reason, s.State.Terminated.Reason, msg)
+				if tc.hookFail {
+					assert.Contains(t, s.State.Terminated.Message, tc.message, msg)
+				}
+			}
+		})
+	}
+}
+
+func TestPostStartHookStopped(t *testing.T) {
+	t.Parallel()
+	u, closer := mkTestUnit(t)
+	defer closer()
+	u.unitConfig.Lifecycle = &api.Lifecycle{
+		PostStart: &api.Handler{
+			Exec: &api.ExecAction{Command: []string{"sleep", "20"}},
+		},
+	}
+	u.stopChan = make(chan os.Signal, 1)
+	start := time.Now()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		u.stopChan <- syscall.SIGTERM
+	}()
+	stopped, err := u.runPostStartHook()
+	assert.True(t, stopped)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestStopCmdPreStopHook(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		hookScript  string
+		forceKilled bool
+		hookFail    bool
+	}{
+		{
+			name:       "hook succeeds",
+			hookScript: "touch MARKER",
+		},
+		{
+			name:       "hook fails",
+			hookScript: "touch MARKER; exit 1",
+			hookFail:   true,
+		},
+		{
+			name:        "hook exceeds grace period",
+			hookScript:  "touch MARKER; sleep 5",
+			forceKilled: true,
+			hookFail:    true,
+		},
+	}
+	for i, tc := range tests {
+		msg := fmt.Sprintf("test %d: %s", i, tc.name)
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			u, closer := mkTestUnit(t)
+			defer closer()
+			gracePeriod := int64(1)
+			u.unitConfig.TerminationGracePeriodSeconds = &gracePeriod
+			marker := filepath.Join(u.Directory, "prestop")
+			hookScript := strings.Replace(tc.hookScript, "MARKER", marker, -1)
+			u.unitConfig.Lifecycle = &api.Lifecycle{
+				PreStop: &api.Handler{
+					Exec: &api.ExecAction{
+						Command: []string{"/bin/sh", "-c", hookScript},
+					},
+				},
+			}
+			u.stopChan = make(chan os.Signal, 1)
+			cmd := exec.Command("/bin/bash", "-c", "trap 'exit 0' TERM; sleep 20 & wait")
+			err := cmd.Start()
+			assert.NoError(t, err, msg)
+			testStart := time.Now()
+			time.Sleep(200 * time.Millisecond)
+			u.stopChan <- syscall.SIGTERM
+			_, probeErr := u.watchRunningCmd(cmd, nil, nil, nil)
+			assert.NoError(t, probeErr, msg)
+			assert.FileExists(t, marker, msg)
+			assert.Equal(t, tc.forceKilled, u.forceKilled, msg)
+			if time.Since(testStart) > 10*time.Second {
+				assert.Fail(t, "did not stop command in time", msg)
+			}
+			u.handleCmdCleanup(cmd, nil, nil, api.RestartPolicyAlways, testStart)
+			s, err := u.GetStatus()
+			assert.NoError(t, err, msg)
+			if assert.NotNil(t, s.State.Terminated, msg) && tc.hookFail {
+				assert.Contains(t, s.State.Terminated.Message, "PreStop hook failed", msg)
+			}
+		})
+	}
+}
+
+type fakeCgroup struct {
+	oomKills uint64
+}
+
+func (c *fakeCgroup) Add(pid int) error {
+	return nil
+}
+
+func (c *fakeCgroup) Delete() error {
+	return nil
+}
+
+func (c *fakeCgroup) OOMKillCount() (uint64, error) {
+	return c.oomKills, nil
+}
+
+func TestHandleCmdCleanupOOMKilled(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		oomKills uint64
+		reason   string
+	}{
+		{
+			name:     "killed by OOM killer",
+			oomKills: 1,
+			reason:   "OOMKilled",
+		},
+		{
+			name:     "killed by someone else",
+			oomKills: 0,
+			reason:   "Error",
+		},
+	}
+	for i, tc := range tests {
+		msg := fmt.Sprintf("test %d: %s", i, tc.name)
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			u, closer := mkTestUnit(t)
+			defer closer()
+			control := &fakeCgroup{}
+			u.control = control
+			initial := uint64(0)
+			u.oomKillCount = &initial
+			cmd := exec.Command("sleep", "10")
+			err := cmd.Start()
+			assert.NoError(t, err, msg)
+			testStart := time.Now()
+			cmd.Process.Kill()
+			cmdErr := cmd.Wait()
+			control.oomKills = tc.oomKills
+			u.handleCmdCleanup(cmd, cmdErr, nil, api.RestartPolicyNever, testStart)
+			s, err := u.GetStatus()
+			assert.NoError(t, err, msg)
+			if assert.NotNil(t, s.State.Terminated, msg) {
+				assert.Equal(t, tc.reason, s.State.Terminated.Reason, msg)
+			}
+		})
+	}
+}
+
+// Mount tables of a unit after it has been pivoted into its rootfs, with a
+// volume, the status file and the special filesystems mounted below it.
+const (
+	overlayRootfsMountinfo = `120 95 0:50 / / rw,relatime - overlay overlay rw,lowerdir=/tosi/l1,upperdir=/tosi/foo/upper,workdir=/tosi/foo/work
+121 120 8:1 /var/lib/itzo/mounts/data /data rw,relatime shared:5 - ext4 /dev/sda1 rw
+122 120 8:1 /var/lib/itzo/mounts/cache /my\040cache rw,relatime shared:6 - ext4 /dev/sda1 rw
+123 120 8:1 /var/lib/itzo/units/foo/status /status rw,relatime - ext4 /dev/sda1 rw
+124 120 0:4 / /proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+125 120 0:6 / /dev rw,nosuid,relatime - devtmpfs devtmpfs rw,mode=755
+126 125 0:22 / /dev/pts rw,nosuid,noexec,relatime - devpts devpts rw,mode=620,ptmxmode=000
+127 120 0:21 / /sys rw,nosuid,nodev,noexec,relatime - sysfs sysfs rw
+`
+	extractedRootfsMountinfo = `120 95 8:1 /var/lib/itzo/units/foo/ROOTFS / rw,relatime - ext4 /dev/sda1 rw
+121 120 8:1 /var/lib/itzo/mounts/data /data rw,relatime shared:5 - ext4 /dev/sda1 rw
+122 120 8:1 /var/lib/itzo/mounts/cache /my\040cache rw,relatime shared:6 - ext4 /dev/sda1 rw
+123 120 8:1 /var/lib/itzo/units/foo/status /status rw,relatime - ext4 /dev/sda1 rw
+124 120 0:4 / /proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+125 120 0:6 / /dev rw,nosuid,relatime - devtmpfs devtmpfs rw,mode=755
+126 125 0:22 / /dev/pts rw,nosuid,noexec,relatime - devpts devpts rw,mode=620,ptmxmode=000
+127 120 0:21 / /sys rw,nosuid,nodev,noexec,relatime - sysfs sysfs rw
+`
+)
+
+func TestReadOnlyRootfsMounts(t *testing.T) {
+	writable := []string{
+		"/data", "/my cache", "/status", "/proc", "/dev", "/dev/pts", "/sys",
+	}
+	testCases := []struct {
+		name                   string
+		mountinfo              string
+		terminationMessagePath string
+		binds                  []string
+	}{
+		{
+			name:                   "overlayfs no termination message",
+			mountinfo:              overlayRootfsMountinfo,
+			terminationMessagePath: "",
+			binds:                  []string{},
+		},
+		{
+			name:                   "overlayfs termination message in dev",
+			mountinfo:              overlayRootfsMountinfo,
+			terminationMessagePath: "/dev/termination-log",
+			binds:                  []string{},
+		},
+		{
+			name:                   "overlayfs termination message in volume",
+			mountinfo:              overlayRootfsMountinfo,
+			terminationMessagePath: "/data/termination-log",
+			binds:                  []string{},
+		},
+		{
+			name:                   "overlayfs termination message in rootfs",
+			mountinfo:              overlayRootfsMountinfo,
+			terminationMessagePath: "/var/log/../log/termination-log",
+			binds:                  []string{"/var/log/termination-log"},
+		},
+		{
+			name:                   "overlayfs termination message next to volume",
+			mountinfo:              overlayRootfsMountinfo,
+			terminationMessagePath: "/database/termination-log",
+			binds:                  []string{"/database/termination-log"},
+		},
+		{
+			name:                   "extracted no termination message",
+			mountinfo:              extractedRootfsMountinfo,
+			terminationMessagePath: "",
+			binds:                  []string{},
+		},
+		{
+			name:                   "extracted termination message in dev",
+			mountinfo:              extractedRootfsMountinfo,
+			terminationMessagePath: "/dev/termination-log",
+			binds:                  []string{},
+		},
+		{
+			name:                   "extracted termination message in volume",
+			mountinfo:              extractedRootfsMountinfo,
+			terminationMessagePath: "/my cache/termination-log",
+			binds:                  []string{},
+		},
+		{
+			name:                   "extracted termination message in rootfs",
+			mountinfo:              extractedRootfsMountinfo,
+			terminationMessagePath: "/termination-log",
+			binds:                  []string{"/termination-log"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mountPoints := findMountPoints(strings.NewReader(tc.mountinfo))
+			assert.Equal(t, "/", mountPoints[0])
+			binds, kept := readOnlyRootfsMounts(
+				mountPoints, tc.terminationMessagePath)
+			assert.Equal(t, tc.binds, binds)
+			// Volumes, /dev, /proc and the status file are mounts of
+			// their own, left alone when the root is remounted.
+			assert.Equal(t, writable, kept)
+		})
+	}
+}
+
+func TestGetSeccompProfile(t *testing.T) {
+	u, closer := mkTestUnit(t)
+	defer closer()
+	profile, err := u.getSeccompProfile(defaultCapabilities)
+	assert.NoError(t, err)
+	assert.Nil(t, profile)
+	u.unitConfig.SeccompProfile = &api.SeccompProfile{
+		Type: api.SeccompProfileTypeUnconfined,
+	}
+	profile, err = u.getSeccompProfile(defaultCapabilities)
+	assert.NoError(t, err)
+	assert.Nil(t, profile)
+	u.unitConfig.SeccompProfile = &api.SeccompProfile{
+		Type: api.SeccompProfileTypeRuntimeDefault,
+	}
+	profile, err = u.getSeccompProfile(defaultCapabilities)
+	assert.NoError(t, err)
+	assert.NotNil(t, profile)
+	u.unitConfig.SeccompProfile = &api.SeccompProfile{
+		Type: api.SeccompProfileTypeLocalhost,
+	}
+	_, err = u.getSeccompProfile(defaultCapabilities)
+	assert.Error(t, err)
+	u.unitConfig.SeccompLocalhostProfile = &specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+	}
+	profile, err = u.getSeccompProfile(defaultCapabilities)
+	assert.NoError(t, err)
+	assert.Equal(t, u.unitConfig.SeccompLocalhostProfile, profile)
+	u.unitConfig.SeccompProfile = &api.SeccompProfile{Type: "foo"}
+	_, err = u.getSeccompProfile(defaultCapabilities)
+	assert.Error(t, err)
+	// Privileged units are unconfined.
+	privileged := true
+	u.unitConfig.SecurityContext.Privileged = &privileged
+	u.unitConfig.SeccompProfile = &api.SeccompProfile{
+		Type: api.SeccompProfileTypeRuntimeDefault,
+	}
+	profile, err = u.getSeccompProfile(defaultCapabilities)
+	assert.NoError(t, err)
+	assert.Nil(t, profile)
+}
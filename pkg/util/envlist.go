@@ -64,6 +64,53 @@ func APIEnvVarsToMap(envs []api.EnvVar) map[string]string {
 	return result
 }
 
+// EnvironToMap constructs a map of environment name to value from a list of
+// "key=value" strings. Later entries override earlier ones.
+func EnvironToMap(env []string) map[string]string {
+	result := make(map[string]string, len(env))
+	for _, e := range env {
+		items := strings.SplitN(e, "=", 2)
+		if len(items) != 2 {
+			continue
+		}
+		result[items[0]] = items[1]
+	}
+	return result
+}
+
+// MergeEnv adds the environment of the spec to the default environment from
+// the image config, overwriting default variables if necessary.
+func MergeEnv(imageEnv, specEnv []string) []string {
+	env := imageEnv
+	for _, e := range specEnv {
+		items := strings.SplitN(e, "=", 2)
+		if len(items) != 2 {
+			continue
+		}
+		env = AddToEnvList(env, items[0], items[1], true)
+	}
+	return env
+}
+
+// ExpandContainerCommandAndArgs expands $(VAR) references in command and args
+// the same way kubelet does, using env, a list of "key=value" strings that
+// has been fully resolved. "$$" is an escaped "$", and references to
+// variables that are not defined are left as they are.
+func ExpandContainerCommandAndArgs(command, args, env []string) ([]string, []string) {
+	mapping := expansion.MappingFuncFor(EnvironToMap(env))
+	expand := func(in []string) []string {
+		if len(in) == 0 {
+			return in
+		}
+		out := make([]string, 0, len(in))
+		for _, s := range in {
+			out = append(out, expansion.Expand(s, mapping))
+		}
+		return out
+	}
+	return expand(command), expand(args)
+}
+
 // ExpandContainerCommandOnlyStatic substitutes only static environment variable values from the
 // container environment definitions. This does *not* include valueFrom substitutions.
 // TODO: callers should use ExpandContainerCommandAndArgs with a fully resolved list of environment.
@@ -79,3 +79,44 @@ func TestAddToEnvList(t *testing.T) {
 		assert.ElementsMatch(t, tc.result, res, description)
 	}
 }
+
+func TestMergeEnv(t *testing.T) {
+	imageEnv := []string{"PATH=/usr/bin", "HOME=/root"}
+	specEnv := []string{"HOME=/home/app", "FOO=bar=baz"}
+	env := MergeEnv(imageEnv, specEnv)
+	assert.ElementsMatch(t,
+		[]string{"PATH=/usr/bin", "HOME=/home/app", "FOO=bar=baz"}, env)
+	assert.Equal(t, map[string]string{
+		"PATH": "/usr/bin",
+		"HOME": "/home/app",
+		"FOO":  "bar=baz",
+	}, EnvironToMap(env))
+}
+
+func TestExpandContainerCommandAndArgs(t *testing.T) {
+	env := MergeEnv(
+		[]string{"GREETING=hi", "NAME=image"},
+		[]string{"NAME=spec", "EMPTY="})
+	testCases := []struct {
+		in       string
+		expected string
+	}{
+		{"$(GREETING)", "hi"},
+		{"$(GREETING), $(NAME)!", "hi, spec!"},
+		{"$$(NAME)", "$(NAME)"},
+		{"$$$(NAME)", "$spec"},
+		{"$(MISSING)", "$(MISSING)"},
+		{"[$(EMPTY)]", "[]"},
+		{"$NAME", "$NAME"},
+		{"$(NAME", "$(NAME"},
+	}
+	for _, tc := range testCases {
+		command, args := ExpandContainerCommandAndArgs(
+			[]string{"/bin/echo", tc.in}, []string{tc.in}, env)
+		assert.Equal(t, []string{"/bin/echo", tc.expected}, command, tc.in)
+		assert.Equal(t, []string{tc.expected}, args, tc.in)
+	}
+	command, args := ExpandContainerCommandAndArgs(nil, nil, env)
+	assert.Nil(t, command)
+	assert.Nil(t, args)
+}
@@ -18,6 +18,7 @@ package kill
 
 import (
 	"os"
+	"syscall"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/mitchellh/go-ps"
@@ -31,7 +32,7 @@ type Process struct {
 
 type ProcessHandler interface {
 	ListProcesses() ([]Process, error)
-	KillProcess(pid int) error
+	SignalProcess(pid int, sig syscall.Signal) error
 }
 
 type OSProcessHandler struct{}
@@ -52,12 +53,12 @@ func (p *OSProcessHandler) ListProcesses() ([]Process, error) {
 	return processes, nil
 }
 
-func (p *OSProcessHandler) KillProcess(pid int) error {
+func (p *OSProcessHandler) SignalProcess(pid int, sig syscall.Signal) error {
 	process, err := os.FindProcess(pid)
 	if err != nil {
 		return err
 	}
-	return process.Kill()
+	return process.Signal(sig)
 }
 
 type ProcessTreeKiller struct {
@@ -71,11 +72,16 @@ func NewProcessTreeKiller(handler ProcessHandler) *ProcessTreeKiller {
 }
 
 func (ptk *ProcessTreeKiller) KillProcessTree(ppid int) error {
+	return ptk.SignalProcessTree(ppid, syscall.SIGKILL)
+}
+
+// SignalProcessTree sends sig to ppid and all of its descendants.
+func (ptk *ProcessTreeKiller) SignalProcessTree(ppid int, sig syscall.Signal) error {
 	processes, err := ptk.handler.ListProcesses()
 	if err != nil {
 		return err
 	}
-	return ptk.killProcessTree(ppid, processes, nil)
+	return ptk.signalProcessTree(ppid, sig, processes, nil)
 }
 
 func copyExcept(processes []Process, except int) []Process {
@@ -88,18 +94,18 @@ func copyExcept(processes []Process, except int) []Process {
 	return result
 }
 
-func (ptk *ProcessTreeKiller) killProcessTree(ppid int, processes []Process, result error) error {
+func (ptk *ProcessTreeKiller) signalProcessTree(ppid int, sig syscall.Signal, processes []Process, result error) error {
 	for i, proc := range processes {
 		if proc.PPid != ppid {
 			continue
 		}
 		reduced := copyExcept(processes, i)
-		err := ptk.killProcessTree(proc.Pid, reduced, result)
+		err := ptk.signalProcessTree(proc.Pid, sig, reduced, result)
 		if err != nil {
 			result = multierror.Append(result, err)
 		}
 	}
-	err := ptk.handler.KillProcess(ppid)
+	err := ptk.handler.SignalProcess(ppid, sig)
 	if err != nil {
 		result = multierror.Append(result, err)
 	}
@@ -18,6 +18,7 @@ package kill
 
 import (
 	"fmt"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -27,6 +28,7 @@ type MockProcessHandler struct {
 	Processes     []Process
 	LiveProcesses []Process
 	KillList      []int
+	Signals       map[int]syscall.Signal
 	ListFailure   bool
 	KillFailure   bool
 }
@@ -40,7 +42,7 @@ func (p *MockProcessHandler) ListProcesses() ([]Process, error) {
 	return ret, nil
 }
 
-func (p *MockProcessHandler) KillProcess(pid int) error {
+func (p *MockProcessHandler) SignalProcess(pid int, sig syscall.Signal) error {
 	if p.KillFailure {
 		return fmt.Errorf("mock KillProcess() failure")
 	}
@@ -52,6 +54,10 @@ func (p *MockProcessHandler) KillProcess(pid int) error {
 	for _, proc := range p.Processes {
 		if proc.Pid == pid {
 			p.KillList = append(p.KillList, pid)
+			if p.Signals == nil {
+				p.Signals = make(map[int]syscall.Signal)
+			}
+			p.Signals[pid] = sig
 			return nil
 		}
 	}
@@ -178,3 +184,47 @@ func TestKillProcessTree(t *testing.T) {
 		assert.ElementsMatch(t, tc.killList, mph.KillList, msg)
 	}
 }
+
+func TestSignalProcessTree(t *testing.T) {
+	mph := MockProcessHandler{
+		Processes: []Process{
+			{10, 1, "parent"},
+			{20, 10, "child"},
+			{30, 20, "grandchild"},
+			{40, 1, "otherprocess"},
+		},
+	}
+	ptk := NewProcessTreeKiller(&mph)
+	err := ptk.SignalProcessTree(10, syscall.SIGTERM)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []int{10, 20, 30}, mph.KillList)
+	for _, pid := range mph.KillList {
+		assert.Equal(t, syscall.SIGTERM, mph.Signals[pid])
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	testCases := []struct {
+		input   string
+		sig     syscall.Signal
+		failure bool
+	}{
+		{input: "SIGQUIT", sig: syscall.SIGQUIT},
+		{input: "QUIT", sig: syscall.SIGQUIT},
+		{input: "sigint", sig: syscall.SIGINT},
+		{input: "15", sig: syscall.SIGTERM},
+		{input: "SIGRTMIN+3", failure: true},
+		{input: "0", failure: true},
+		{input: "", failure: true},
+	}
+	for i, tc := range testCases {
+		msg := fmt.Sprintf("test case #%d %+v failed", i, tc)
+		sig, err := ParseSignal(tc.input)
+		if tc.failure {
+			assert.Error(t, err, msg)
+			continue
+		}
+		assert.NoError(t, err, msg)
+		assert.Equal(t, tc.sig, sig, msg)
+	}
+}
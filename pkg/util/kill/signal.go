@@ -0,0 +1,73 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kill
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var signalMap = map[string]syscall.Signal{
+	"ABRT":  syscall.SIGABRT,
+	"ALRM":  syscall.SIGALRM,
+	"BUS":   syscall.SIGBUS,
+	"CHLD":  syscall.SIGCHLD,
+	"CONT":  syscall.SIGCONT,
+	"FPE":   syscall.SIGFPE,
+	"HUP":   syscall.SIGHUP,
+	"ILL":   syscall.SIGILL,
+	"INT":   syscall.SIGINT,
+	"IO":    syscall.SIGIO,
+	"KILL":  syscall.SIGKILL,
+	"PIPE":  syscall.SIGPIPE,
+	"PROF":  syscall.SIGPROF,
+	"QUIT":  syscall.SIGQUIT,
+	"SEGV":  syscall.SIGSEGV,
+	"STOP":  syscall.SIGSTOP,
+	"SYS":   syscall.SIGSYS,
+	"TERM":  syscall.SIGTERM,
+	"TRAP":  syscall.SIGTRAP,
+	"TSTP":  syscall.SIGTSTP,
+	"TTIN":  syscall.SIGTTIN,
+	"TTOU":  syscall.SIGTTOU,
+	"URG":   syscall.SIGURG,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+	"XCPU":  syscall.SIGXCPU,
+	"XFSZ":  syscall.SIGXFSZ,
+}
+
+// ParseSignal translates a signal specification as found in image configs,
+// e.g. "SIGQUIT", "QUIT" or "3", into a signal.
+func ParseSignal(s string) (syscall.Signal, error) {
+	s = strings.TrimSpace(s)
+	if num, err := strconv.Atoi(s); err == nil {
+		if num <= 0 || num > 64 {
+			return 0, fmt.Errorf("invalid signal number %d", num)
+		}
+		return syscall.Signal(num), nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	sig, ok := signalMap[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", s)
+	}
+	return sig, nil
+}
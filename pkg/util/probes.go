@@ -37,3 +37,24 @@ func TranslateProbePorts(unit *api.Unit, probe *api.Probe) *api.Probe {
 	}
 }
 
+
+// TranslateLifecyclePorts translates named ports in the handlers of the
+// lifecycle hooks of a unit, the same way TranslateProbePorts does for
+// probes.
+func TranslateLifecyclePorts(unit *api.Unit, lifecycle *api.Lifecycle) *api.Lifecycle {
+	if lifecycle == nil {
+		return nil
+	}
+	lc := *lifecycle
+	lc.PostStart = translateHandlerPorts(unit, lc.PostStart)
+	lc.PreStop = translateHandlerPorts(unit, lc.PreStop)
+	return &lc
+}
+
+func translateHandlerPorts(unit *api.Unit, handler *api.Handler) *api.Handler {
+	if handler == nil {
+		return nil
+	}
+	p := TranslateProbePorts(unit, &api.Probe{Handler: *handler})
+	return &p.Handler
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/elotl/itzo/pkg/api"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// These are the same values the kubelet uses when converting CPU requests and
+// limits into cgroup settings.
+const (
+	minShares     = 2
+	sharesPerCPU  = 1024
+	milliCPUToCPU = 1000
+
+	// 100000 is equivalent to 100ms.
+	quotaPeriod    = 100000
+	minQuotaPeriod = 1000
+)
+
+// MilliCPUToShares converts milliCPU to CPU shares.
+func MilliCPUToShares(milliCPU int64) uint64 {
+	if milliCPU == 0 {
+		// Return 2 here to really match kernel default for zero milliCPU.
+		return minShares
+	}
+	shares := (milliCPU * sharesPerCPU) / milliCPUToCPU
+	if shares < minShares {
+		return minShares
+	}
+	return uint64(shares)
+}
+
+// MilliCPUToQuota converts milliCPU to a CFS quota for the given period.
+func MilliCPUToQuota(milliCPU int64, period int64) int64 {
+	if milliCPU == 0 {
+		return 0
+	}
+	quota := (milliCPU * period) / milliCPUToCPU
+	if quota < minQuotaPeriod {
+		quota = minQuotaPeriod
+	}
+	return quota
+}
+
+func getQuantity(list api.ResourceList, name api.ResourceName) (resource.Quantity, bool) {
+	q, ok := list[name]
+	if !ok || q.IsZero() {
+		return resource.Quantity{}, false
+	}
+	return q, true
+}
+
+// UnitResourcesToLinux translates the resource requests and limits of a unit
+// into cgroup settings: the CPU request into CPU shares, the CPU limit into a
+// CFS quota, and the memory and pids limits into the corresponding cgroup
+// limits. As with Kubernetes containers, a missing CPU request defaults to the
+// CPU limit.
+func UnitResourcesToLinux(resources api.ResourceRequirements) *specs.LinuxResources {
+	lr := &specs.LinuxResources{}
+	cpuRequest, hasCPURequest := getQuantity(resources.Requests, api.ResourceCPU)
+	cpuLimit, hasCPULimit := getQuantity(resources.Limits, api.ResourceCPU)
+	if !hasCPURequest && hasCPULimit {
+		cpuRequest, hasCPURequest = cpuLimit, true
+	}
+	if hasCPURequest || hasCPULimit {
+		lr.CPU = &specs.LinuxCPU{}
+	}
+	if hasCPURequest {
+		shares := MilliCPUToShares(cpuRequest.MilliValue())
+		lr.CPU.Shares = &shares
+	}
+	if hasCPULimit {
+		period := uint64(quotaPeriod)
+		quota := MilliCPUToQuota(cpuLimit.MilliValue(), quotaPeriod)
+		lr.CPU.Period = &period
+		lr.CPU.Quota = &quota
+	}
+	if memoryLimit, ok := getQuantity(resources.Limits, api.ResourceMemory); ok {
+		limit := memoryLimit.Value()
+		lr.Memory = &specs.LinuxMemory{Limit: &limit}
+	}
+	if pidsLimit, ok := getQuantity(resources.Limits, api.ResourcePIDs); ok {
+		lr.Pids = &specs.LinuxPids{Limit: pidsLimit.Value()}
+	}
+	return lr
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/elotl/itzo/pkg/api"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestUnitResourcesToLinux(t *testing.T) {
+	uint64Ptr := func(v uint64) *uint64 { return &v }
+	int64Ptr := func(v int64) *int64 { return &v }
+	testCases := []struct {
+		resources api.ResourceRequirements
+		expected  *specs.LinuxResources
+	}{
+		{
+			resources: api.ResourceRequirements{},
+			expected:  &specs.LinuxResources{},
+		},
+		{
+			resources: api.ResourceRequirements{
+				Requests: api.ResourceList{
+					api.ResourceCPU: resource.MustParse("250m"),
+				},
+			},
+			expected: &specs.LinuxResources{
+				CPU: &specs.LinuxCPU{Shares: uint64Ptr(256)},
+			},
+		},
+		{
+			// The CPU request defaults to the limit.
+			resources: api.ResourceRequirements{
+				Limits: api.ResourceList{
+					api.ResourceCPU:    resource.MustParse("1500m"),
+					api.ResourceMemory: resource.MustParse("128Mi"),
+					api.ResourcePIDs:   resource.MustParse("100"),
+				},
+			},
+			expected: &specs.LinuxResources{
+				CPU: &specs.LinuxCPU{
+					Shares: uint64Ptr(1536),
+					Period: uint64Ptr(100000),
+					Quota:  int64Ptr(150000),
+				},
+				Memory: &specs.LinuxMemory{Limit: int64Ptr(128 * 1024 * 1024)},
+				Pids:   &specs.LinuxPids{Limit: 100},
+			},
+		},
+		{
+			resources: api.ResourceRequirements{
+				Requests: api.ResourceList{
+					api.ResourceCPU: resource.MustParse("1m"),
+				},
+				Limits: api.ResourceList{
+					api.ResourceCPU:    resource.MustParse("2m"),
+					api.ResourceMemory: resource.MustParse("0"),
+				},
+			},
+			expected: &specs.LinuxResources{
+				CPU: &specs.LinuxCPU{
+					Shares: uint64Ptr(2),
+					Period: uint64Ptr(100000),
+					Quota:  int64Ptr(1000),
+				},
+			},
+		},
+	}
+	for i, tc := range testCases {
+		lr := UnitResourcesToLinux(tc.resources)
+		assert.Equal(t, tc.expected, lr, "test case #%d", i)
+	}
+}
@@ -16,6 +16,9 @@ if [[ $2 == "logs" ]]; then
 elif [[ $2 == "status" ]]; then
     path=http://$ip:6421/rest/v1/status
     curl $path
+elif [[ $2 == "events" ]]; then
+    path=http://$ip:6421/rest/v1/events
+    curl $path
 elif [[ $2 == "update" ]]; then
     echo "update"
     path=http://$ip:6421/rest/v1/updatepod